@@ -2,6 +2,17 @@
   {{  . | toYaml | trim | sha256sum | substr 0 10 }}
 {{- end }}
 
+{{/*
+Hash of the configuration, the fragments are only included if some are set to keep the name of existing ConfigMaps
+*/}}
+{{- define "configHash" -}}
+{{- if .Values.configFragments }}
+{{- include "yamlHash" (list .Values.config .Values.configFragments) }}
+{{- else }}
+{{- include "yamlHash" .Values.config }}
+{{- end }}
+{{- end }}
+
 {{/*
 Common labels
 */}}
@@ -22,6 +22,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/go-logr/logr"
 
@@ -44,11 +45,13 @@ import (
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client/custom_api"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client/elasticsearch"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/controller"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/monitoring"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/profiling"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/provider"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/reload"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/scheduler"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
 )
@@ -57,6 +60,10 @@ const (
 	serviceType                  = "elasticsearch-k8s-metrics-adapter"
 	elastisearchMetricServerType = "elasticsearch"
 	customMetricServerType       = "custom"
+
+	// shutdownTimeout is how long the in-flight requests to the metric servers, and the buffered APM data, are awaited
+	// once the API server is stopped.
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
@@ -74,6 +81,8 @@ func main() {
 	cmd.Flags().BoolVar(&cmd.Insecure, "insecure", false, "if true authentication and authorization are disabled, only to be used in dev mode")
 	cmd.Flags().IntVar(&cmd.MonitoringPort, "monitoring-port", 9090, "port to expose readiness and Prometheus metrics")
 	cmd.Flags().IntVar(&cmd.ProfilingPort, "profiling-port", 0, "port to expose pprof profiling")
+	cmd.Flags().StringVar(&cmd.ConfigPath, "config", config.Path, "path to the configuration file, or to a directory whose *.yml files are merged in the order of their names")
+	cmd.Flags().BoolVar(&cmd.MetricServerResources, "metric-server-resources", false, "if true metric servers are also read from MetricServer and ElasticsearchMetricSet resources")
 	cmd.Flags().AddGoFlagSet(flag.CommandLine) // make sure we get the klog flags
 	err := cmd.Flags().Parse(os.Args)
 	if err != nil {
@@ -84,18 +93,21 @@ func main() {
 	defer flushLogs()
 	logger = log.ForPackage("main")
 
-	adapterCfg, err := config.Parse()
+	adapterCfg, err := config.Load(cmd.ConfigPath)
 	if err != nil {
 		logErrorAndExit(err, "Unable to parse adapter configuration")
 	}
 
+	// ctx is done when SIGTERM or SIGINT is received, the adapter then stops gracefully.
+	ctx := genericapiserver.SetupSignalContext()
+
 	logger.Info("Starting monitoring server...")
 	monitoringServer := monitoring.NewServer(adapterCfg.MetricServers, cmd.MonitoringPort, adapterCfg.ReadinessProbe.FailureThreshold)
 	go monitoringServer.Start()
 
 	if cmd.ProfilingPort > 0 {
 		logger.Info("Starting profiling server...")
-		go profiling.StartProfiling(cmd.ProfilingPort)
+		go profiling.StartProfiling(ctx, cmd.ProfilingPort)
 	}
 
 	apmTracer, err := apm.NewTracer(serviceType, serviceVersion)
@@ -109,13 +121,53 @@ func main() {
 		logErrorAndExit(err, "Unable to create metrics provider")
 	}
 
+	monitoringServer.WithNodesReporters(metricsClients...).WithCircuitBreakers(metricsClients...)
+	// The clients are reloaded and closed, not the cache.
+	clients := metricsClients
+	metricsClients = client.WithCache(metricsClients...)
+
+	metricsRegistry := registry.NewRegistry().WithRouting(adapterCfg.Routing)
+	monitoringServer.WithRoutingExplainer(metricsRegistry)
+	metricListeners := []scheduler.MetricListener{monitoringServer, metricsRegistry}
+	errorListeners := []scheduler.ErrorListener{monitoringServer}
 	scheduler := scheduler.NewScheduler(metricsClients...)
-	metricsRegistry := registry.NewRegistry()
+	reloader := reload.NewReloader(
+		adapterCfg,
+		clients,
+		func(metricServer config.MetricServer) (client.Interface, error) {
+			return cmd.newMetricsClient(metricServer, apmTracer)
+		},
+		scheduler,
+		metricsRegistry,
+		monitoringServer,
+	)
+
+	var metricServersController *controller.Controller
+	if cmd.MetricServerResources {
+		dynamicClient, err := cmd.DynamicClient()
+		if err != nil {
+			logErrorAndExit(err, "Unable to construct dynamic client")
+		}
+		metricServersController = controller.NewController(dynamicClient, reloader)
+		metricListeners = append(metricListeners, metricServersController)
+		errorListeners = append(errorListeners, metricServersController)
+	}
 	scheduler.
-		WithMetricListeners(monitoringServer, metricsRegistry).
-		WithErrorListeners(monitoringServer).
-		Start().
-		WaitInitialSync()
+		WithMetricListeners(metricListeners...).
+		WithErrorListeners(errorListeners...).
+		Start(ctx)
+	if metricServersController != nil {
+		logger.Info("Starting metric server resources controller...")
+		// The metric servers of the existing resources are added before the initial sync.
+		if err := metricServersController.Start(ctx); err != nil {
+			logErrorAndExit(err, "Unable to start metric server resources controller")
+		}
+	}
+	scheduler.WaitInitialSync(adapterCfg.GetInitialSyncTimeout())
+
+	if err := reloader.Watch(ctx, cmd.ConfigPath); err != nil {
+		logErrorAndExit(err, "Unable to watch adapter configuration")
+	}
 	aggProvider := provider.NewAggregationProvider(metricsRegistry, apmTracer)
 
 	cmd.WithCustomMetrics(aggProvider)
@@ -126,9 +178,30 @@ func main() {
 	}
 
 	logger.Info("Starting elastic k8s metrics adapter...")
-	if err := cmd.Run(context.WithoutCancel(context.Background())); err != nil {
+	// Run returns once the API server is stopped and the in-flight requests are completed.
+	if err := cmd.Run(ctx); err != nil {
 		logErrorAndExit(err, "Unable to run elastic k8s metrics adapter")
 	}
+	shutdown(scheduler, monitoringServer, apmTracer, reloader.Clients())
+}
+
+// shutdown stops the metric sources and the monitoring server, releases the resources held by the clients and flushes
+// the buffered APM data, within shutdownTimeout.
+func shutdown(scheduler *scheduler.Scheduler, monitoringServer *monitoring.Server, tracer *apm.Tracer, clients []client.Interface) {
+	logger.Info("Stopping elastic k8s metrics adapter...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	scheduler.Stop()
+	scheduler.Wait()
+	if err := client.Close(ctx, clients...); err != nil {
+		logger.Error(err, "Failed to close metric clients")
+	}
+	if err := monitoringServer.Shutdown(ctx); err != nil {
+		logger.Error(err, "Failed to stop monitoring server")
+	}
+	tracer.Flush(ctx.Done())
+	tracer.Close()
+	logger.Info("Elastic k8s metrics adapter stopped")
 }
 
 type ElasticsearchAdapter struct {
@@ -138,9 +211,25 @@ type ElasticsearchAdapter struct {
 	PrometheusMetricsEnabled bool
 	MonitoringPort           int
 	ProfilingPort            int
+	ConfigPath               string
+	MetricServerResources    bool
 }
 
 func (a *ElasticsearchAdapter) newMetricsClients(adapterCfg *config.Config, tracer *apm.Tracer) ([]client.Interface, error) {
+	var clients []client.Interface
+	for _, clientCfg := range adapterCfg.MetricServers {
+		metricsClient, err := a.newMetricsClient(clientCfg, tracer)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, metricsClient)
+	}
+	return clients, nil
+}
+
+// newMetricsClient creates the client of a metric server, it is also used to create the clients of the metric servers
+// added or changed when the configuration is reloaded.
+func (a *ElasticsearchAdapter) newMetricsClient(clientCfg config.MetricServer, tracer *apm.Tracer) (client.Interface, error) {
 	dynamicClient, err := a.DynamicClient()
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct dynamic dynamicClient: %w", err)
@@ -151,39 +240,34 @@ func (a *ElasticsearchAdapter) newMetricsClients(adapterCfg *config.Config, trac
 		return nil, fmt.Errorf("unable to construct dynamicClient REST mapper: %w", err)
 	}
 
-	var clients []client.Interface
-	for _, clientCfg := range adapterCfg.MetricServers {
-		switch clientCfg.ServerType {
-		case elastisearchMetricServerType:
-			esMetricClient, err := elasticsearch.NewElasticsearchClient(
-				clientCfg,
-				dynamicClient,
-				mapper,
-				tracer,
-			)
-			if err != nil {
-				return nil, fmt.Errorf("unable to construct Elasticsearch dynamicClient: %w", err)
-			}
-			clients = append(clients, esMetricClient)
-		case customMetricServerType:
-			kubeClientCfg, err := a.ClientConfig()
-			if err != nil {
-				return nil, fmt.Errorf("unable to construct Kubernetes dynamicClient config: %w", err)
-			}
-			kubeClient, err := kubernetes.NewForConfig(kubeClientCfg)
-			if err != nil {
-				return nil, fmt.Errorf("unable to construct Kubernetes dynamicClient: %w", err)
-			}
-			metricApiClient, err := custom_api.NewMetricApiClientProvider(kubeClientCfg, mapper).NewClient(kubeClient, clientCfg)
-			if err != nil {
-				return nil, fmt.Errorf("unable to construct Kubernetes custom metric API dynamicClient: %w", err)
-			}
-			clients = append(clients, metricApiClient)
+	switch clientCfg.ServerType {
+	case elastisearchMetricServerType:
+		esMetricClient, err := elasticsearch.NewElasticsearchClient(
+			clientCfg,
+			dynamicClient,
+			mapper,
+			tracer,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct Elasticsearch dynamicClient: %w", err)
 		}
-
+		return esMetricClient, nil
+	case customMetricServerType:
+		kubeClientCfg, err := a.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct Kubernetes dynamicClient config: %w", err)
+		}
+		kubeClient, err := kubernetes.NewForConfig(kubeClientCfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct Kubernetes dynamicClient: %w", err)
+		}
+		metricApiClient, err := custom_api.NewMetricApiClientProvider(kubeClientCfg, mapper).NewClient(kubeClient, clientCfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct Kubernetes custom metric API dynamicClient: %w", err)
+		}
+		return metricApiClient, nil
 	}
-
-	return clients, nil
+	return nil, fmt.Errorf("unknown metric server type: %s", clientCfg.ServerType)
 }
 
 func logErrorAndExit(err error, msg string) {
@@ -0,0 +1,214 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed lets all the requests through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects all the requests.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single trial request through, the circuit is closed if it succeeds.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// ErrCircuitOpen is returned when a request is rejected because the circuit of a metric server is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "The state of the circuit breaker of a metrics server: 0 if closed, 1 if half-open, 2 if open",
+	}, []string{"client"})
+	breakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_rejected_total",
+		Help: "The total number of requests rejected by the circuit breaker of a metrics server",
+	}, []string{"client"})
+)
+
+var breakerStateValues = map[BreakerState]float64{
+	BreakerClosed:   0,
+	BreakerHalfOpen: 1,
+	BreakerOpen:     2,
+}
+
+// CircuitBreaker makes the requests to a metric server fail fast after consecutive failures. A nil CircuitBreaker lets
+// all the requests through.
+type CircuitBreaker struct {
+	client       string
+	threshold    int
+	openDuration time.Duration
+	now          func() time.Time
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probing is true while the trial request of a half-open circuit is in flight.
+	probing bool
+}
+
+// NewCircuitBreaker creates the circuit breaker of a metric server, or returns nil if it is not enabled.
+func NewCircuitBreaker(metricServer config.MetricServer) *CircuitBreaker {
+	if metricServer.CircuitBreaker == nil {
+		return nil
+	}
+	b := &CircuitBreaker{
+		client:       metricServer.Name,
+		threshold:    metricServer.CircuitBreaker.FailureThreshold,
+		openDuration: metricServer.CircuitBreaker.GetOpenDuration(),
+		now:          time.Now,
+	}
+	b.setState(BreakerClosed)
+	return b
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openDuration {
+		b.setState(BreakerHalfOpen)
+	}
+	switch {
+	case b.state == BreakerOpen, b.state == BreakerHalfOpen && b.probing:
+		breakerRejected.WithLabelValues(b.client).Inc()
+		return ErrCircuitOpen
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// Release ends a request which has been allowed without recording its result.
+func (b *CircuitBreaker) Release() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+// RecordResult records the result of a request which has been allowed, unless it has been cancelled by the caller.
+func (b *CircuitBreaker) RecordResult(ctx context.Context, res *http.Response, err error) {
+	if IsCancelled(ctx, err) {
+		b.Release()
+		return
+	}
+	b.Record(!IsFailure(res, err))
+}
+
+// Record records the result of a request which has been allowed.
+func (b *CircuitBreaker) Record(success bool) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openDuration {
+		// The next request is a trial request.
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	breakerState.WithLabelValues(b.client).Set(breakerStateValues[state])
+}
+
+// IsFailure returns true if the result of a request means that the server is unavailable or overloaded.
+func IsFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrCircuitOpen) && !errors.Is(err, context.Canceled)
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError
+}
+
+// IsCancelled returns true if a request failed because its context has been cancelled, or its deadline exceeded, by the
+// caller before the query timeout of the server has elapsed. The error does not tell anything about the server.
+func IsCancelled(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil && !errors.Is(context.Cause(ctx), ErrQueryTimeout)
+}
+
+// WrapTransport returns a transport which sends the requests through the circuit breaker.
+func (b *CircuitBreaker) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	if b == nil {
+		return next
+	}
+	return &breakerTransport{breaker: b, next: next}
+}
+
+type breakerTransport struct {
+	breaker *CircuitBreaker
+	next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	res, err := t.next.RoundTrip(req)
+	t.breaker.RecordResult(req.Context(), res, err)
+	return res, err
+}
+
+// CircuitBreakerReporter is implemented by the clients which use a circuit breaker.
+type CircuitBreakerReporter interface {
+	// CircuitBreaker returns the circuit breaker of the client, nil if it is not enabled.
+	CircuitBreaker() *CircuitBreaker
+}
@@ -0,0 +1,151 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(config.MetricServer{
+		Name:           "es",
+		CircuitBreaker: &config.CircuitBreaker{FailureThreshold: 2, OpenDuration: time.Minute},
+	})
+	b.now = func() time.Time { return now }
+
+	// A success resets the consecutive failures.
+	assert.NoError(t, b.Allow())
+	b.Record(false)
+	assert.NoError(t, b.Allow())
+	b.Record(true)
+	assert.NoError(t, b.Allow())
+	b.Record(false)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// The circuit is opened after 2 consecutive failures.
+	assert.NoError(t, b.Allow())
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	// A single trial request is allowed once the open duration has elapsed.
+	now = now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.NoError(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	// The circuit is opened again if the trial request fails.
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	// The circuit is closed if the trial request succeeds.
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Allow())
+	b.Record(true)
+	assert.Equal(t, BreakerClosed, b.State())
+	assert.NoError(t, b.Allow())
+}
+
+func TestCircuitBreaker_disabled(t *testing.T) {
+	b := NewCircuitBreaker(config.MetricServer{Name: "es"})
+	assert.Nil(t, b)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.Allow())
+		b.Record(false)
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+}
+
+func TestIsFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "success", status: http.StatusOK, want: false},
+		{name: "not found", status: http.StatusNotFound, want: false},
+		{name: "too many requests", status: http.StatusTooManyRequests, want: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, want: true},
+		{name: "network error", err: errors.New("connection refused"), want: true},
+		{name: "rejected by the circuit breaker", err: ErrCircuitOpen, want: false},
+		{name: "cancelled by the caller", err: fmt.Errorf("request failed: %w", context.Canceled), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res *http.Response
+			if tt.err == nil {
+				res = &http.Response{StatusCode: tt.status}
+			}
+			assert.Equal(t, tt.want, IsFailure(res, tt.err))
+		})
+	}
+}
+
+func TestCircuitBreaker_RecordResult(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	metricServer := config.MetricServer{
+		Name:           "es",
+		CircuitBreaker: &config.CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Minute},
+	}
+	b := NewCircuitBreaker(metricServer)
+	b.now = func() time.Time { return now }
+
+	// The deadline of the caller is exceeded before the query timeout.
+	callerCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	queryCtx, cancel := WithQueryTimeout(callerCtx, &countingClient{metricServer: metricServer})
+	defer cancel()
+	assert.NoError(t, b.Allow())
+	b.RecordResult(queryCtx, nil, context.DeadlineExceeded)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// The request is cancelled by the caller.
+	callerCtx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, b.Allow())
+	b.RecordResult(callerCtx, nil, context.Canceled)
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// The server does not answer within the query timeout.
+	metricServer.QueryTimeout = time.Nanosecond
+	queryCtx, cancel = WithQueryTimeout(context.Background(), &countingClient{metricServer: metricServer})
+	defer cancel()
+	<-queryCtx.Done()
+	assert.NoError(t, b.Allow())
+	b.RecordResult(queryCtx, nil, context.DeadlineExceeded)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	// A cancelled trial request lets another trial request through, without closing the circuit.
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Allow())
+	b.RecordResult(callerCtx, nil, context.Canceled)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.NoError(t, b.Allow())
+}
@@ -0,0 +1,231 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale"
+)
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_requests_total",
+	Help: "The total number of requests for metric values served by the cache of a metrics server, by result",
+}, []string{"client", "result"})
+
+// cachedClient caches the metric values returned by a client. Identical requests received while a value is being
+// retrieved wait for it instead of querying the server again.
+type cachedClient struct {
+	Interface
+	now func() time.Time
+
+	group singleflight.Group
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	// purged is the last time the expired entries have been removed.
+	purged time.Time
+}
+
+type cacheEntry struct {
+	value     interface{}
+	fetchedAt time.Time
+	ttl       time.Duration
+}
+
+// WithCache returns the clients with a cache in front of the metric values lookups, if it is enabled for their server.
+func WithCache(clients ...Interface) []Interface {
+	cached := make([]Interface, len(clients))
+	for i, c := range clients {
+		cached[i] = NewCachedClient(c)
+	}
+	return cached
+}
+
+// NewCachedClient returns a client with a cache in front of the metric values lookups, or the client itself if the
+// cache is not enabled for its server.
+func NewCachedClient(c Interface) Interface {
+	if c.GetConfiguration().Cache == nil {
+		return c
+	}
+	return &cachedClient{
+		Interface: c,
+		now:       time.Now,
+		entries:   make(map[string]*cacheEntry),
+	}
+}
+
+func (c *cachedClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	key := cacheKey("object", info.String(), name.String(), selectorString(metricSelector))
+	value, err := c.get(ctx, key, info.Metric, func(ctx context.Context) (interface{}, error) {
+		return c.Interface.GetMetricByName(ctx, name, info, metricSelector)
+	}, func(value interface{}, fetchedAt time.Time) interface{} {
+		metric := value.(*custom_metrics.MetricValue).DeepCopy()
+		metric.Timestamp = staleTimestamp(metric.Timestamp, fetchedAt)
+		return metric
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*custom_metrics.MetricValue).DeepCopy(), nil
+}
+
+func (c *cachedClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	key := cacheKey("selector", info.String(), namespace, selectorString(selector), selectorString(metricSelector))
+	value, err := c.get(ctx, key, info.Metric, func(ctx context.Context) (interface{}, error) {
+		return c.Interface.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	}, func(value interface{}, fetchedAt time.Time) interface{} {
+		metrics := value.(*custom_metrics.MetricValueList).DeepCopy()
+		for i := range metrics.Items {
+			metrics.Items[i].Timestamp = staleTimestamp(metrics.Items[i].Timestamp, fetchedAt)
+		}
+		return metrics
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*custom_metrics.MetricValueList).DeepCopy(), nil
+}
+
+func (c *cachedClient) GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	key := cacheKey("external", name, namespace, selectorString(selector))
+	value, err := c.get(ctx, key, name, func(ctx context.Context) (interface{}, error) {
+		return c.Interface.GetExternalMetric(ctx, name, namespace, selector)
+	}, func(value interface{}, fetchedAt time.Time) interface{} {
+		metrics := value.(*external_metrics.ExternalMetricValueList).DeepCopy()
+		for i := range metrics.Items {
+			metrics.Items[i].Timestamp = staleTimestamp(metrics.Items[i].Timestamp, fetchedAt)
+		}
+		return metrics
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*external_metrics.ExternalMetricValueList).DeepCopy(), nil
+}
+
+// get returns the cached value of a key if it has not expired, or fetches it. If the server returns an error, or does
+// not answer before the context is done, a value which has expired since less than staleIfError is returned using stale.
+func (c *cachedClient) get(
+	ctx context.Context,
+	key, metric string,
+	fetch func(ctx context.Context) (interface{}, error),
+	stale func(value interface{}, fetchedAt time.Time) interface{},
+) (interface{}, error) {
+	clientName := c.GetConfiguration().Name
+	ttl := c.GetConfiguration().Cache.TTLFor(metric)
+	entry := c.entry(key)
+	if entry != nil && c.now().Sub(entry.fetchedAt) < entry.ttl {
+		cacheRequests.WithLabelValues(clientName, cacheHit).Inc()
+		return entry.value, nil
+	}
+
+	cacheRequests.WithLabelValues(clientName, cacheMiss).Inc()
+	result := c.group.DoChan(key, func() (interface{}, error) {
+		// The value is shared by all the requests waiting for it, it must not be cancelled with the first one.
+		fetchCtx, cancel := WithQueryTimeout(context.WithoutCancel(ctx), c)
+		defer cancel()
+		value, err := fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		c.set(key, &cacheEntry{value: value, fetchedAt: c.now(), ttl: ttl})
+		return value, nil
+	})
+	var value interface{}
+	var err error
+	select {
+	case <-ctx.Done():
+		// The fetch goes on in the background, but the caller cannot wait any longer for it.
+		err = ctx.Err()
+	case r := <-result:
+		value, err = r.Val, r.Err
+	}
+	if err == nil {
+		return value, nil
+	}
+
+	// Serve the last known value if it is not too old.
+	staleIfError := c.GetConfiguration().Cache.StaleIfError
+	if entry = c.entry(key); entry != nil && c.now().Sub(entry.fetchedAt) < entry.ttl+staleIfError {
+		cacheRequests.WithLabelValues(clientName, cacheStale).Inc()
+		return stale(entry.value, entry.fetchedAt), nil
+	}
+	return nil, err
+}
+
+func (c *cachedClient) entry(key string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[key]
+}
+
+func (c *cachedClient) set(key string, entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = entry
+	now := c.now()
+	staleIfError := c.GetConfiguration().Cache.StaleIfError
+	if now.Sub(c.purged) < time.Minute {
+		return
+	}
+	// Remove the entries which cannot be served anymore.
+	for k, e := range c.entries {
+		if now.Sub(e.fetchedAt) >= e.ttl+staleIfError {
+			delete(c.entries, k)
+		}
+	}
+	c.purged = now
+}
+
+// staleTimestamp returns the timestamp of a stale value: a timestamp later than the time the value has been fetched is
+// replaced, consumers can then compare it with the current time to detect that the value is stale.
+func staleTimestamp(timestamp metav1.Time, fetchedAt time.Time) metav1.Time {
+	if timestamp.Time.After(fetchedAt) || timestamp.IsZero() {
+		return metav1.NewTime(fetchedAt)
+	}
+	return timestamp
+}
+
+func cacheKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+func selectorString(selector labels.Selector) string {
+	if selector == nil {
+		return ""
+	}
+	return selector.String()
+}
@@ -0,0 +1,208 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// countingClient returns the number of times it has been called as the value of the metrics.
+type countingClient struct {
+	metricServer config.MetricServer
+	calls        atomic.Int64
+	err          error
+	// release, if not nil, blocks the requests until it is closed.
+	release chan struct{}
+}
+
+func (c *countingClient) GetConfiguration() config.MetricServer {
+	return c.metricServer
+}
+
+func (c *countingClient) ListCustomMetricInfos(context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	return nil, nil
+}
+
+func (c *countingClient) GetMetricByName(_ context.Context, name types.NamespacedName, info provider.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValue, error) {
+	calls := c.calls.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{Name: name.Name},
+		Metric:          custom_metrics.MetricIdentifier{Name: info.Metric},
+		Timestamp:       metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+		Value:           *resource.NewQuantity(calls, resource.DecimalSI),
+	}, nil
+}
+
+func (c *countingClient) GetMetricBySelector(context.Context, string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
+	return nil, nil
+}
+
+func (c *countingClient) ListExternalMetrics(context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	return nil, nil
+}
+
+func (c *countingClient) GetExternalMetric(context.Context, string, string, labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	return nil, nil
+}
+
+func newCountingClient(t *testing.T, cache *config.Cache) (*countingClient, *cachedClient, *time.Time) {
+	t.Helper()
+	backend := &countingClient{metricServer: config.MetricServer{Name: "es", Cache: cache}}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cached, ok := NewCachedClient(backend).(*cachedClient)
+	assert.True(t, ok)
+	cached.now = func() time.Time { return now }
+	return backend, cached, &now
+}
+
+func getValue(t *testing.T, c Interface, pod, metric string) int64 {
+	t.Helper()
+	value, err := c.GetMetricByName(
+		context.Background(),
+		types.NamespacedName{Namespace: "ns1", Name: pod},
+		provider.CustomMetricInfo{Metric: metric},
+		labels.Everything(),
+	)
+	assert.NoError(t, err)
+	if value == nil {
+		return 0
+	}
+	return value.Value.Value()
+}
+
+func TestNewCachedClient_disabled(t *testing.T) {
+	backend := &countingClient{metricServer: config.MetricServer{Name: "es"}}
+	assert.Same(t, backend, NewCachedClient(backend))
+}
+
+func TestCachedClient_ttl(t *testing.T) {
+	backend, cached, now := newCountingClient(t, cacheConfig(t, `
+      ttl: 5s
+      metrics:
+        - name: '^slow'
+          ttl: 1m`))
+
+	assert.Equal(t, int64(1), getValue(t, cached, "pod-a", "load"))
+	assert.Equal(t, int64(1), getValue(t, cached, "pod-a", "load"), "value must be cached")
+	assert.Equal(t, int64(2), getValue(t, cached, "pod-b", "load"), "values are cached per object")
+	assert.Equal(t, int64(3), getValue(t, cached, "pod-a", "slow.load"), "values are cached per metric")
+
+	*now = now.Add(5 * time.Second)
+	assert.Equal(t, int64(4), getValue(t, cached, "pod-a", "load"), "value must have expired")
+	assert.Equal(t, int64(3), getValue(t, cached, "pod-a", "slow.load"), "TTL can be set per metric")
+	assert.Equal(t, int64(4), backend.calls.Load())
+}
+
+func TestCachedClient_staleIfError(t *testing.T) {
+	backend, cached, now := newCountingClient(t, &config.Cache{TTL: 5 * time.Second, StaleIfError: 30 * time.Second})
+	fetchedAt := *now
+	assert.Equal(t, int64(1), getValue(t, cached, "pod-a", "load"))
+
+	backend.err = errors.New("unavailable")
+	*now = now.Add(20 * time.Second)
+	value, err := cached.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns1", Name: "pod-a"}, provider.CustomMetricInfo{Metric: "load"}, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value.Value.Value(), "last known value must be served")
+	assert.False(t, value.Timestamp.After(fetchedAt), "stale value must not be more recent than the last successful query")
+
+	*now = now.Add(20 * time.Second)
+	_, err = cached.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns1", Name: "pod-a"}, provider.CustomMetricInfo{Metric: "load"}, labels.Everything())
+	assert.Error(t, err, "value is too old to be served")
+}
+
+func TestCachedClient_staleIfError_timeout(t *testing.T) {
+	backend, cached, now := newCountingClient(t, &config.Cache{TTL: 5 * time.Second, StaleIfError: 30 * time.Second})
+	assert.Equal(t, int64(1), getValue(t, cached, "pod-a", "load"))
+
+	// The server hangs until the query timeout of the caller has elapsed.
+	backend.release = make(chan struct{})
+	defer close(backend.release)
+	*now = now.Add(20 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	value, err := cached.GetMetricByName(ctx, types.NamespacedName{Namespace: "ns1", Name: "pod-a"}, provider.CustomMetricInfo{Metric: "load"}, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value.Value.Value(), "last known value must be served")
+}
+
+func TestCachedClient_singleflight(t *testing.T) {
+	backend, cached, _ := newCountingClient(t, &config.Cache{TTL: 5 * time.Second})
+	backend.release = make(chan struct{})
+	var wg sync.WaitGroup
+	values := make([]int64, 5)
+	for i := range values {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values[i] = getValue(t, cached, "pod-a", "load")
+		}()
+	}
+	// Wait for the first request to reach the backend before releasing it.
+	assert.Eventually(t, func() bool { return backend.calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	assert.Equal(t, int64(1), backend.calls.Load(), "identical requests must be collapsed")
+	assert.Equal(t, []int64{1, 1, 1, 1, 1}, values)
+}
+
+func TestCachedClient_cancelled(t *testing.T) {
+	backend, cached, _ := newCountingClient(t, &config.Cache{TTL: 5 * time.Second})
+	backend.release = make(chan struct{})
+	defer close(backend.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cached.GetMetricByName(ctx, types.NamespacedName{Namespace: "ns1", Name: "pod-a"}, provider.CustomMetricInfo{Metric: "load"}, labels.Everything())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// cacheConfig reads the cache configuration of a server.
+func cacheConfig(t *testing.T, cache string) *config.Cache {
+	t.Helper()
+	cfg, err := config.From([]byte(`
+metricServers:
+  - name: custom
+    serverType: custom
+    clientConfig:
+      host: https://custom-metrics-apiserver.custom-metrics.svc
+    cache:` + cache))
+	assert.NoError(t, err)
+	return cfg.MetricServers[0].Cache
+}
@@ -18,8 +18,10 @@
 package custom_api
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 
@@ -38,12 +40,14 @@ import (
 	"k8s.io/metrics/pkg/apis/external_metrics"
 	externalMetricsAPI "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
 	cmClient "k8s.io/metrics/pkg/client/custom_metrics"
-	emClient "k8s.io/metrics/pkg/client/external_metrics"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
+	"go.elastic.co/apm/module/apmhttp/v2"
+
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
 )
 
 type metricsClientProvider struct {
@@ -55,21 +59,23 @@ type metricsClient struct {
 	logger                           logr.Logger
 	metricServerCfg                  config.MetricServer
 	customMetricsAvailableAPIsGetter cmClient.AvailableAPIsGetter
-	customMetricsClient              cmClient.CustomMetricsClient
+	metrics                          *metricsRESTClient
 
-	externalMetricsClient emClient.ExternalMetricsClient
-	discoveryClient       discovery.ServerResourcesInterface
-	mapper                meta.RESTMapper
+	discoveryClient discovery.ServerResourcesInterface
+	mapper          meta.RESTMapper
 
 	rwLock                                 sync.RWMutex
 	customMetricNamer, externalMetricNamer config.Namer
+
+	// breaker is the circuit breaker of the server, nil if it is not enabled.
+	breaker *client.CircuitBreaker
 }
 
 func (mc *metricsClient) GetConfiguration() config.MetricServer {
 	return mc.metricServerCfg
 }
 
-func (mc *metricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error) {
+func (mc *metricsClient) ListCustomMetricInfos(_ context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
 	version, err := mc.customMetricsAvailableAPIsGetter.PreferredVersion()
 	if err != nil {
 		return nil, err
@@ -102,29 +108,30 @@ func (mc *metricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]
 	return metricInfos, nil
 }
 
-func (mc *metricsClient) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
+func (mc *metricsClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
+	defer tracing.Span(&ctx)()
 	mc.rwLock.Lock()
 	defer mc.rwLock.Unlock()
-	var object *customMetricsAPI.MetricValue
-	var err error
 	metricName, ok := mc.customMetricNamer.Get(info.Metric)
 	if !ok {
 		return nil, fmt.Errorf("metric name alias for custom metric %s not found", info.Metric)
 	}
+	namespace := ""
 	if info.Namespaced {
-		object, err = mc.customMetricsClient.NamespacedMetrics(name.Namespace).GetForObject(
-			schema.GroupKind{Group: info.GroupResource.Group, Kind: info.GroupResource.Resource},
-			name.Name, metricName, selector,
-		)
-	} else {
-		object, err = mc.customMetricsClient.RootScopedMetrics().GetForObject(
-			schema.GroupKind{Group: info.GroupResource.Group, Kind: info.GroupResource.Resource},
-			name.Name, metricName, selector,
-		)
+		namespace = name.Namespace
 	}
+	objects, err := mc.metrics.getCustomMetrics(
+		ctx, namespace,
+		schema.GroupKind{Group: info.GroupResource.Group, Kind: info.GroupResource.Resource},
+		name.Name, labels.Everything(), metricName, selector,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metric from backend: %v", err)
+		return nil, fmt.Errorf("failed to get metric from backend: %w", err)
+	}
+	if len(objects.Items) != 1 {
+		return nil, fmt.Errorf("the custom metrics API server returned %v results when we asked for exactly one", len(objects.Items))
 	}
+	object := objects.Items[0]
 	return &custom_metrics.MetricValue{
 		DescribedObject: custom_metrics.ObjectReference{
 			Kind:            object.DescribedObject.Kind,
@@ -143,9 +150,8 @@ func (mc *metricsClient) GetMetricByName(name types.NamespacedName, info provide
 	}, nil
 }
 
-func (mc *metricsClient) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
-	var objects *customMetricsAPI.MetricValueList
-	var err error
+func (mc *metricsClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	defer tracing.Span(&ctx)()
 	kind, err := mc.mapper.ResourceSingularizer(info.GroupResource.Resource)
 	if err != nil {
 		return nil, fmt.Errorf("failed to singularize %s: %v", info.GroupResource.Resource, err)
@@ -157,25 +163,16 @@ func (mc *metricsClient) GetMetricBySelector(namespace string, selector labels.S
 	if !ok {
 		return nil, fmt.Errorf("metric name alias for custom metric %s/%s not found", namespace, info.Metric)
 	}
-	if info.Namespaced {
-		objects, err = mc.customMetricsClient.NamespacedMetrics(namespace).GetForObjects(
-			schema.GroupKind{
-				Group: info.GroupResource.Group,
-				Kind:  kind,
-			},
-			selector, metricName, metricSelector,
-		)
-	} else {
-		objects, err = mc.customMetricsClient.RootScopedMetrics().GetForObjects(
-			schema.GroupKind{
-				Group: info.GroupResource.Group,
-				Kind:  kind,
-			},
-			selector, metricName, metricSelector,
-		)
+	if !info.Namespaced {
+		namespace = ""
 	}
+	groupKind := schema.GroupKind{Group: info.GroupResource.Group, Kind: kind}
+	if groupKind.Kind == "Namespace" && groupKind.Group == "" && len(namespace) == 0 {
+		return nil, fmt.Errorf("cannot fetch metrics for multiple namespaces at once")
+	}
+	objects, err := mc.metrics.getCustomMetrics(ctx, namespace, groupKind, "", selector, metricName, metricSelector)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metric from backend: %v", err)
+		return nil, fmt.Errorf("failed to get metric from backend: %w", err)
 	}
 	values := make([]custom_metrics.MetricValue, len(objects.Items))
 	for i, v := range objects.Items {
@@ -201,7 +198,7 @@ func (mc *metricsClient) GetMetricBySelector(namespace string, selector labels.S
 	}, nil
 }
 
-func (mc *metricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error) {
+func (mc *metricsClient) ListExternalMetrics(_ context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
 	infos := make(map[provider.ExternalMetricInfo]struct{})
 	resources, err := mc.discoveryClient.ServerResourcesForGroupVersion(externalMetricsAPI.SchemeGroupVersion.String())
 	if err != nil {
@@ -216,16 +213,17 @@ func (mc *metricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]
 	return infos, nil
 }
 
-func (mc *metricsClient) GetExternalMetric(name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+func (mc *metricsClient) GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	defer tracing.Span(&ctx)()
 	mc.rwLock.Lock()
 	defer mc.rwLock.Unlock()
 	metricName, ok := mc.externalMetricNamer.Get(name)
 	if !ok {
 		return nil, fmt.Errorf("metric name alias for external metric %s/%s not found", namespace, name)
 	}
-	result, err := mc.externalMetricsClient.NamespacedMetrics(namespace).List(metricName, selector)
+	result, err := mc.metrics.getExternalMetrics(ctx, namespace, metricName, selector)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metrics for external metric %s/%s: %v", namespace, metricName, err)
+		return nil, fmt.Errorf("failed to get metrics for external metric %s/%s: %w", namespace, metricName, err)
 	}
 	valueList := &external_metrics.ExternalMetricValueList{
 		Items: make([]external_metrics.ExternalMetricValue, len(result.Items)),
@@ -244,6 +242,11 @@ func (mc *metricsClient) GetExternalMetric(name, namespace string, selector labe
 }
 
 var _ client.Interface = &metricsClient{}
+var _ client.CircuitBreakerReporter = &metricsClient{}
+
+func (mc *metricsClient) CircuitBreaker() *client.CircuitBreaker {
+	return mc.breaker
+}
 
 func NewMetricApiClientProvider(baseConfig *rest.Config, mapper meta.RESTMapper) *metricsClientProvider {
 	return &metricsClientProvider{
@@ -253,31 +256,30 @@ func NewMetricApiClientProvider(baseConfig *rest.Config, mapper meta.RESTMapper)
 }
 
 func (mcp metricsClientProvider) NewClient(
-	client *kubernetes.Clientset,
+	clientset *kubernetes.Clientset,
 	metricServerCfg config.MetricServer,
 ) (client.Interface, error) {
-	restClientConfig, err := metricServerCfg.ClientConfig.NewRestClientConfig(client, mcp.baseConfig)
+	restClientConfig, err := metricServerCfg.ClientConfig.NewRestClientConfig(clientset, mcp.baseConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate rest restClientConfig for %s: %s", metricServerCfg.ClientConfig.Host, err)
 	}
+	breaker := client.NewCircuitBreaker(metricServerCfg)
+	restClientConfig.Wrap(breaker.WrapTransport)
+	// Propagate the trace of the requests received by the adapter.
+	restClientConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper { return apmhttp.WrapRoundTripper(rt) })
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restClientConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create discovery client: %v", err)
 	}
 	customMetricsAvailableAPIsGetter := cmClient.NewAvailableAPIsGetter(discoveryClient)
-	customMetricsClient := cmClient.NewForConfig(restClientConfig, mcp.mapper, customMetricsAvailableAPIsGetter)
-	externalMetricsClient, err := emClient.NewForConfig(restClientConfig)
-	if err != nil {
-		return nil, fmt.Errorf("%s: failed to create external metrics client: %v", metricServerCfg.Name, err)
-	}
 
 	return &metricsClient{
 		logger:                           log.ForPackage("custom_api"),
 		metricServerCfg:                  metricServerCfg,
 		customMetricsAvailableAPIsGetter: customMetricsAvailableAPIsGetter,
-		customMetricsClient:              customMetricsClient,
-		externalMetricsClient:            externalMetricsClient,
+		metrics:                          newMetricsRESTClient(restClientConfig, mcp.mapper, customMetricsAvailableAPIsGetter),
 		discoveryClient:                  discoveryClient,
 		mapper:                           mcp.mapper,
-	}, err
+		breaker:                          breaker,
+	}, nil
 }
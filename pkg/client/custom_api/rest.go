@@ -0,0 +1,182 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package custom_api
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	cmint "k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta1"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	externalMetricsAPI "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	cmClient "k8s.io/metrics/pkg/client/custom_metrics"
+	cmScheme "k8s.io/metrics/pkg/client/custom_metrics/scheme"
+)
+
+var versionConverter = cmClient.NewMetricConverter()
+
+// metricsRESTClient gets the metrics from the custom and external metrics APIs of a server. The clients provided by
+// k8s.io/metrics are not used since they do not accept a context.
+type metricsRESTClient struct {
+	config        *rest.Config
+	mapper        meta.RESTMapper
+	availableAPIs cmClient.AvailableAPIsGetter
+
+	lock sync.Mutex
+	// customClients are the clients of the custom metrics API, by version.
+	customClients         map[schema.GroupVersion]rest.Interface
+	externalMetricsClient rest.Interface
+}
+
+func newMetricsRESTClient(config *rest.Config, mapper meta.RESTMapper, availableAPIs cmClient.AvailableAPIsGetter) *metricsRESTClient {
+	return &metricsRESTClient{
+		config:        config,
+		mapper:        mapper,
+		availableAPIs: availableAPIs,
+		customClients: make(map[schema.GroupVersion]rest.Interface),
+	}
+}
+
+// restClientFor returns a REST client for an API version.
+func (c *metricsRESTClient) restClientFor(version schema.GroupVersion, serializer runtime.NegotiatedSerializer) (rest.Interface, error) {
+	config := rest.CopyConfig(c.config)
+	config.APIPath = "/apis"
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	config.GroupVersion = &version
+	config.NegotiatedSerializer = serializer
+	return rest.RESTClientFor(config)
+}
+
+// customClient returns a client of the custom metrics API, using the version preferred by the server.
+func (c *metricsRESTClient) customClient() (rest.Interface, schema.GroupVersion, error) {
+	version, err := c.availableAPIs.PreferredVersion()
+	if err != nil {
+		return nil, schema.GroupVersion{}, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if client, exists := c.customClients[version]; exists {
+		return client, version, nil
+	}
+	client, err := c.restClientFor(version, cmScheme.Codecs.WithoutConversion())
+	if err != nil {
+		return nil, schema.GroupVersion{}, err
+	}
+	c.customClients[version] = client
+	return client, version, nil
+}
+
+// externalClient returns a client of the external metrics API.
+func (c *metricsRESTClient) externalClient() (rest.Interface, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.externalMetricsClient != nil {
+		return c.externalMetricsClient, nil
+	}
+	client, err := c.restClientFor(externalMetricsAPI.SchemeGroupVersion, scheme.Codecs.WithoutConversion())
+	if err != nil {
+		return nil, err
+	}
+	c.externalMetricsClient = client
+	return client, nil
+}
+
+// getCustomMetrics gets the value of a custom metric for the objects of a kind. namespace is empty for cluster scoped
+// objects. If name is empty the values for all the objects matching the selector are returned.
+func (c *metricsRESTClient) getCustomMetrics(
+	ctx context.Context,
+	namespace string,
+	groupKind schema.GroupKind,
+	name string,
+	selector labels.Selector,
+	metricName string,
+	metricSelector labels.Selector,
+) (*v1beta2.MetricValueList, error) {
+	client, version, err := c.customClient()
+	if err != nil {
+		return nil, err
+	}
+	options := &cmint.MetricListOptions{MetricLabelSelector: metricSelector.String()}
+	if len(name) == 0 {
+		name = v1beta1.AllObjects
+		options.LabelSelector = selector.String()
+	}
+	params, err := versionConverter.ConvertListOptionsToVersion(options, version)
+	if err != nil {
+		return nil, err
+	}
+
+	req := client.Get()
+	if groupKind.Kind == "Namespace" && groupKind.Group == "" && len(namespace) == 0 {
+		// Metrics of a namespace are stored in the namespace itself.
+		req = req.Resource("metrics").Namespace(name).Name(metricName)
+	} else {
+		mapping, err := c.mapper.RESTMapping(groupKind)
+		if err != nil {
+			return nil, fmt.Errorf("unable to map kind %s to resource: %v", groupKind.String(), err)
+		}
+		req = req.Resource(mapping.Resource.GroupResource().String()).Namespace(namespace).Name(name).SubResource(metricName)
+	}
+	result := req.VersionedParams(params, cmScheme.ParameterCodec).Do(ctx)
+
+	metricObj, err := versionConverter.ConvertResultToVersion(result, v1beta2.SchemeGroupVersion)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := metricObj.(*v1beta2.MetricValueList)
+	if !ok {
+		return nil, fmt.Errorf("the custom metrics API server didn't return MetricValueList, the type is %v", reflect.TypeOf(metricObj))
+	}
+	return values, nil
+}
+
+// getExternalMetrics gets the values of an external metric.
+func (c *metricsRESTClient) getExternalMetrics(
+	ctx context.Context,
+	namespace string,
+	metricName string,
+	metricSelector labels.Selector,
+) (*externalMetricsAPI.ExternalMetricValueList, error) {
+	client, err := c.externalClient()
+	if err != nil {
+		return nil, err
+	}
+	values := &externalMetricsAPI.ExternalMetricValueList{}
+	err = client.Get().
+		Namespace(namespace).
+		Resource(metricName).
+		VersionedParams(&metav1.ListOptions{LabelSelector: metricSelector.String()}, metav1.ParameterCodec).
+		Do(ctx).
+		Into(values)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
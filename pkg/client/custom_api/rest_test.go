@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package custom_api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+)
+
+type preferredVersion schema.GroupVersion
+
+func (p preferredVersion) PreferredVersion() (schema.GroupVersion, error) {
+	return schema.GroupVersion(p), nil
+}
+
+func (p preferredVersion) Invalidate() {}
+
+func newTestMetricsRESTClient(t *testing.T, handler http.HandlerFunc) *metricsRESTClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+	return newMetricsRESTClient(&rest.Config{Host: server.URL}, mapper, preferredVersion(v1beta2.SchemeGroupVersion))
+}
+
+func Test_metricsRESTClient_getCustomMetrics(t *testing.T) {
+	var gotPath, gotQuery string
+	c := newTestMetricsRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery = r.URL.Path, r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"MetricValueList","apiVersion":"custom.metrics.k8s.io/v1beta2","items":[` +
+			`{"describedObject":{"kind":"Pod","namespace":"ns1","name":"pod-a"},"metric":{"name":"load"},"value":"2"}]}`))
+	})
+	selector, err := labels.Parse("app=kibana")
+	assert.NoError(t, err)
+	values, err := c.getCustomMetrics(context.Background(), "ns1", schema.GroupKind{Kind: "Pod"}, "", selector, "load", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, "/apis/custom.metrics.k8s.io/v1beta2/namespaces/ns1/pods/*/load", gotPath)
+	assert.Equal(t, "labelSelector=app%3Dkibana", gotQuery)
+	assert.Equal(t, 1, len(values.Items))
+	assert.Equal(t, "pod-a", values.Items[0].DescribedObject.Name)
+}
+
+func Test_metricsRESTClient_getExternalMetrics(t *testing.T) {
+	var gotPath string
+	c := newTestMetricsRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"ExternalMetricValueList","apiVersion":"external.metrics.k8s.io/v1beta1","items":[` +
+			`{"metricName":"queue_length","value":"12"}]}`))
+	})
+	values, err := c.getExternalMetrics(context.Background(), "ns1", "queue_length", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, "/apis/external.metrics.k8s.io/v1beta1/namespaces/ns1/queue_length", gotPath)
+	assert.Equal(t, 1, len(values.Items))
+	assert.Equal(t, int64(12), values.Items[0].Value.Value())
+}
+
+func Test_metricsRESTClient_cancelled(t *testing.T) {
+	c := newTestMetricsRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// The request must be cancelled before the server responds.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.getExternalMetrics(ctx, "ns1", "queue_length", labels.Everything())
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
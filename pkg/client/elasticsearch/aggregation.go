@@ -0,0 +1,442 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+const (
+	valueAggregation     = "value"
+	timestampAggregation = "timestamp"
+	samplesAggregation   = "samples"
+	seriesAggregation    = "counter_series"
+
+	// defaultWindow is the window over which the rate of a counter is computed, or the latest value of a time series is
+	// searched, if no aggregation is set.
+	defaultWindow = 5 * time.Minute
+	// maxRateSamples is the maximum number of samples used to compute a rate, default max_inner_result_window of the indices.
+	maxRateSamples = 100
+	// maxRateSeries is the maximum number of series of an object for which a rate is computed.
+	maxRateSeries = 100
+
+	// seriesKeyScript builds a key from the values of the fields which identify a series, a missing field being empty.
+	seriesKeyScript = `StringBuilder key = new StringBuilder();
+for (String field : params.fields) {
+  if (doc.containsKey(field) && doc[field].size() > 0) { key.append(doc[field].value); }
+  key.append('|');
+}
+return key.toString();`
+)
+
+// windowed describes how the value of a metric is computed from the documents in a time window.
+type windowed struct {
+	metric      string
+	identity    config.Identity
+	aggregation *config.Aggregation
+	// counter is true if the value is the per-second rate of a counter.
+	counter bool
+	// series are the fields which identify the series of an object. The rate of a counter is computed for each series,
+	// and the rates are added.
+	series []string
+}
+
+// windowedFor returns how the value of a metric is computed, or nil if the value is read from the latest document.
+func windowedFor(metric string, identity config.Identity, aggregation *config.Aggregation, counter bool, series []string) *windowed {
+	if aggregation == nil && !counter {
+		return nil
+	}
+	return &windowed{
+		metric:      metric,
+		identity:    identity,
+		aggregation: aggregation,
+		counter:     counter,
+		series:      series,
+	}
+}
+
+// windowed returns how the value of a metric is computed, or nil if the value is read from the latest document.
+func (m MetricMetadata) windowed(metric string) *windowed {
+	return windowedFor(metric, m.Fields.Identity, m.Fields.Aggregation, m.Counter, m.seriesFields())
+}
+
+// seriesFields returns the fields which identify the series of an object: the label fields of the metric, sorted.
+func (m MetricMetadata) seriesFields() []string {
+	if len(m.Labels) == 0 {
+		return nil
+	}
+	fields := make([]string, 0, len(m.Labels))
+	for _, field := range m.Labels {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// windowSeconds returns the length of the window in seconds.
+func (w *windowed) windowSeconds() int64 {
+	if w.aggregation == nil {
+		return int64(defaultWindow / time.Second)
+	}
+	return w.aggregation.WindowSeconds()
+}
+
+// filter only keeps the documents in the window.
+func (w *windowed) filter() map[string]interface{} {
+	return rangeQuery(w.identity.GetTimestampField(), "gte", fmt.Sprintf("now-%ds", w.windowSeconds()))
+}
+
+// aggregations returns the aggregations used to compute the value of a metric over the window.
+func (w *windowed) aggregations() map[string]interface{} {
+	if w.counter {
+		// The rate is computed from the latest samples, to handle the counter resets.
+		samples := map[string]interface{}{
+			samplesAggregation: map[string]interface{}{
+				"top_hits": map[string]interface{}{
+					"size": maxRateSamples,
+					"sort": []interface{}{latestFirst(w.identity.GetTimestampField())},
+					"_source": map[string]interface{}{
+						"includes": []string{w.metric, w.identity.GetTimestampField()},
+					},
+				},
+			},
+		}
+		if len(w.series) == 0 {
+			return samples
+		}
+		// The samples of each series are read separately, the values of different series must not be interleaved.
+		return map[string]interface{}{
+			seriesAggregation: map[string]interface{}{
+				"terms": map[string]interface{}{
+					"script": map[string]interface{}{
+						"source": seriesKeyScript,
+						"params": map[string]interface{}{"fields": w.series},
+					},
+					"size": maxRateSeries,
+				},
+				"aggs": samples,
+			},
+		}
+	}
+	var value map[string]interface{}
+	switch reducer := w.aggregation.GetReducer(); reducer {
+	case config.LastReducer:
+		value = map[string]interface{}{
+			"top_metrics": map[string]interface{}{
+				"metrics": map[string]interface{}{"field": w.metric},
+				"sort":    latestFirst(w.identity.GetTimestampField()),
+			},
+		}
+	case config.PercentileReducer:
+		value = map[string]interface{}{
+			"percentiles": map[string]interface{}{
+				"field":    w.metric,
+				"percents": []float64{w.aggregation.Percentile},
+				"keyed":    false,
+			},
+		}
+	default:
+		value = map[string]interface{}{
+			string(reducer): map[string]interface{}{"field": w.metric},
+		}
+	}
+	return map[string]interface{}{
+		valueAggregation: value,
+		timestampAggregation: map[string]interface{}{
+			"max": map[string]interface{}{"field": w.identity.GetTimestampField()},
+		},
+	}
+}
+
+// query returns a query which computes the value of the metric, from the documents matching all the filters, over the
+// window.
+func (w *windowed) query(filter []interface{}) (string, error) {
+	filter = append(filter, w.filter())
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filter,
+			},
+		},
+		"size": 0,
+		"aggs": w.aggregations(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(query), nil
+}
+
+// result reads the result of the aggregations returned by aggregations. It returns nil if there is no value in the window.
+func (w *windowed) result(aggregations map[string]interface{}) (*timestampedMetric, error) {
+	var result *timestampedMetric
+	var err error
+	if w.counter {
+		result, err = w.rateResult(aggregations)
+	} else {
+		result, err = w.reducerResult(aggregations)
+	}
+	if err != nil || result == nil {
+		return nil, err
+	}
+	if result.WindowSeconds == nil {
+		windowSeconds := w.windowSeconds()
+		result.WindowSeconds = &windowSeconds
+	}
+	return result, nil
+}
+
+func (w *windowed) reducerResult(aggregations map[string]interface{}) (*timestampedMetric, error) {
+	timestamp, err := getAggregationValue(aggregations, timestampAggregation)
+	if err != nil || timestamp == nil {
+		// No document in the window.
+		return nil, err
+	}
+
+	var value interface{}
+	switch w.aggregation.GetReducer() {
+	case config.LastReducer:
+		value, err = getTopMetric(aggregations, w.metric)
+	case config.PercentileReducer:
+		value, err = getPercentile(aggregations)
+	default:
+		value, err = getAggregationValue(aggregations, valueAggregation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	floatValue, err := getFloat(value)
+	if err != nil {
+		return nil, err
+	}
+	floatTimestamp, err := getFloat(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &timestampedMetric{
+		Value:     newQuantity(floatValue),
+		Timestamp: metav1.NewTime(time.UnixMilli(int64(floatTimestamp))),
+	}, nil
+}
+
+// rateResult computes the per-second rate of a counter from its samples. A decrease of the counter is considered as a
+// reset, in which case the value after the reset is the increase since the previous sample. If the counter has several
+// series, the rates of the series are added.
+func (w *windowed) rateResult(aggregations map[string]interface{}) (*timestampedMetric, error) {
+	if len(w.series) == 0 {
+		return w.samplesRate(aggregations)
+	}
+	series, ok := aggregations[seriesAggregation].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert series: %v", aggregations[seriesAggregation])
+	}
+	buckets, ok := series["buckets"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert buckets: %v", series["buckets"])
+	}
+	var sum *seriesSum
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert bucket: %v", b)
+		}
+		rate, err := w.samplesRate(bucket)
+		if err != nil {
+			return nil, err
+		}
+		if rate == nil {
+			// Not enough samples to compute the rate of this series.
+			continue
+		}
+		if sum == nil {
+			sum = &seriesSum{}
+		}
+		sum.add(*rate)
+	}
+	if sum == nil {
+		return nil, nil
+	}
+	return sum.result(), nil
+}
+
+// samplesRate computes the per-second rate of a counter from the samples aggregation.
+func (w *windowed) samplesRate(aggregations map[string]interface{}) (*timestampedMetric, error) {
+	samples, ok := aggregations[samplesAggregation].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert samples: %v", aggregations[samplesAggregation])
+	}
+	hits, ok := samples["hits"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert hits: %v", samples["hits"])
+	}
+	documents, ok := hits["hits"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert docs: %v", hits["hits"])
+	}
+	return w.rateOf(documents)
+}
+
+// rateOf computes the per-second rate of a counter from samples sorted from the most recent to the oldest one. If the
+// samples have been truncated to the latest maxRateSamples, the window of the rate is the span of these samples.
+func (w *windowed) rateOf(documents []interface{}) (*timestampedMetric, error) {
+	if len(documents) < 2 {
+		// At least 2 samples are required to compute a rate.
+		return nil, nil
+	}
+
+	var increase float64
+	var first, last metav1.Time
+	var previous float64
+	// Documents are sorted from the most recent to the oldest one.
+	for i := len(documents) - 1; i >= 0; i-- {
+		document, ok := documents[i].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert document: %v", documents[i])
+		}
+		v, err := getValue("_source."+w.metric, document)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		t, err := getValue("_source."+w.identity.GetTimestampField(), document)
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := getTimestamp(t)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case i == len(documents)-1:
+			first = timestamp
+		case value < previous:
+			// Counter has been reset.
+			increase += value
+		default:
+			increase += value - previous
+		}
+		previous = value
+		last = timestamp
+	}
+
+	elapsed := last.Sub(first.Time).Seconds()
+	if elapsed <= 0 {
+		return nil, nil
+	}
+	rate := &timestampedMetric{
+		Value:     newQuantity(increase / elapsed),
+		Timestamp: last,
+	}
+	if len(documents) >= maxRateSamples {
+		span := int64(math.Ceil(elapsed))
+		rate.WindowSeconds = &span
+	}
+	return rate, nil
+}
+
+// seriesSum adds the values of several series.
+type seriesSum struct {
+	value     float64
+	timestamp metav1.Time
+	// windowSeconds is the shortest window of the values, nil if none is set.
+	windowSeconds *int64
+}
+
+func (s *seriesSum) add(value timestampedMetric) {
+	s.value += value.Value.AsApproximateFloat64()
+	if s.timestamp.Before(&value.Timestamp) {
+		s.timestamp = value.Timestamp
+	}
+	if value.WindowSeconds != nil && (s.windowSeconds == nil || *value.WindowSeconds < *s.windowSeconds) {
+		s.windowSeconds = value.WindowSeconds
+	}
+}
+
+func (s *seriesSum) result() *timestampedMetric {
+	return &timestampedMetric{
+		Value:         newQuantity(s.value),
+		Timestamp:     s.timestamp,
+		WindowSeconds: s.windowSeconds,
+	}
+}
+
+// getAggregationValue returns the value of a single value aggregation, or nil if the aggregation has no value.
+func getAggregationValue(aggregations map[string]interface{}, name string) (interface{}, error) {
+	agg, ok := aggregations[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert aggregation %s: %v", name, aggregations[name])
+	}
+	return agg["value"], nil
+}
+
+func getTopMetric(aggregations map[string]interface{}, metric string) (interface{}, error) {
+	agg, ok := aggregations[valueAggregation].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert top metrics: %v", aggregations[valueAggregation])
+	}
+	top, ok := agg["top"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert top metrics: %v", agg["top"])
+	}
+	if len(top) == 0 {
+		return nil, nil
+	}
+	first, ok := top[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert top metric: %v", top[0])
+	}
+	metrics, ok := first["metrics"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert top metric: %v", first["metrics"])
+	}
+	return metrics[metric], nil
+}
+
+func getPercentile(aggregations map[string]interface{}) (interface{}, error) {
+	agg, ok := aggregations[valueAggregation].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert percentiles: %v", aggregations[valueAggregation])
+	}
+	values, ok := agg["values"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert percentiles: %v", agg["values"])
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	percentile, ok := values[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert percentile: %v", values[0])
+	}
+	return percentile["value"], nil
+}
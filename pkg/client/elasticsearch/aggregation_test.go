@@ -0,0 +1,264 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+func Test_windowQueryFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		aggregation config.Aggregation
+		wantValue   string
+	}{
+		{
+			name:        "default reducer",
+			aggregation: config.Aggregation{Window: 2 * time.Minute},
+			wantValue:   `{"avg":{"field":"kibana.stats.load"}}`,
+		},
+		{
+			name:        "max",
+			aggregation: config.Aggregation{Window: 2 * time.Minute, Reducer: config.MaxReducer},
+			wantValue:   `{"max":{"field":"kibana.stats.load"}}`,
+		},
+		{
+			name:        "last",
+			aggregation: config.Aggregation{Window: 2 * time.Minute, Reducer: config.LastReducer},
+			wantValue:   `{"top_metrics":{"metrics":{"field":"kibana.stats.load"},"sort":{"@timestamp":{"order":"desc"}}}}`,
+		},
+		{
+			name:        "percentile",
+			aggregation: config.Aggregation{Window: 2 * time.Minute, Reducer: config.PercentileReducer, Percentile: 95},
+			wantValue:   `{"percentiles":{"field":"kibana.stats.load","keyed":false,"percents":[95]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryFor(QueryParams{
+				Metric:      "kibana.stats.load",
+				Name:        types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+				Field:       "kubernetes.pod.name",
+				Namespaced:  true,
+				Aggregation: &tt.aggregation,
+			})
+			assert.NoError(t, err)
+			want := `{"aggs":{"timestamp":{"max":{"field":"@timestamp"}},"value":` + tt.wantValue + `},` +
+				`"query":{"bool":{"filter":[{"exists":{"field":"kibana.stats.load"}},{"term":{"kubernetes.namespace":"ns1"}},` +
+				`{"term":{"kubernetes.pod.name":"pod1"}},{"range":{"@timestamp":{"gte":"now-120s"}}}]}},"size":0}`
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_getWindowResult(t *testing.T) {
+	tests := []struct {
+		name         string
+		aggregation  config.Aggregation
+		aggregations string
+		wantValue    float64
+		wantNil      bool
+		wantErr      bool
+	}{
+		{
+			name:         "single value",
+			aggregation:  config.Aggregation{Window: time.Minute},
+			aggregations: `{"value":{"value":1.5},"timestamp":{"value":1680513648000,"value_as_string":"2023-04-03T09:20:48.000Z"}}`,
+			wantValue:    1.5,
+		},
+		{
+			name:         "last",
+			aggregation:  config.Aggregation{Window: time.Minute, Reducer: config.LastReducer},
+			aggregations: `{"value":{"top":[{"sort":["2023-04-03T09:20:48.000Z"],"metrics":{"kibana.stats.load":3}}]},"timestamp":{"value":1680513648000}}`,
+			wantValue:    3,
+		},
+		{
+			name:         "percentile",
+			aggregation:  config.Aggregation{Window: time.Minute, Reducer: config.PercentileReducer, Percentile: 99},
+			aggregations: `{"value":{"values":[{"key":99.0,"value":42}]},"timestamp":{"value":1680513648000}}`,
+			wantValue:    42,
+		},
+		{
+			name:         "no document in the window",
+			aggregation:  config.Aggregation{Window: time.Minute, Reducer: config.SumReducer},
+			aggregations: `{"value":{"value":0},"timestamp":{"value":null}}`,
+			wantNil:      true,
+		},
+		{
+			name:         "missing aggregation",
+			aggregation:  config.Aggregation{Window: time.Minute},
+			aggregations: `{}`,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var aggregations map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(tt.aggregations), &aggregations))
+			got, err := windowedFor("kibana.stats.load", config.Identity{}, &tt.aggregation, false, nil).result(aggregations)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.wantNil {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, tt.wantValue, got.Value.AsApproximateFloat64())
+			assert.Equal(t, int64(1680513648), got.Timestamp.Unix())
+			assert.Equal(t, int64(60), *got.WindowSeconds)
+		})
+	}
+}
+
+func Test_rateResult(t *testing.T) {
+	sample := func(value float64, timestamp string) string {
+		return fmt.Sprintf(`{"_source":{"http":{"requests":{"total":%v}},"@timestamp":"%s"}}`, value, timestamp)
+	}
+	// truncated are the latest samples of a counter increasing by 10 every 10 seconds, over more than the window.
+	var truncated []string
+	for i := 0; i < maxRateSamples; i++ {
+		truncated = append(truncated, sample(float64(10000-10*i), time.Date(2023, 4, 3, 9, 21, 0, 0, time.UTC).Add(-10*time.Duration(i)*time.Second).Format(time.RFC3339)))
+	}
+	tests := []struct {
+		name      string
+		samples   []string
+		window    *config.Aggregation
+		wantValue float64
+		// wantWindow is the window of the rate, the window of the aggregation if not set.
+		wantWindow int64
+		wantNil    bool
+	}{
+		{
+			name: "increasing counter",
+			samples: []string{
+				sample(160, "2023-04-03T09:21:00Z"),
+				sample(130, "2023-04-03T09:20:30Z"),
+				sample(100, "2023-04-03T09:20:00Z"),
+			},
+			wantValue: 1,
+		},
+		{
+			name: "counter reset",
+			samples: []string{
+				sample(40, "2023-04-03T09:21:00Z"),
+				sample(10, "2023-04-03T09:20:30Z"),
+				sample(100, "2023-04-03T09:20:00Z"),
+			},
+			window:    &config.Aggregation{Window: 2 * time.Minute},
+			wantValue: 40.0 / 60,
+		},
+		{
+			name:       "truncated samples",
+			samples:    truncated,
+			window:     &config.Aggregation{Window: time.Hour},
+			wantValue:  1,
+			wantWindow: 990,
+		},
+		{
+			name:    "single sample",
+			samples: []string{sample(100, "2023-04-03T09:20:00Z")},
+			wantNil: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var aggregations map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(`{"samples":{"hits":{"hits":[`+strings.Join(tt.samples, ",")+`]}}}`), &aggregations))
+			w := windowedFor("http.requests.total", config.Identity{}, tt.window, true, nil)
+			got, err := w.result(aggregations)
+			assert.NoError(t, err)
+			if tt.wantNil {
+				assert.Nil(t, got)
+				return
+			}
+			assert.InDelta(t, tt.wantValue, got.Value.AsApproximateFloat64(), 0.001)
+			assert.Equal(t, "2023-04-03T09:21:00Z", got.Timestamp.UTC().Format(time.RFC3339))
+			wantWindow := tt.wantWindow
+			if wantWindow == 0 {
+				wantWindow = w.windowSeconds()
+			}
+			assert.Equal(t, wantWindow, *got.WindowSeconds)
+		})
+	}
+}
+
+func Test_rateResult_series(t *testing.T) {
+	sample := func(value float64, timestamp string) string {
+		return fmt.Sprintf(`{"_source":{"http":{"requests":{"total":%v}},"@timestamp":"%s"}}`, value, timestamp)
+	}
+	// The two series would be interleaved, and seen as resets, if they were not read separately.
+	var aggregations map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"counter_series":{"buckets":[
+		{"key":"container-a|","samples":{"hits":{"hits":[`+
+		sample(1060, "2023-04-03T09:21:00Z")+","+sample(1000, "2023-04-03T09:20:00Z")+`]}}},
+		{"key":"container-b|","samples":{"hits":{"hits":[`+
+		sample(130, "2023-04-03T09:20:50Z")+","+sample(10, "2023-04-03T09:20:00Z")+`]}}},
+		{"key":"container-c|","samples":{"hits":{"hits":[`+sample(5, "2023-04-03T09:20:00Z")+`]}}}
+	]}}`), &aggregations))
+	w := windowedFor("http.requests.total", config.Identity{}, nil, true, []string{"kubernetes.container.name"})
+	got, err := w.result(aggregations)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0+120.0/50, got.Value.AsApproximateFloat64(), 0.001)
+	assert.Equal(t, "2023-04-03T09:21:00Z", got.Timestamp.UTC().Format(time.RFC3339))
+	assert.Equal(t, w.windowSeconds(), *got.WindowSeconds)
+}
+
+func Test_rateQueryFor(t *testing.T) {
+	got, err := queryFor(QueryParams{
+		Metric:     "http.requests.total",
+		Name:       types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+		Field:      "kubernetes.pod.name",
+		Namespaced: true,
+		Counter:    true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"aggs":{"samples":{"top_hits":{"_source":{"includes":["http.requests.total","@timestamp"]},`+
+		`"size":100,"sort":[{"@timestamp":{"order":"desc"}}]}}},`+
+		`"query":{"bool":{"filter":[{"exists":{"field":"http.requests.total"}},{"term":{"kubernetes.namespace":"ns1"}},`+
+		`{"term":{"kubernetes.pod.name":"pod1"}},{"range":{"@timestamp":{"gte":"now-300s"}}}]}},"size":0}`, got)
+
+	// The samples are read for each series identified by the label fields.
+	got, err = queryFor(QueryParams{
+		Metric:     "http.requests.total",
+		Name:       types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+		Field:      "kubernetes.pod.name",
+		Namespaced: true,
+		Counter:    true,
+		Series:     []string{"kubernetes.container.name"},
+	})
+	assert.NoError(t, err)
+	var query map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(got), &query))
+	series := query["aggs"].(map[string]interface{})[seriesAggregation].(map[string]interface{})
+	terms := series["terms"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"fields": []interface{}{"kubernetes.container.name"}}, terms["script"].(map[string]interface{})["params"])
+	assert.Equal(t, float64(maxRateSeries), terms["size"])
+	assert.Contains(t, series["aggs"], samplesAggregation)
+}
@@ -0,0 +1,401 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	esv8 "github.com/elastic/go-elasticsearch/v9"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
+)
+
+const objectsAggregation = "objects"
+
+// getMetricsForObjects gets the values of a metric for several objects using a single request. Objects for which no
+// value has been found are not included in the result.
+func getMetricsForObjects(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	namespace string,
+	names []string,
+	info provider.CustomMetricInfo,
+	metricSelector labels.Selector,
+	originalSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	defer tracing.Span(ctx)()
+	if len(names) == 0 {
+		return map[string]timestampedMetric{}, nil
+	}
+	switch {
+	case metadata.Search == nil:
+		return getDefaultMetricsForObjects(ctx, esClient, metadata, namespace, names, info, metricSelector)
+	case metadata.Search.IsESQL():
+		return getESQLMetricsForObjects(ctx, esClient, metadata, namespace, names, info, metricSelector, originalSelector)
+	case metadata.Search.ObjectsResultQuery != nil:
+		return getPerObjectMetrics(ctx, esClient, metadata, namespace, names, info, metricSelector, originalSelector)
+	default:
+		return getMultiSearchMetrics(ctx, esClient, metadata, namespace, names, info, metricSelector, originalSelector)
+	}
+}
+
+// objectsQueryFor returns the default query used to get the latest value of a metric for several objects.
+func objectsQueryFor(
+	metric, namespace string,
+	resource config.Resource,
+	metadata MetricMetadata,
+	namespaced bool,
+	names []string,
+) map[string]interface{} {
+	identity := metadata.Fields.Identity
+	filter := []interface{}{exists(metric), terms(resource.Field, names)}
+	if namespaced {
+		filter = append(filter, term(identity.GetNamespaceField(), namespace))
+	}
+	if w := metadata.windowed(metric); w != nil {
+		// Compute the value of each object over the window.
+		return map[string]interface{}{
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"filter": append(filter, w.filter()),
+				},
+			},
+			"size": 0,
+			"aggs": map[string]interface{}{
+				objectsAggregation: map[string]interface{}{
+					"terms": map[string]interface{}{
+						"field": resource.Field,
+						"size":  len(names),
+					},
+					"aggs": w.aggregations(),
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filter,
+			},
+		},
+		"size": 0,
+		"aggs": map[string]interface{}{
+			objectsAggregation: map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": resource.Field,
+					"size":  len(names),
+				},
+				"aggs": map[string]interface{}{
+					"latest": map[string]interface{}{
+						"top_hits": map[string]interface{}{
+							"size": 1,
+							"sort": []interface{}{latestFirst(identity.GetTimestampField())},
+							"_source": map[string]interface{}{
+								"includes": []string{metric, identity.GetTimestampField()},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// getDefaultMetricsForObjects gets the latest document of each object using a terms aggregation on the field which
+// holds the name of the objects.
+func getDefaultMetricsForObjects(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	namespace string,
+	names []string,
+	info provider.CustomMetricInfo,
+	metricSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	resource, ok := metadata.resourceFor(info.GroupResource)
+	if !ok {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	if metadata.useTimeSeries() {
+		filter := []interface{}{exists(info.Metric), terms(resource.Field, names)}
+		if info.Namespaced {
+			filter = append(filter, term(metadata.Fields.Identity.GetNamespaceField(), namespace))
+		}
+		return getTimeSeriesMetrics(ctx, esClient, metadata, info.Metric, filter, resource.Field, metricSelector)
+	}
+	body, err := json.Marshal(objectsQueryFor(info.Metric, namespace, resource, metadata, info.Namespaced, names))
+	if err != nil {
+		return nil, err
+	}
+	query, err := withFilters(string(body), selectorFilters(metricSelector, metadata.fieldFor))
+	if err != nil {
+		return nil, err
+	}
+	r, err := doSearch(ctx, esClient, metadata, query)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := getBuckets(r, objectsAggregation)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]timestampedMetric, len(buckets))
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert bucket: %v", b)
+		}
+		name, ok := bucket["key"].(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot convert bucket key: %v", bucket["key"])
+		}
+		if w := metadata.windowed(info.Metric); w != nil {
+			value, err := w.result(bucket)
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				result[name] = *value
+			}
+			continue
+		}
+		latest, ok := bucket["latest"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert top hits: %v", bucket["latest"])
+		}
+		metricDocument, err := firstHit(latest)
+		if err != nil {
+			return nil, err
+		}
+		if metricDocument == nil {
+			continue
+		}
+		value, err := getDocumentResult(ctx, info.Metric, metadata, metricDocument)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// getPerObjectMetrics runs a custom search once for all the objects, the results of each object are then read using the
+// objectsPath, namePath, metricPath and timestampPath.
+func getPerObjectMetrics(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	namespace string,
+	names []string,
+	info provider.CustomMetricInfo,
+	metricSelector labels.Selector,
+	originalSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	query, err := executeTemplate(metadata.Search, customQueryParams{
+		Metric:       info.Metric,
+		PodSelectors: podSelectorsFor(originalSelector),
+		Namespace:    namespace,
+		Objects:      names,
+		Env:          Env,
+	})
+	if err != nil {
+		return nil, err
+	}
+	query, err = withFilters(query, selectorFilters(metricSelector, metadata.fieldFor))
+	if err != nil {
+		return nil, err
+	}
+	r, err := doSearch(ctx, esClient, metadata, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]timestampedMetric)
+	iter := metadata.Search.ObjectsResultQuery.Run(r)
+	for {
+		object, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := object.(error); ok {
+			return nil, err
+		}
+		name, err := getObjectName(metadata.Search, object)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getSearchResult(metadata.Search, object)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// getMultiSearchMetrics runs a custom search for each object, all the searches are sent in a single multi search request.
+func getMultiSearchMetrics(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	namespace string,
+	names []string,
+	info provider.CustomMetricInfo,
+	metricSelector labels.Selector,
+	originalSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	podSelectors := podSelectorsFor(originalSelector)
+	body := bytes.Buffer{}
+	for _, name := range names {
+		query, err := executeTemplate(metadata.Search, customQueryParams{
+			Metric:       info.Metric,
+			Pod:          name,
+			PodSelectors: podSelectors,
+			Namespace:    namespace,
+			Objects:      names,
+			Env:          Env,
+		})
+		if err != nil {
+			return nil, err
+		}
+		query, err = withFilters(query, selectorFilters(metricSelector, metadata.fieldFor))
+		if err != nil {
+			return nil, err
+		}
+		// Searches must be written on a single line.
+		body.WriteString("{}\n")
+		if err := json.Compact(&body, []byte(query)); err != nil {
+			return nil, fmt.Errorf("failed to compact search for %s: %w", name, err)
+		}
+		body.WriteString("\n")
+	}
+
+	res, err := esClient.Msearch(
+		&body,
+		esClient.Msearch.WithContext(*ctx),
+		esClient.Msearch.WithIndex(metadata.Indices...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decodeResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	responses, ok := r["responses"].([]interface{})
+	if !ok || len(responses) != len(names) {
+		return nil, fmt.Errorf("unexpected multi search response: %v", r["responses"])
+	}
+
+	result := make(map[string]timestampedMetric, len(names))
+	for i, response := range responses {
+		searchResponse, ok := response.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert search response: %v", response)
+		}
+		if searchError, hasError := searchResponse["error"]; hasError {
+			return nil, fmt.Errorf("search failed for %s: %v", names[i], searchError)
+		}
+		value, err := getSearchResult(metadata.Search, searchResponse)
+		if err != nil {
+			return nil, err
+		}
+		result[names[i]] = value
+	}
+	return result, nil
+}
+
+// getESQLMetricsForObjects runs an ES|QL query once for all the objects if it returns one row per object, otherwise the
+// query is run for each object.
+func getESQLMetricsForObjects(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	namespace string,
+	names []string,
+	info provider.CustomMetricInfo,
+	metricSelector labels.Selector,
+	originalSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	params := customQueryParams{
+		Metric:       info.Metric,
+		PodSelectors: podSelectorsFor(originalSelector),
+		Namespace:    namespace,
+		Objects:      names,
+		Env:          Env,
+	}
+	result := make(map[string]timestampedMetric, len(names))
+	for i, name := range names {
+		params.Pod = name
+		esqlResult, err := getESQLResult(ctx, esClient, metadata, params, metricSelector)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && esqlResult.HasNames {
+			// One row per object, no need to run the query for each object.
+			for _, row := range esqlResult.Rows {
+				result[row.Name] = row.Metric
+			}
+			return result, nil
+		}
+		if value, found := esqlResult.metricFor(name); found {
+			result[name] = value
+		}
+	}
+	return result, nil
+}
+
+func getObjectName(search *config.Search, object interface{}) (string, error) {
+	iter := search.NameResultQuery.Run(object)
+	v, ok := iter.Next()
+	if !ok {
+		return "", fmt.Errorf("no object name in %v", object)
+	}
+	if err, ok := v.(error); ok {
+		return "", err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("object name is not a string: %v", v)
+	}
+	return name, nil
+}
+
+// getBuckets returns the buckets of a top level bucket aggregation.
+func getBuckets(r map[string]interface{}, aggregation string) ([]interface{}, error) {
+	aggregations, ok := r["aggregations"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	agg, ok := aggregations[aggregation].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert aggregation %s: %v", aggregation, aggregations[aggregation])
+	}
+	buckets, ok := agg["buckets"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert buckets: %v", agg["buckets"])
+	}
+	return buckets, nil
+}
@@ -0,0 +1,218 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"text/template"
+
+	esv8 "github.com/elastic/go-elasticsearch/v9"
+	"github.com/itchyny/gojq"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// fakeTransport records the requests sent to Elasticsearch and returns the response set for the path of the request,
+// or response if there is none.
+type fakeTransport struct {
+	response  string
+	responses map[string]string
+	requests  []*http.Request
+	bodies    []string
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests = append(f.requests, req)
+	body := ""
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+	f.bodies = append(f.bodies, body)
+	response, ok := f.responses[req.URL.Path]
+	if !ok {
+		response = f.response
+	}
+	header := http.Header{}
+	header.Set("X-Elastic-Product", "Elasticsearch")
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(response)),
+	}, nil
+}
+
+func newFakeClient(t *testing.T, response string) (*esv8.Client, *fakeTransport) {
+	t.Helper()
+	transport := &fakeTransport{response: response}
+	esClient, err := esv8.NewClient(esv8.Config{Transport: transport})
+	assert.NoError(t, err)
+	return esClient, transport
+}
+
+func newSearch(t *testing.T, search config.Search) *config.Search {
+	t.Helper()
+	search.Template = template.Must(template.New("").Parse(search.Body))
+	for query, path := range map[**gojq.Query]string{
+		&search.MetricResultQuery:    search.MetricPath,
+		&search.TimestampResultQuery: search.TimestampPath,
+		&search.ObjectsResultQuery:   search.ObjectsPath,
+		&search.NameResultQuery:      search.GetNamePath(),
+	} {
+		if path == "" {
+			continue
+		}
+		compiled, err := gojq.Parse(path)
+		assert.NoError(t, err)
+		*query = compiled
+	}
+	return &search
+}
+
+var podMetric = podMetricFor("kibana.stats.load")
+
+func podMetricFor(metric string) provider.CustomMetricInfo {
+	return provider.CustomMetricInfo{
+		GroupResource: schema.GroupResource{Resource: "pods"},
+		Namespaced:    true,
+		Metric:        metric,
+	}
+}
+
+func Test_getMetricsForObjects(t *testing.T) {
+	tests := []struct {
+		name        string
+		search      *config.Search
+		response    string
+		wantPath    string
+		wantBody    string
+		wantResults map[string]float64
+		wantErr     bool
+	}{
+		{
+			name: "default query",
+			response: `{"aggregations":{"objects":{"buckets":[
+				{"key":"pod-a","latest":{"hits":{"hits":[{"_source":{"kibana":{"stats":{"load":1.5}},"@timestamp":"2023-04-03T09:20:48Z"}}]}}},
+				{"key":"pod-b","latest":{"hits":{"hits":[{"_source":{"kibana":{"stats":{"load":3}},"@timestamp":"2023-04-03T09:20:46Z"}}]}}}
+			]}}}`,
+			wantPath: "/metricbeat-*/_search",
+			wantBody: `{"aggs":{"objects":{"aggs":{"latest":{"top_hits":{"_source":{"includes":["kibana.stats.load","@timestamp"]},` +
+				`"size":1,"sort":[{"@timestamp":{"order":"desc"}}]}}},"terms":{"field":"kubernetes.pod.name","size":3}}},` +
+				`"query":{"bool":{"filter":[{"exists":{"field":"kibana.stats.load"}},` +
+				`{"terms":{"kubernetes.pod.name":["pod-a","pod-b","pod-c"]}},{"term":{"kubernetes.namespace":"ns1"}}]}},"size":0}`,
+			wantResults: map[string]float64{"pod-a": 1.5, "pod-b": 3},
+		},
+		{
+			name: "per-object search",
+			search: newSearch(t, config.Search{
+				Body:          `{"size":0,"aggs":{"pods":{"terms":{"field":"kubernetes.pod.name","include":[{{ range $i, $o := .Objects }}{{ if $i }},{{ end }}"{{ $o }}"{{ end }}]}}}}`,
+				ObjectsPath:   ".aggregations.pods.buckets[]",
+				MetricPath:    ".load.value",
+				TimestampPath: ".timestamp.value_as_string",
+			}),
+			response: `{"aggregations":{"pods":{"buckets":[
+				{"key":"pod-a","load":{"value":2},"timestamp":{"value_as_string":"2023-04-03T09:20:48Z"}},
+				{"key":"pod-c","load":{"value":4},"timestamp":{"value_as_string":"2023-04-03T09:20:48Z"}}
+			]}}}`,
+			wantPath:    "/metricbeat-*/_search",
+			wantBody:    `{"size":0,"aggs":{"pods":{"terms":{"field":"kubernetes.pod.name","include":["pod-a","pod-b","pod-c"]}}}}`,
+			wantResults: map[string]float64{"pod-a": 2, "pod-c": 4},
+		},
+		{
+			name: "multi search",
+			search: newSearch(t, config.Search{
+				Body:          `{"query":{"term":{"kubernetes.pod.name":"{{ .Pod }}"}},"size":1}`,
+				MetricPath:    ".hits.hits[0]._source.kibana.stats.load",
+				TimestampPath: ".hits.hits[0]._source[\"@timestamp\"]",
+			}),
+			response: `{"responses":[
+				{"hits":{"hits":[{"_source":{"kibana":{"stats":{"load":1}},"@timestamp":"2023-04-03T09:20:48Z"}}]}},
+				{"hits":{"hits":[{"_source":{"kibana":{"stats":{"load":2}},"@timestamp":"2023-04-03T09:20:48Z"}}]}},
+				{"hits":{"hits":[{"_source":{"kibana":{"stats":{"load":3}},"@timestamp":"2023-04-03T09:20:48Z"}}]}}
+			]}`,
+			wantPath: "/metricbeat-*/_msearch",
+			wantBody: "{}\n" + `{"query":{"term":{"kubernetes.pod.name":"pod-a"}},"size":1}` + "\n" +
+				"{}\n" + `{"query":{"term":{"kubernetes.pod.name":"pod-b"}},"size":1}` + "\n" +
+				"{}\n" + `{"query":{"term":{"kubernetes.pod.name":"pod-c"}},"size":1}` + "\n",
+			wantResults: map[string]float64{"pod-a": 1, "pod-b": 2, "pod-c": 3},
+		},
+		{
+			name: "multi search with a failed search",
+			search: newSearch(t, config.Search{
+				Body:          `{"query":{"term":{"kubernetes.pod.name":"{{ .Pod }}"}},"size":1}`,
+				MetricPath:    ".hits.hits[0]._source.kibana.stats.load",
+				TimestampPath: ".hits.hits[0]._source[\"@timestamp\"]",
+			}),
+			response: `{"responses":[
+				{"hits":{"hits":[]}},
+				{"error":{"type":"index_not_found_exception"}},
+				{"hits":{"hits":[]}}
+			]}`,
+			wantPath: "/metricbeat-*/_msearch",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			esClient, transport := newFakeClient(t, tt.response)
+			metadata := MetricMetadata{
+				Fields:  config.Fields{},
+				Search:  tt.search,
+				Indices: []string{"metricbeat-*"},
+			}
+			ctx := context.Background()
+			got, err := getMetricsForObjects(&ctx, esClient, metadata, "ns1", []string{"pod-a", "pod-b", "pod-c"}, podMetric, labels.Everything(), labels.Everything())
+			assert.Equal(t, 1, len(transport.requests), "a single request must be sent")
+			assert.Equal(t, tt.wantPath, transport.requests[0].URL.Path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantBody, transport.bodies[0])
+			values := make(map[string]float64, len(got))
+			for name, value := range got {
+				values[name] = value.Value.AsApproximateFloat64()
+				assert.False(t, value.Timestamp.IsZero())
+			}
+			assert.Equal(t, tt.wantResults, values)
+		})
+	}
+}
+
+func Test_getMetricsForObjects_noObjects(t *testing.T) {
+	esClient, transport := newFakeClient(t, `{}`)
+	ctx := context.Background()
+	got, err := getMetricsForObjects(&ctx, esClient, MetricMetadata{}, "ns1", nil, podMetric, labels.Everything(), labels.Everything())
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+	assert.Empty(t, transport.requests)
+}
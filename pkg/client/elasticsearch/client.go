@@ -19,21 +19,18 @@ package elasticsearch
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"sync"
 
 	"github.com/go-logr/logr"
 
-	apierr "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
@@ -41,6 +38,7 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider/helpers"
 
+	"github.com/elastic/elastic-transport-go/v8/elastictransport"
 	esv8 "github.com/elastic/go-elasticsearch/v9"
 	"go.elastic.co/apm/module/apmelasticsearch/v2"
 	"go.elastic.co/apm/v2"
@@ -51,55 +49,33 @@ import (
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
 )
 
-const (
-	query = `
-{
-	"query": {
-		"bool": {
-			"must": [{
-				"exists": {
-					"field": "%s"
-				}
-			}, {
-				"match": {
-					"kubernetes.namespace": "%s"
-				}
-			}, {
-				"match": {
-					"kubernetes.pod.name": "%s"
-				}
-			}]
-		}
-	},
-	"size": 1,
-  "sort": [
-    {
-      "@timestamp": {
-        "order": "desc"
-      }
-    }
-  ]
-}
-`
-)
-
 // MetricsClient is a wrapper around the Elasticsearch client to implement to metrics interface.
 type MetricsClient struct {
 	*esv8.Client
 	metricServerCfg config.MetricServer
 	lock            sync.RWMutex
 
-	// metrics list of the metrics currently known ny this client
-	metrics map[string]provider.CustomMetricInfo
+	// metrics list of the metrics currently known ny this client, for each associated resource
+	metrics map[string][]provider.CustomMetricInfo
 
 	// indexedMetrics is used to associate a metric name with an index and a field.
 	indexedMetrics map[string]MetricMetadata
 
 	// namer maintains an index of the metric aliases and their real names in the Elasticsearch cluster.
 	namer config.Namer
+	// discovered is true once the metrics have been discovered successfully.
+	discovered bool
 
 	client dynamic.Interface
 	mapper apimeta.RESTMapper
+	// unknownResources holds the resources which are not known by the API server and have already been logged.
+	unknownResources sync.Map
+
+	// credentials are reloaded when the credential files are updated.
+	credentials *credentials
+
+	// breaker is the circuit breaker of the server, nil if it is not enabled.
+	breaker *client.CircuitBreaker
 
 	tracer *apm.Tracer
 	logger logr.Logger
@@ -111,61 +87,102 @@ func (mc *MetricsClient) GetConfiguration() config.MetricServer {
 
 func NewElasticsearchClient(
 	metricServerCfg config.MetricServer,
-	client dynamic.Interface,
+	dynamicClient dynamic.Interface,
 	mapper apimeta.RESTMapper,
 	tracer *apm.Tracer,
 ) (*MetricsClient, error) {
 	logger := log.ForPackage("elasticsearch")
 
-	tlsConfig, err := newTLSClientConfig(logger, metricServerCfg.ClientConfig.TLSClientConfig)
+	cfg, creds, err := newClientConfig(logger, metricServerCfg.Name, metricServerCfg.ClientConfig)
 	if err != nil {
 		return nil, err
 	}
-	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-
-	cfg := esv8.Config{
-		Addresses: []string{os.ExpandEnv(metricServerCfg.ClientConfig.Host)},
-		Transport: apmelasticsearch.WrapRoundTripper(transport),
-	}
-
-	if metricServerCfg.ClientConfig.AuthenticationConfig != nil {
-		cfg.Username = os.ExpandEnv(metricServerCfg.ClientConfig.AuthenticationConfig.Username)
-		cfg.Password = os.ExpandEnv(metricServerCfg.ClientConfig.AuthenticationConfig.Password)
-	}
-
+	// Nodes are discovered once the transport has been wrapped.
+	discoverNodesOnStart := cfg.DiscoverNodesOnStart
+	cfg.DiscoverNodesOnStart = false
 	esClient, err := esv8.NewClient(cfg)
 	if err != nil {
 		return nil, err
 	}
+	breaker := client.NewCircuitBreaker(metricServerCfg)
+	esClient.Transport = newResilientTransport(logger, metricServerCfg, esClient.Transport, breaker)
+	if discoverNodesOnStart {
+		go func() {
+			if err := esClient.DiscoverNodes(); err != nil {
+				logger.Error(err, "Failed to discover Elasticsearch nodes", "client", metricServerCfg.Name)
+			}
+		}()
+	}
+	if err := creds.watch(); err != nil {
+		return nil, fmt.Errorf("%s: failed to watch credentials: %w", metricServerCfg.Name, err)
+	}
 	return &MetricsClient{
 		logger:          logger,
 		Client:          esClient,
+		credentials:     creds,
+		breaker:         breaker,
 		metricServerCfg: metricServerCfg,
-		client:          client,
+		client:          dynamicClient,
 		mapper:          mapper,
 		tracer:          tracer,
 	}, nil
 }
 
 var _ client.Interface = &MetricsClient{}
+var _ client.NodesReporter = &MetricsClient{}
+var _ client.CircuitBreakerReporter = &MetricsClient{}
+var _ client.Closer = &MetricsClient{}
+
+// Close closes the connections to Elasticsearch, once the in-flight requests are completed or the context is done, and
+// stops watching the credential files.
+func (mc *MetricsClient) Close(ctx context.Context) error {
+	return errors.Join(mc.Client.Close(ctx), mc.credentials.Close())
+}
+
+func (mc *MetricsClient) CircuitBreaker() *client.CircuitBreaker {
+	return mc.breaker
+}
 
-func (mc *MetricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error) {
-	if err := mc.discoverMetrics(); err != nil {
+// NodesHealth returns the health of the Elasticsearch nodes, a node is not healthy if the last request sent to it failed.
+func (mc *MetricsClient) NodesHealth() ([]client.NodeHealth, error) {
+	metrics, err := mc.Client.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]client.NodeHealth, 0, len(metrics.Connections))
+	for _, c := range metrics.Connections {
+		connection, ok := c.(elastictransport.ConnectionMetric)
+		if !ok {
+			continue
+		}
+		nodes = append(nodes, client.NodeHealth{
+			URL:       connection.URL,
+			Name:      connection.Meta.Name,
+			Healthy:   !connection.IsDead,
+			Failures:  connection.Failures,
+			DeadSince: connection.DeadSince,
+		})
+	}
+	return nodes, nil
+}
+
+func (mc *MetricsClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	if err := mc.discoverMetrics(ctx); err != nil {
 		return nil, err
 	}
 	mc.lock.RLock()
 	defer mc.lock.RUnlock()
 	customMetrics := make(map[provider.CustomMetricInfo]struct{}, len(mc.metrics))
-	for i := range mc.metrics {
-		customMetrics[mc.metrics[i]] = struct{}{}
+	for _, infos := range mc.metrics {
+		for _, info := range infos {
+			customMetrics[info] = struct{}{}
+		}
 	}
 	return customMetrics, nil
 }
 
-func (mc *MetricsClient) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
-	t, ctx := tracing.NewTransaction(context.TODO(), mc.tracer, "elasticsearch-provider", "GetMetricBySelector")
+func (mc *MetricsClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	t, ctx := tracing.NewTransaction(ctx, mc.tracer, "elasticsearch-provider", "GetMetricBySelector")
 	defer tracing.EndTransaction(t)
 	mc.logger.V(1).Info("GetMetricByName", "name", name, "info", info.String(), "metricSelector", metricSelector)
 	value, err := mc.valueFor(&ctx, info, name, labels.NewSelector(), []string{}, metricSelector)
@@ -175,48 +192,128 @@ func (mc *MetricsClient) GetMetricByName(name types.NamespacedName, info provide
 	return mc.metricFor(&ctx, value, name, labels.Everything(), info, metricSelector)
 }
 
-func (mc *MetricsClient) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
-	t, ctx := tracing.NewTransaction(context.TODO(), mc.tracer, "elasticsearch-provider", "GetMetricBySelector")
+func (mc *MetricsClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	t, ctx := tracing.NewTransaction(ctx, mc.tracer, "elasticsearch-provider", "GetMetricBySelector")
 	defer tracing.EndTransaction(t)
 	mc.logger.V(1).Info("GetMetricBySelector", "namespace", namespace, "selector", selector, "info", info.String(), "metricSelector", metricSelector)
 	return mc.metricsFor(&ctx, namespace, selector, info, metricSelector)
 }
 
 func (mc *MetricsClient) GetExternalMetric(
-	_, _ string,
-	_ labels.Selector,
+	ctx context.Context,
+	name, namespace string,
+	selector labels.Selector,
 ) (*external_metrics.ExternalMetricValueList, error) {
-	mc.logger.Error(errors.New("not supported by Elasticsearch metrics client"), "Fail to GetExternalMetric")
-	return nil, nil
+	t, ctx := tracing.NewTransaction(ctx, mc.tracer, "elasticsearch-provider", "GetExternalMetric")
+	defer tracing.EndTransaction(t)
+	mc.logger.V(1).Info("GetExternalMetric", "name", name, "namespace", namespace, "selector", selector)
+	mc.lock.RLock()
+	metricName, ok := mc.namer.Get(name)
+	if !ok {
+		mc.lock.RUnlock()
+		return nil, fmt.Errorf("metric name alias for external metric %s not found", name)
+	}
+	metadata, ok := mc.indexedMetrics[metricName]
+	mc.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no metadata for metric %s", metricName)
+	}
+
+	value, err := getExternalMetric(&ctx, mc.Client, metadata, metricName, namespace, selector)
+	if err != nil {
+		return nil, tracing.CaptureError(ctx, err)
+	}
+
+	valueList := &external_metrics.ExternalMetricValueList{}
+	if value == nil {
+		// No document matches the selector.
+		return valueList, nil
+	}
+	valueList.Items = []external_metrics.ExternalMetricValue{
+		{
+			MetricName:    name,
+			MetricLabels:  selectorLabels(selector),
+			Timestamp:     value.Timestamp,
+			WindowSeconds: value.WindowSeconds,
+			Value:         value.Value,
+		},
+	}
+	return valueList, nil
 }
 
-func (mc *MetricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error) {
-	mc.logger.V(1).Info("ListAllExternalMetrics: not supported by Elasticsearch metrics client")
-	return nil, nil
+func (mc *MetricsClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	mc.lock.RLock()
+	discovered := mc.discovered
+	mc.lock.RUnlock()
+	if !discovered || !mc.metricServerCfg.MetricTypes.HasType(config.CustomMetricType) {
+		// Metrics are discovered while custom metrics are listed, do it now if custom metrics are not served, or if they
+		// have not been discovered yet.
+		if err := mc.discoverMetrics(ctx); err != nil {
+			return nil, err
+		}
+	}
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	externalMetrics := make(map[provider.ExternalMetricInfo]struct{}, len(mc.metrics))
+	for _, infos := range mc.metrics {
+		for _, info := range infos {
+			externalMetrics[provider.ExternalMetricInfo{Metric: info.Metric}] = struct{}{}
+		}
+	}
+	return externalMetrics, nil
 }
 
-func newTLSClientConfig(logger logr.Logger, config *config.TLSClientConfig) (*tls.Config, error) {
-	if config == nil {
-		// If nothing has been set just return a nil struct
-		logger.V(1).Info("No Elasticsearch TLS configuration provided")
-		return nil, nil
+// selectorLabels returns the labels with a single value in a selector.
+func selectorLabels(selector labels.Selector) map[string]string {
+	result := make(map[string]string)
+	if selector == nil {
+		return result
 	}
-	logger.V(1).Info("Loading Elasticsearch TLS configuration")
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: config.Insecure,
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		switch requirement.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			if values := requirement.Values(); values.Len() == 1 {
+				result[requirement.Key()] = values.List()[0]
+			}
+		}
 	}
+	return result
+}
 
-	if config.CAFile != "" {
-		// Load CA cert
-		caCert, err := ioutil.ReadFile(config.CAFile)
-		if err != nil {
-			return nil, err
+// newClientConfig converts the configuration of a metric server into the configuration of the Elasticsearch client. The
+// returned credentials are the transport of the client.
+func newClientConfig(logger logr.Logger, name string, clientConfig config.HTTPClientConfig) (esv8.Config, *credentials, error) {
+	creds, err := newCredentials(logger, name, clientConfig)
+	if err != nil {
+		return esv8.Config{}, nil, err
+	}
+	cfg := esv8.Config{
+		Transport: apmelasticsearch.WrapRoundTripper(creds),
+		// Metrics are used to report the health of the nodes.
+		EnableMetrics: true,
+		// Requests are sent to another node on network errors and 502, other errors are retried with a backoff by
+		// resilientTransport.
+		RetryOnStatus: []int{http.StatusBadGateway},
+	}
+	if len(clientConfig.CloudID) > 0 {
+		cfg.CloudID = os.ExpandEnv(clientConfig.CloudID)
+	} else {
+		for _, host := range clientConfig.GetHosts() {
+			cfg.Addresses = append(cfg.Addresses, os.ExpandEnv(host))
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
 	}
-	return tlsConfig, nil
+	if sniffing := clientConfig.Sniffing; sniffing != nil {
+		cfg.DiscoverNodesOnStart = sniffing.OnStart
+		cfg.DiscoverNodesInterval = sniffing.Interval
+	}
+	if auth := clientConfig.AuthenticationConfig; auth != nil {
+		// Credentials read from files are set by the transport.
+		cfg.Username = os.ExpandEnv(auth.Username)
+		cfg.Password = os.ExpandEnv(auth.Password)
+		cfg.APIKey = os.ExpandEnv(auth.APIKey)
+	}
+	return cfg, creds, nil
 }
 
 // valueFor is a helper function to get just the value of a specific metric
@@ -229,33 +326,48 @@ func (mc *MetricsClient) valueFor(
 	metricSelector labels.Selector,
 ) (timestampedMetric, error) {
 	defer tracing.Span(ctx)()
-	info, _, err := info.Normalized(mc.mapper)
+	info, metadata, err := mc.metadataFor(info)
 	if err != nil {
 		return timestampedMetric{}, err
 	}
+	return getMetricForPod(ctx, mc.Client, metadata, name, info, metricSelector, originalSelector, objects)
+}
+
+// valuesFor is a helper function to get the values of a specific metric for several objects using a single request.
+func (mc *MetricsClient) valuesFor(
+	ctx *context.Context,
+	info provider.CustomMetricInfo,
+	namespace string,
+	names []string,
+	originalSelector labels.Selector,
+	metricSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	defer tracing.Span(ctx)()
+	info, metadata, err := mc.metadataFor(info)
+	if err != nil {
+		return nil, err
+	}
+	return getMetricsForObjects(ctx, mc.Client, metadata, namespace, names, info, metricSelector, originalSelector)
+}
+
+// metadataFor returns the normalized metric info, with the original name of the metric, and the metadata of the metric.
+func (mc *MetricsClient) metadataFor(info provider.CustomMetricInfo) (provider.CustomMetricInfo, MetricMetadata, error) {
+	info, _, err := info.Normalized(mc.mapper)
+	if err != nil {
+		return info, MetricMetadata{}, err
+	}
 	mc.lock.RLock()
 	defer mc.lock.RUnlock()
 	metricName, ok := mc.namer.Get(info.Metric)
 	if !ok {
-		return timestampedMetric{}, fmt.Errorf("metric name alias for custom metric %s not found", info.Metric)
+		return info, MetricMetadata{}, fmt.Errorf("metric name alias for custom metric %s not found", info.Metric)
 	}
 	info.Metric = metricName
 	metadata, ok := mc.indexedMetrics[info.Metric]
 	if !ok {
-		return timestampedMetric{}, fmt.Errorf("no metadata for metric %s", info.Metric)
-	}
-	value, err := getMetricForPod(ctx, mc.Client, metadata, name, info, metricSelector, originalSelector, objects)
-	if err != nil {
-		return timestampedMetric{}, err
+		return info, MetricMetadata{}, fmt.Errorf("no metadata for metric %s", info.Metric)
 	}
-
-	// TODO: handle metricSelector
-	/*if !metricSelector.Matches(value.labels) {
-		return resource.Quantity{}, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
-	}*/
-
-	return value, nil
-
+	return info, metadata, nil
 }
 
 // metricFor is a helper function which formats a value, metric, and object info into a MetricValue which can be returned by the metrics API
@@ -278,8 +390,9 @@ func (mc *MetricsClient) metricFor(
 		Metric: custom_metrics.MetricIdentifier{
 			Name: info.Metric,
 		},
-		Timestamp: timeStampedMetric.Timestamp,
-		Value:     timeStampedMetric.Value,
+		Timestamp:     timeStampedMetric.Timestamp,
+		WindowSeconds: timeStampedMetric.WindowSeconds,
+		Value:         timeStampedMetric.Value,
 	}
 
 	if len(metricSelector.String()) > 0 {
@@ -308,17 +421,18 @@ func (mc *MetricsClient) metricsFor(
 		return nil, err
 	}
 
+	values, err := mc.valuesFor(ctx, info, namespace, names, selector, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+
 	res := make([]custom_metrics.MetricValue, 0, len(names))
 	for _, name := range names {
-		namespacedName := types.NamespacedName{Name: name, Namespace: namespace}
-		value, err := mc.valueFor(ctx, info, namespacedName, selector, names, metricSelector)
-		if err != nil {
-			if apierr.IsNotFound(err) {
-				continue
-			}
-			return nil, err
+		value, found := values[name]
+		if !found {
+			continue
 		}
-
+		namespacedName := types.NamespacedName{Name: name, Namespace: namespace}
 		metric, err := mc.metricFor(ctx, value, namespacedName, selector, info, metricSelector)
 		if err != nil {
 			return nil, err
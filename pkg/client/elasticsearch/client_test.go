@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	esv8 "github.com/elastic/go-elasticsearch/v9"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+func Test_newClientConfig(t *testing.T) {
+	t.Setenv("API_KEY", "ZnJvbS1lbnY=")
+
+	t.Run("API key from an environment variable", func(t *testing.T) {
+		cfg, _, err := newClientConfig(logr.Discard(), "es", config.HTTPClientConfig{
+			Host:                 "https://elasticsearch-es-http.default.svc:9200",
+			AuthenticationConfig: &config.AuthenticationConfig{APIKey: "${API_KEY}"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://elasticsearch-es-http.default.svc:9200"}, cfg.Addresses)
+		assert.Equal(t, "ZnJvbS1lbnY=", cfg.APIKey)
+	})
+
+	t.Run("Cloud ID", func(t *testing.T) {
+		cfg, _, err := newClientConfig(logr.Discard(), "es", config.HTTPClientConfig{
+			CloudID: "my-deployment:ZXUtY2VudHJhbC0xLmF3cy5jbG91ZC5lcy5pbyQ=",
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, cfg.Addresses)
+		assert.Equal(t, "my-deployment:ZXUtY2VudHJhbC0xLmF3cy5jbG91ZC5lcy5pbyQ=", cfg.CloudID)
+	})
+
+	t.Run("missing API key file", func(t *testing.T) {
+		_, _, err := newClientConfig(logr.Discard(), "es", config.HTTPClientConfig{
+			Host:                 "https://elasticsearch-es-http.default.svc:9200",
+			AuthenticationConfig: &config.AuthenticationConfig{APIKeyFile: filepath.Join(t.TempDir(), "missing")},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestMetricsClient_NodesHealth(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer healthy.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unavailable.Close()
+
+	cfg, _, err := newClientConfig(logr.Discard(), "es", config.HTTPClientConfig{
+		Hosts: []string{unavailable.URL, healthy.URL},
+	})
+	assert.NoError(t, err)
+	esClient, err := esv8.NewClient(cfg)
+	assert.NoError(t, err)
+	mc := &MetricsClient{Client: esClient}
+
+	// Requests are retried on the other node.
+	for i := 0; i < 2; i++ {
+		res, err := esClient.Info()
+		assert.NoError(t, err)
+		assert.False(t, res.IsError())
+		_ = res.Body.Close()
+	}
+
+	nodes, err := mc.NodesHealth()
+	assert.NoError(t, err)
+	health := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		health[node.URL] = node.Healthy
+	}
+	assert.Equal(t, map[string]bool{unavailable.URL: false, healthy.URL: true}, health)
+}
@@ -0,0 +1,284 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+const (
+	caCredential          = "caFile"
+	certificateCredential = "certFile"
+	apiKeyCredential      = "apiKeyFile"
+	tokenCredential       = "tokenFile"
+	passwordCredential    = "passwordFile"
+)
+
+var (
+	credentialsReloadTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "credentials_last_reload_timestamp_seconds",
+		Help: "The time of the last reload of a credential file",
+	}, []string{"client", "credential"})
+	credentialsReloadSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "credentials_last_reload_success",
+		Help: "Whether the last reload of a credential file succeeded",
+	}, []string{"client", "credential"})
+)
+
+// credentials holds the credentials and the CA bundle read from files, they are reloaded when the files are updated.
+// It is the transport of the Elasticsearch client: new connections use the latest TLS material, and the authorization
+// header is set on each request.
+type credentials struct {
+	logger logr.Logger
+	client string
+	auth   *config.AuthenticationConfig
+	tls    *config.TLSClientConfig
+
+	lock sync.RWMutex
+	// rootCAs and certificate are the TLS material used by transport.
+	rootCAs     *x509.CertPool
+	certificate *tls.Certificate
+	transport   *http.Transport
+	// authorization is the authorization header built from the credential files, if any.
+	authorization string
+
+	watcher *fsnotify.Watcher
+}
+
+// newCredentials loads the credentials of a client, an error is returned if one of them cannot be read.
+func newCredentials(logger logr.Logger, client string, clientConfig config.HTTPClientConfig) (*credentials, error) {
+	c := &credentials{
+		logger: logger,
+		client: client,
+		auth:   clientConfig.AuthenticationConfig,
+		tls:    clientConfig.TLSClientConfig,
+	}
+	if c.tls == nil {
+		// If nothing has been set just use the default TLS configuration
+		logger.V(1).Info("No Elasticsearch TLS configuration provided")
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// files returns the credential files, by credential.
+func (c *credentials) files() map[string][]string {
+	files := make(map[string][]string)
+	if c.tls != nil && len(c.tls.CAFile) > 0 {
+		files[caCredential] = []string{c.tls.CAFile}
+	}
+	if c.auth == nil {
+		return files
+	}
+	if len(c.auth.CertFile) > 0 {
+		files[certificateCredential] = []string{c.auth.CertFile, c.auth.KeyFile}
+	}
+	if len(c.auth.APIKeyFile) > 0 {
+		files[apiKeyCredential] = []string{c.auth.APIKeyFile}
+	}
+	if len(c.auth.BearerTokenFile) > 0 {
+		files[tokenCredential] = []string{c.auth.BearerTokenFile}
+	}
+	if len(c.auth.PasswordFile) > 0 {
+		files[passwordCredential] = []string{c.auth.PasswordFile}
+	}
+	return files
+}
+
+// reload reads all the credential files. A credential which cannot be read is not updated, the previous one is still
+// used, and an error is returned.
+func (c *credentials) reload() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var errs []error
+	tlsUpdated := c.transport == nil
+	for credential := range c.files() {
+		var err error
+		switch credential {
+		case caCredential:
+			err = c.loadCA()
+			tlsUpdated = tlsUpdated || err == nil
+		case certificateCredential:
+			err = c.loadCertificate()
+			tlsUpdated = tlsUpdated || err == nil
+		case apiKeyCredential:
+			err = c.loadAuthorization(c.auth.APIKeyFile, func(apiKey string) string { return "ApiKey " + apiKey })
+		case tokenCredential:
+			err = c.loadAuthorization(c.auth.BearerTokenFile, func(token string) string { return "Bearer " + token })
+		case passwordCredential:
+			err = c.loadAuthorization(c.auth.PasswordFile, func(password string) string {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(os.ExpandEnv(c.auth.Username)+":"+password))
+			})
+		}
+		credentialsReloadTimestamp.WithLabelValues(c.client, credential).SetToCurrentTime()
+		if err != nil {
+			credentialsReloadSuccess.WithLabelValues(c.client, credential).Set(0)
+			errs = append(errs, fmt.Errorf("failed to load %s: %w", credential, err))
+			continue
+		}
+		credentialsReloadSuccess.WithLabelValues(c.client, credential).Set(1)
+	}
+	if tlsUpdated {
+		previous := c.transport
+		c.transport = &http.Transport{TLSClientConfig: c.tlsConfig()}
+		if previous != nil {
+			// Connections established with the previous TLS material are not reused.
+			previous.CloseIdleConnections()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *credentials) loadCA() error {
+	caCert, err := os.ReadFile(c.tls.CAFile)
+	if err != nil {
+		return err
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no certificate found in %s", c.tls.CAFile)
+	}
+	c.rootCAs = caCertPool
+	return nil
+}
+
+func (c *credentials) loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(c.auth.CertFile, c.auth.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.certificate = &cert
+	return nil
+}
+
+// loadAuthorization reads a secret from a file, leading and trailing white spaces are removed, and builds the
+// authorization header.
+func (c *credentials) loadAuthorization(path string, header func(secret string) string) error {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.authorization = header(strings.TrimSpace(string(secret)))
+	return nil
+}
+
+// tlsConfig returns the TLS configuration built from the latest TLS material.
+func (c *credentials) tlsConfig() *tls.Config {
+	if c.tls == nil && c.certificate == nil {
+		return nil
+	}
+	tlsConfig := &tls.Config{
+		RootCAs: c.rootCAs,
+	}
+	if c.tls != nil {
+		tlsConfig.InsecureSkipVerify = c.tls.Insecure
+	}
+	if c.certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.certificate}
+	}
+	return tlsConfig
+}
+
+// RoundTrip sends a request using the latest credentials.
+func (c *credentials) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.lock.RLock()
+	transport, authorization := c.transport, c.authorization
+	c.lock.RUnlock()
+	if len(authorization) > 0 {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", authorization)
+	}
+	return transport.RoundTrip(req)
+}
+
+// watch reloads the credentials when the credential files are updated. The directories of the files are watched, since
+// the files mounted from a Secret are updated by replacing a symbolic link.
+func (c *credentials) watch() error {
+	files := c.files()
+	if len(files) == 0 {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	directories := make(map[string]struct{})
+	for _, paths := range files {
+		for _, path := range paths {
+			directories[filepath.Dir(path)] = struct{}{}
+		}
+	}
+	for directory := range directories {
+		if err := watcher.Add(directory); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+	c.watcher = watcher
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) {
+					continue
+				}
+				c.logger.V(1).Info("Reloading credentials", "client", c.client, "event", event.String())
+				if err := c.reload(); err != nil {
+					c.logger.Error(err, "Failed to reload credentials", "client", c.client)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				c.logger.Error(err, "Error while watching credentials", "client", c.client)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the credential files.
+func (c *credentials) Close() error {
+	if c.watcher == nil {
+		return nil
+	}
+	return c.watcher.Close()
+}
+
+var _ http.RoundTripper = &credentials{}
@@ -0,0 +1,205 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// authorizationServer records the authorization header of the last request.
+type authorizationServer struct {
+	*httptest.Server
+	lock          sync.Mutex
+	authorization string
+}
+
+func newAuthorizationServer(t *testing.T) *authorizationServer {
+	t.Helper()
+	s := &authorizationServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.authorization = r.Header.Get("Authorization")
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// authorizationOf sends a request using the credentials and returns the authorization header received by the server.
+func (s *authorizationServer) authorizationOf(t *testing.T, c *credentials) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	assert.NoError(t, err)
+	res, err := c.RoundTrip(req)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.authorization
+}
+
+func Test_credentials_reload(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	tests := []struct {
+		name       string
+		credential string
+		auth       *config.AuthenticationConfig
+		want       func(secret string) string
+	}{
+		{
+			name:       "API key",
+			credential: apiKeyCredential,
+			auth:       &config.AuthenticationConfig{APIKeyFile: secretFile},
+			want:       func(secret string) string { return "ApiKey " + secret },
+		},
+		{
+			name:       "service account token",
+			credential: tokenCredential,
+			auth:       &config.AuthenticationConfig{BearerTokenFile: secretFile},
+			want:       func(secret string) string { return "Bearer " + secret },
+		},
+		{
+			name:       "password",
+			credential: passwordCredential,
+			auth:       &config.AuthenticationConfig{Username: "metrics-adapter", PasswordFile: secretFile},
+			want: func(secret string) string {
+				req := &http.Request{Header: http.Header{}}
+				req.SetBasicAuth("metrics-adapter", secret)
+				return req.Header.Get("Authorization")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newAuthorizationServer(t)
+			assert.NoError(t, os.WriteFile(secretFile, []byte("first\n"), 0600))
+			c, err := newCredentials(logr.Discard(), tt.name, config.HTTPClientConfig{AuthenticationConfig: tt.auth})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want("first"), server.authorizationOf(t, c))
+
+			// The secret is rotated.
+			assert.NoError(t, os.WriteFile(secretFile, []byte("second"), 0600))
+			assert.NoError(t, c.reload())
+			assert.Equal(t, tt.want("second"), server.authorizationOf(t, c))
+			assert.Equal(t, 1.0, testutil.ToFloat64(credentialsReloadSuccess.WithLabelValues(tt.name, tt.credential)))
+
+			// The previous secret is still used if the new one cannot be read.
+			assert.NoError(t, os.Remove(secretFile))
+			assert.Error(t, c.reload())
+			assert.Equal(t, tt.want("second"), server.authorizationOf(t, c))
+			assert.Equal(t, 0.0, testutil.ToFloat64(credentialsReloadSuccess.WithLabelValues(tt.name, tt.credential)))
+		})
+	}
+}
+
+func Test_credentials_reloadCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir := t.TempDir()
+	caFile, _ := writeCertificate(t, dir)
+
+	c, err := newCredentials(logr.Discard(), "es", config.HTTPClientConfig{TLSClientConfig: &config.TLSClientConfig{CAFile: caFile}})
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	_, err = c.RoundTrip(req)
+	assert.Error(t, err, "the certificate of the server must not be trusted")
+
+	// The CA bundle is updated with the certificate of the server.
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	assert.NoError(t, c.reload())
+	res, err := c.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_ = res.Body.Close()
+}
+
+func Test_credentials_certificate(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+	c, err := newCredentials(logr.Discard(), "es", config.HTTPClientConfig{
+		AuthenticationConfig: &config.AuthenticationConfig{CertFile: certFile, KeyFile: keyFile},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(c.transport.TLSClientConfig.Certificates))
+
+	assert.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+	assert.Error(t, c.reload())
+	assert.Equal(t, 1, len(c.transport.TLSClientConfig.Certificates), "the previous certificate must still be used")
+}
+
+func Test_credentials_watch(t *testing.T) {
+	server := newAuthorizationServer(t)
+	dir := t.TempDir()
+	apiKeyFile := filepath.Join(dir, "api-key")
+	assert.NoError(t, os.WriteFile(apiKeyFile, []byte("first"), 0600))
+	c, err := newCredentials(logr.Discard(), "es", config.HTTPClientConfig{
+		AuthenticationConfig: &config.AuthenticationConfig{APIKeyFile: apiKeyFile},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, c.watch())
+	defer c.Close()
+
+	// Secrets are updated by replacing the file.
+	tmp := filepath.Join(dir, "api-key.tmp")
+	assert.NoError(t, os.WriteFile(tmp, []byte("second"), 0600))
+	assert.NoError(t, os.Rename(tmp, apiKeyFile))
+	assert.Eventually(t, func() bool {
+		return server.authorizationOf(t, c) == "ApiKey second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// writeCertificate writes a self-signed certificate and its key in dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metrics-adapter"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
@@ -18,6 +18,7 @@
 package elasticsearch
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"os"
@@ -25,9 +26,15 @@ import (
 	"sort"
 	"testing"
 
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 )
 
@@ -91,7 +98,7 @@ metricServers:
 		t.Run(tt.name, func(t *testing.T) {
 			noopNamer, err := config.NewNamer(nil)
 			assert.NoError(t, err)
-			metricRecorder := newRecorder(noopNamer)
+			metricRecorder := newRecorder(noopNamer, allNamespaced)
 			metricRecorder.processMappingDocument(tt.args.mapping, tt.args.fields, tt.args.indices)
 			sortedResult := make([]string, 0, len(metricRecorder.metrics))
 			for metric := range metricRecorder.metrics {
@@ -103,6 +110,291 @@ metricServers:
 	}
 }
 
+func Test_recorder_processMappingDocument_labels(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - patterns: [ '^prometheus\.metrics\.' ]
+            labels: [ '^prometheus\.labels\.(.*)$' ]
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	var mapping interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+  "properties": {
+    "prometheus": {
+      "properties": {
+        "labels": {
+          "properties": {
+            "container": { "type": "keyword" },
+            "queue": { "type": "keyword" }
+          }
+        },
+        "metrics": {
+          "properties": {
+            "http_requests_in_flight": { "type": "double" }
+          }
+        }
+      }
+    }
+  }
+}`), &mapping))
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, allNamespaced)
+	metricRecorder.processMappingDocument(mapping, metricSet.Fields, metricSet.Indices)
+
+	metadata, ok := metricRecorder.indexedMetrics["prometheus.metrics.http_requests_in_flight"]
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{
+		"container": "prometheus.labels.container",
+		"queue":     "prometheus.labels.queue",
+	}, metadata.Labels)
+}
+
+func Test_recorder_processMappingDocument_counters(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - patterns: [ '^nginx\.stats\.requests$' ]
+            counter: true
+          - patterns: [ '^.*$' ]
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	var mapping interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+  "properties": {
+    "nginx": {
+      "properties": {
+        "stats": {
+          "properties": {
+            "active": { "type": "long", "time_series_metric": "gauge" },
+            "handled": { "type": "long", "time_series_metric": "counter" },
+            "requests": { "type": "long" }
+          }
+        }
+      }
+    }
+  }
+}`), &mapping))
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, allNamespaced)
+	metricRecorder.processMappingDocument(mapping, metricSet.Fields, metricSet.Indices)
+
+	for metric, wantCounter := range map[string]bool{
+		"nginx.stats.active":   false,
+		"nginx.stats.handled":  true,
+		"nginx.stats.requests": true,
+	} {
+		metadata, ok := metricRecorder.indexedMetrics[metric]
+		assert.True(t, ok, metric)
+		assert.Equal(t, wantCounter, metadata.Counter, metric)
+	}
+}
+
+func Test_recorder_processMappingDocument_timeSeries(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - patterns: [ '^memory\.' ]
+            aggregateMetric: avg
+          - patterns: [ '^.*$' ]
+            labels: [ '^labels\.(.*)$' ]
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	var mapping interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+  "properties": {
+    "container": { "type": "keyword", "time_series_dimension": true },
+    "labels": { "properties": { "app": { "type": "keyword", "time_series_dimension": true } } },
+    "cpu": {
+      "properties": {
+        "usage": { "type": "aggregate_metric_double", "metrics": [ "min", "max" ], "default_metric": "max", "time_series_metric": "gauge" },
+        "limit": { "type": "aggregate_metric_double", "metrics": [ "min" ], "default_metric": "min" },
+        "total": { "type": "long", "time_series_metric": "counter" }
+      }
+    },
+    "memory": {
+      "properties": {
+        "usage": { "type": "aggregate_metric_double", "metrics": [ "sum", "value_count" ], "default_metric": "sum", "time_series_metric": "gauge" },
+        "limit": { "type": "aggregate_metric_double", "metrics": [ "max" ], "default_metric": "max" }
+      }
+    },
+    "requests": { "type": "long" }
+  }
+}`), &mapping))
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, allNamespaced)
+	metricRecorder.timeSeries = true
+	metricRecorder.processMappingDocument(mapping, metricSet.Fields, metricSet.Indices)
+
+	type want struct {
+		timeSeries      bool
+		counter         bool
+		aggregateMetric string
+	}
+	for metric, want := range map[string]want{
+		"cpu.usage":    {timeSeries: true, aggregateMetric: "max"},
+		"cpu.limit":    {aggregateMetric: "min"},
+		"cpu.total":    {timeSeries: true, counter: true},
+		"memory.usage": {timeSeries: true, aggregateMetric: "avg"},
+		"requests":     {},
+	} {
+		metadata, ok := metricRecorder.indexedMetrics[metric]
+		assert.True(t, ok, metric)
+		assert.Equal(t, want.timeSeries, metadata.TimeSeries, metric)
+		assert.Equal(t, want.counter, metadata.Counter, metric)
+		assert.Equal(t, want.aggregateMetric, metadata.AggregateMetric, metric)
+	}
+	// avg cannot be computed without sum and value_count
+	_, ok := metricRecorder.indexedMetrics["memory.limit"]
+	assert.False(t, ok)
+	// dimensions can be used as labels, unless they already match a label pattern
+	assert.Equal(t,
+		map[string]string{"container": "container", "app": "labels.app"},
+		metricRecorder.indexedMetrics["requests"].Labels,
+	)
+}
+
+func Test_getMappingFor_standardIndices(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - patterns: [ '^nginx\.' ]
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	esClient, transport := newFakeClient(t, "")
+	// metrics-b is a standard index, even if its fields are mapped as time series metrics.
+	transport.responses = map[string]string{
+		"/metrics-*/_settings/index.mode": `{
+  ".ds-metrics-a-000001": { "settings": { "index.mode": "time_series" } },
+  "metrics-b": { "settings": {} }
+}`,
+		"/metrics-*/_mapping": `{
+  "metrics-b": {
+    "mappings": {
+      "properties": {
+        "nginx": {
+          "properties": {
+            "active": { "type": "long", "time_series_metric": "gauge" },
+            "handled": { "type": "long", "time_series_metric": "counter" }
+          }
+        }
+      }
+    }
+  }
+}`,
+	}
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, allNamespaced)
+	assert.NoError(t, getMappingFor(context.Background(), logr.Discard(), metricSet, esClient, metricRecorder))
+	assert.Equal(t, 2, len(transport.requests))
+
+	for metric, wantCounter := range map[string]bool{
+		"nginx.active":  false,
+		"nginx.handled": true,
+	} {
+		metadata, ok := metricRecorder.indexedMetrics[metric]
+		assert.True(t, ok, metric)
+		assert.False(t, metadata.TimeSeries, metric)
+		assert.False(t, metadata.useTimeSeries(), metric)
+		// counters are still detected, their rate is computed from the latest documents.
+		assert.Equal(t, wantCounter, metadata.Counter, metric)
+	}
+}
+
+func Test_recorder_processMappingDocument_resources(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    metricSets:
+      - indices: [ 'metricbeat-*' ]
+        fields:
+          - patterns: [ '^system\.cpu\.' ]
+            resources:
+              - field: kubernetes.pod.name
+                resource: pods
+              - field: kubernetes.node.name
+                resource: nodes
+          - patterns: [ '^kibana\.stats\.' ]
+            resources:
+              - field: service.name
+                group: kibana.k8s.elastic.co
+                resource: kibanas
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	var mapping interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+  "properties": {
+    "system": { "properties": { "cpu": { "properties": { "cores": { "type": "long" } } } } },
+    "kibana": { "properties": { "stats": { "properties": { "load": { "type": "double" } } } } }
+  }
+}`), &mapping))
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, func(groupResource schema.GroupResource) bool {
+		return groupResource.Resource != "nodes"
+	})
+	metricRecorder.processMappingDocument(mapping, metricSet.Fields, metricSet.Indices)
+
+	assert.ElementsMatch(t, []provider.CustomMetricInfo{
+		{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "system.cpu.cores"},
+		{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "system.cpu.cores"},
+	}, metricRecorder.metrics["system.cpu.cores"])
+	assert.ElementsMatch(t, []provider.CustomMetricInfo{
+		{GroupResource: schema.GroupResource{Group: "kibana.k8s.elastic.co", Resource: "kibanas"}, Namespaced: true, Metric: "kibana.stats.load"},
+	}, metricRecorder.metrics["kibana.stats.load"])
+
+	resource, ok := metricRecorder.indexedMetrics["system.cpu.cores"].resourceFor(schema.GroupResource{Resource: "nodes"})
+	assert.True(t, ok)
+	assert.Equal(t, "kubernetes.node.name", resource.Field)
+	_, ok = metricRecorder.indexedMetrics["kibana.stats.load"].resourceFor(schema.GroupResource{Resource: "pods"})
+	assert.False(t, ok)
+}
+
+func allNamespaced(schema.GroupResource) bool {
+	return true
+}
+
 func mustReadMapping(file string) interface{} {
 	f, err := os.Open(file)
 	if err != nil {
@@ -122,3 +414,38 @@ func mustReadMapping(file string) interface{} {
 	}
 	return mapping
 }
+
+func Test_recorder_metricInfos_scopes(t *testing.T) {
+	calls := 0
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, func(schema.GroupResource) bool {
+		calls++
+		return true
+	})
+	fields := config.Fields{Resources: []config.Resource{{Field: "kubernetes.pod.name", GroupResource: config.GroupResource{Resource: "pods"}}}}
+	for _, metric := range []string{"a", "b", "c"} {
+		infos := metricRecorder.metricInfos(metric, fields)
+		assert.Equal(t, 1, len(infos))
+		assert.True(t, infos[0].Namespaced)
+	}
+	assert.Equal(t, 1, calls, "the scope of a resource should only be read once per discovery")
+}
+
+func TestMetricsClient_isNamespaced(t *testing.T) {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, apimeta.RESTScopeRoot)
+	var logs []string
+	mc := &MetricsClient{
+		mapper: mapper,
+		logger: funcr.New(func(_, args string) { logs = append(logs, args) }, funcr.Options{}),
+	}
+	assert.True(t, mc.isNamespaced(schema.GroupResource{Resource: "pods"}))
+	assert.False(t, mc.isNamespaced(schema.GroupResource{Resource: "nodes"}))
+	assert.Empty(t, logs)
+	for i := 0; i < 3; i++ {
+		assert.True(t, mc.isNamespaced(schema.GroupResource{Group: "example.com", Resource: "unknowns"}))
+	}
+	assert.Equal(t, 1, len(logs), "an unknown resource should only be logged once")
+}
@@ -22,11 +22,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
-	"text/template"
 
 	"github.com/go-logr/logr"
-	"github.com/itchyny/gojq"
 
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
@@ -48,6 +47,9 @@ var allowedTypes = map[string]struct{}{
 	"unsigned_long": {},
 }
 
+// aggregateMetricDoubleType is the type of the metrics in downsampled indices.
+const aggregateMetricDoubleType = "aggregate_metric_double"
+
 func isTypeAllowed(t string) bool {
 	_, ok := allowedTypes[t]
 	return ok
@@ -58,53 +60,91 @@ type MetricMetadata struct {
 	Search          *config.Search
 	Indices         []string
 	MetricsProvider provider.MetricsProvider
+	// Labels maps the label names which can be used in a metric selector to the fields in the indices.
+	Labels map[string]string
+	// Counter is true if the metric is a monotonic counter, its value is then a per-second rate.
+	Counter bool
+	// TimeSeries is true if the metric is a time series metric and all the indices are in time series mode.
+	TimeSeries bool
+	// AggregateMetric is the sub-metric to be read if the metric is an aggregate_metric_double field.
+	AggregateMetric string
+}
+
+// fieldFor returns the field in which a label is stored. The label name is used as is if it has not been discovered.
+func (m MetricMetadata) fieldFor(label string) string {
+	if field, ok := m.Labels[label]; ok {
+		return field
+	}
+	return label
+}
+
+// resourceFor returns the resource configuration, and the field which holds the name of the objects, for a given resource.
+func (m MetricMetadata) resourceFor(groupResource schema.GroupResource) (config.Resource, bool) {
+	for _, resource := range m.Fields.GetResources() {
+		if resource.Group == groupResource.Group && resource.Resource == groupResource.Resource {
+			return resource, true
+		}
+	}
+	return config.Resource{}, false
+}
+
+// isNamespaced returns true if the resource is a namespaced one. Resources which are not known by the API server are
+// considered as namespaced, they are only logged the first time they are not found.
+func (mc *MetricsClient) isNamespaced(groupResource schema.GroupResource) bool {
+	gvk, err := mc.mapper.KindFor(groupResource.WithVersion(""))
+	if err != nil {
+		mc.unknownResource(groupResource, err, "Failed to get resource kind, assuming resource is namespaced")
+		return true
+	}
+	mapping, err := mc.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		mc.unknownResource(groupResource, err, "Failed to get resource mapping, assuming resource is namespaced")
+		return true
+	}
+	mc.unknownResources.Delete(groupResource)
+	return mapping.Scope.Name() == apimeta.RESTScopeNameNamespace
+}
+
+// unknownResource logs a resource which is not known by the API server, unless it has already been logged.
+func (mc *MetricsClient) unknownResource(groupResource schema.GroupResource, err error, msg string) {
+	if _, logged := mc.unknownResources.LoadOrStore(groupResource, struct{}{}); logged {
+		return
+	}
+	mc.logger.Error(err, msg, "resource", groupResource.String())
 }
 
 // discoverMetrics attempts to create a list of the available metrics and maintains an internal state.
-func (mc *MetricsClient) discoverMetrics() error {
+func (mc *MetricsClient) discoverMetrics(ctx context.Context) error {
 	namer, err := config.NewNamer(mc.GetConfiguration().Rename)
 	if err != nil {
 		return fmt.Errorf("%s: failed to create namer: %v", mc.GetConfiguration().Name, err)
 	}
-	metricRecorder := newRecorder(namer)
+	metricRecorder := newRecorder(namer, mc.isNamespaced)
 
 	// We first record static fields, they do not require to read the mapping
 	for _, metricSet := range mc.metricServerCfg.MetricSets {
 		for _, field := range metricSet.Fields {
 			if len(field.Name) > 0 {
 				search := field.Search
-				search.Template = template.Must(template.New("").Parse(search.Body))
-				metricResultQuery, err := gojq.Parse(search.MetricPath)
-				if err != nil {
-					return fmt.Errorf("error while parsing metricResultQuery for field %s: error: %v", field.Name, err)
-				}
-				search.MetricResultQuery = metricResultQuery
-				timestampResultQuery, err := gojq.Parse(search.TimestampPath)
-				if err != nil {
-					return fmt.Errorf("error while parsing timestampResultQuery for field %s: error: %v", field.Name, err)
-
+				if err := search.Compile(); err != nil {
+					return fmt.Errorf("error while compiling the search of field %s: %w", field.Name, err)
 				}
-				search.TimestampResultQuery = timestampResultQuery
 				// This is a static field, save the request body and the metric path
-				metricRecorder.indexedMetrics[field.Name] = MetricMetadata{
-					Search:  &search,
-					Indices: metricSet.Indices,
-				}
-				metricRecorder.metrics[field.Name] = provider.CustomMetricInfo{
-					GroupResource: schema.GroupResource{ // TODO: infer resource from configuration
-						Group:    "",
-						Resource: "pods",
-					},
-					Namespaced: true,
-					Metric:     field.Name,
-				}
+				metricRecorder.recordStatic(field, &search, metricSet.Indices)
 			}
 		}
 	}
 
 	for _, metricSet := range mc.metricServerCfg.MetricSets {
-		if err := getMappingFor(mc.logger, metricSet, mc.Client, metricRecorder); err != nil {
-			return err
+		switch metricSet.GetDiscovery() {
+		case config.FieldCapsDiscovery:
+			if err := getFieldCapsFor(ctx, mc.logger, metricSet, mc.Client, metricRecorder); err != nil {
+				return err
+			}
+		default:
+			if err := getMappingFor(ctx, mc.logger, metricSet, mc.Client, metricRecorder); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -113,12 +153,18 @@ func (mc *MetricsClient) discoverMetrics() error {
 	mc.metrics = metricRecorder.metrics
 	mc.indexedMetrics = metricRecorder.indexedMetrics
 	mc.namer = namer
+	mc.discovered = true
 	return nil
 }
 
-func getMappingFor(logger logr.Logger, metricSet config.MetricSet, esClient *esv8.Client, recorder *recorder) error {
+func getMappingFor(ctx context.Context, logger logr.Logger, metricSet config.MetricSet, esClient *esv8.Client, recorder *recorder) error {
+	timeSeries, err := isTimeSeriesMode(ctx, esClient, metricSet.Indices)
+	if err != nil {
+		return err
+	}
+	recorder.timeSeries = timeSeries
 	req := esapi.IndicesGetMappingRequest{Index: metricSet.Indices}
-	res, err := req.Do(context.Background(), esClient)
+	res, err := req.Do(ctx, esClient)
 	if err != nil {
 		return fmt.Errorf("discovery error, got response: %s", err)
 	}
@@ -162,18 +208,128 @@ func (r *recorder) processMappingDocument(mapping interface{}, fields config.Fie
 	r._processMappingDocument("", rpm, fields, indices)
 }
 
-func newRecorder(namer config.Namer) *recorder {
+func newRecorder(namer config.Namer, isNamespaced func(schema.GroupResource) bool) *recorder {
 	return &recorder{
-		metrics:        make(map[string]provider.CustomMetricInfo),
+		metrics:        make(map[string][]provider.CustomMetricInfo),
 		indexedMetrics: make(map[string]MetricMetadata),
+		labels:         make(map[string]map[string]string),
 		namer:          namer,
+		isNamespaced:   isNamespaced,
+		scopes:         make(map[schema.GroupResource]bool),
 	}
 }
 
 type recorder struct {
-	metrics        map[string]provider.CustomMetricInfo
+	// metrics holds, for each field, the metrics as they are exposed for each associated resource.
+	metrics        map[string][]provider.CustomMetricInfo
 	indexedMetrics map[string]MetricMetadata
-	namer          config.Namer
+	// labels holds the label fields discovered for a set of indices and label patterns.
+	labels       map[string]map[string]string
+	namer        config.Namer
+	isNamespaced func(schema.GroupResource) bool
+	// scopes caches the result of isNamespaced during the discovery.
+	scopes map[schema.GroupResource]bool
+	// timeSeries is true if the indices of the metric set being discovered are all in time series mode.
+	timeSeries bool
+}
+
+// namespaced returns true if the resource is a namespaced one, the API server is only asked once per discovery.
+func (r *recorder) namespaced(groupResource schema.GroupResource) bool {
+	namespaced, ok := r.scopes[groupResource]
+	if !ok {
+		namespaced = r.isNamespaced(groupResource)
+		r.scopes[groupResource] = namespaced
+	}
+	return namespaced
+}
+
+// metricInfos returns a metric info for each resource associated with the fields.
+func (r *recorder) metricInfos(metricName string, fields config.Fields) []provider.CustomMetricInfo {
+	resources := fields.GetResources()
+	infos := make([]provider.CustomMetricInfo, len(resources))
+	for i, resource := range resources {
+		groupResource := schema.GroupResource{
+			Group:    resource.Group,
+			Resource: resource.Resource,
+		}
+		infos[i] = provider.CustomMetricInfo{
+			GroupResource: groupResource,
+			Namespaced:    r.namespaced(groupResource),
+			Metric:        metricName,
+		}
+	}
+	return infos
+}
+
+// recordStatic records a static field and its search.
+func (r *recorder) recordStatic(field config.Fields, search *config.Search, indices []string) {
+	r.indexedMetrics[field.Name] = MetricMetadata{
+		Fields:  field,
+		Search:  search,
+		Indices: indices,
+		Labels:  r.labelsFor(indices, field),
+	}
+	r.metrics[field.Name] = r.metricInfos(field.Name, field)
+}
+
+// recordDimension records a time series dimension as a label, unless it already matches a label pattern.
+func (r *recorder) recordDimension(fieldName string, fieldsSet config.FieldsSet, indices []string) {
+	for _, fields := range fieldsSet {
+		if _, isLabel := fields.LabelName(fieldName); isLabel {
+			continue
+		}
+		r.labelsFor(indices, fields)[fieldName] = fieldName
+	}
+}
+
+// aggregateMetricFor returns the sub-metric to be read from an aggregate_metric_double field, or an empty string if the
+// sub-metric is not stored in the field.
+func aggregateMetricFor(mapping map[string]interface{}, configured string) string {
+	metrics := make(map[string]struct{})
+	if subMetrics, ok := mapping["metrics"].([]interface{}); ok {
+		for _, m := range subMetrics {
+			if name, ok := m.(string); ok {
+				metrics[name] = struct{}{}
+			}
+		}
+	}
+	subMetric := configured
+	if len(subMetric) == 0 {
+		subMetric, _ = mapping["default_metric"].(string)
+	}
+	if subMetric == "avg" {
+		_, hasSum := metrics["sum"]
+		_, hasCount := metrics["value_count"]
+		if hasSum && hasCount {
+			return subMetric
+		}
+		return ""
+	}
+	if _, ok := metrics[subMetric]; ok {
+		return subMetric
+	}
+	return ""
+}
+
+// labelsFor returns the label fields discovered for the given indices and fields. The returned map is shared by all the
+// metrics using the same label patterns, and it is updated while the mappings are processed.
+func (r *recorder) labelsFor(indices []string, fields config.Fields) map[string]string {
+	key := fmt.Sprintf("%s/%s", strings.Join(indices, ","), strings.Join(fields.Labels, ","))
+	labels, ok := r.labels[key]
+	if !ok {
+		labels = make(map[string]string)
+		r.labels[key] = labels
+	}
+	return labels
+}
+
+// recordLabel records a field as a label if it matches one of the label patterns.
+func (r *recorder) recordLabel(fieldName string, fieldsSet config.FieldsSet, indices []string) {
+	for _, fields := range fieldsSet {
+		if labelName, isLabel := fields.LabelName(fieldName); isLabel {
+			r.labelsFor(indices, fields)[labelName] = fieldName
+		}
+	}
 }
 
 func (r *recorder) _processMappingDocument(root string, d map[string]interface{}, fieldsSet config.FieldsSet, indices []string) {
@@ -202,36 +358,53 @@ func (r *recorder) _processMappingDocument(root string, d map[string]interface{}
 				}
 				r._processMappingDocument(newRoot, child, fieldsSet, indices)
 			} else {
-				// Ensure that we have a type
-				if t, hasType := child["type"]; !(hasType && isTypeAllowed(t.(string))) {
-					continue
-				}
-				metricName := ""
-				// New metric
+				fieldName := ""
 				if root == "" {
-					metricName = k
+					fieldName = k
 				} else {
-					metricName = fmt.Sprintf("%s.%s", root, k)
-				}
-
-				fields := fieldsSet.FindMetadata(metricName)
-				if fields == nil {
-					// field does not match a pattern, do not register it as available
-					continue
-				}
-				r.metrics[metricName] = provider.CustomMetricInfo{
-					GroupResource: schema.GroupResource{ // TODO: infer resource from configuration
-						Group:    "",
-						Resource: "pods",
-					},
-					Namespaced: true,
-					Metric:     r.namer.Register(metricName),
-				}
-				r.indexedMetrics[metricName] = MetricMetadata{
-					Fields:  *fields,
-					Indices: indices,
+					fieldName = fmt.Sprintf("%s.%s", root, k)
 				}
+				r.recordField(fieldName, child, fieldsSet, indices)
 			}
 		}
 	}
 }
+
+// recordField records a field given its mapping, as a label and/or as a metric.
+func (r *recorder) recordField(fieldName string, mapping map[string]interface{}, fieldsSet config.FieldsSet, indices []string) {
+	if _, hasType := mapping["type"]; hasType {
+		r.recordLabel(fieldName, fieldsSet, indices)
+	}
+	if mapping["time_series_dimension"] == true {
+		r.recordDimension(fieldName, fieldsSet, indices)
+	}
+	// Ensure that we have a type
+	fieldType, _ := mapping["type"].(string)
+	if !isTypeAllowed(fieldType) && fieldType != aggregateMetricDoubleType {
+		return
+	}
+	// New metric
+	metricName := fieldName
+
+	fields := fieldsSet.FindMetadata(metricName)
+	if fields == nil {
+		// field does not match a pattern, do not register it as available
+		return
+	}
+	var aggregateMetric string
+	if fieldType == aggregateMetricDoubleType {
+		if aggregateMetric = aggregateMetricFor(mapping, fields.AggregateMetric); len(aggregateMetric) == 0 {
+			// the sub-metric is not stored in the field
+			return
+		}
+	}
+	r.metrics[metricName] = r.metricInfos(r.namer.Register(metricName), *fields)
+	r.indexedMetrics[metricName] = MetricMetadata{
+		Fields:          *fields,
+		Indices:         indices,
+		Labels:          r.labelsFor(indices, *fields),
+		Counter:         fields.Counter || mapping["time_series_metric"] == "counter",
+		TimeSeries:      r.timeSeries && mapping["time_series_metric"] != nil,
+		AggregateMetric: aggregateMetric,
+	}
+}
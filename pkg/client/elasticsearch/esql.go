@@ -0,0 +1,205 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	esv8 "github.com/elastic/go-elasticsearch/v9"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
+)
+
+// invalidParamChars matches the characters which cannot be used in the name of an ES|QL parameter.
+var invalidParamChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// esqlRequest is the body of a request to the _query API.
+type esqlRequest struct {
+	Query  string                   `json:"query"`
+	Params []map[string]interface{} `json:"params,omitempty"`
+	Filter map[string]interface{}   `json:"filter,omitempty"`
+}
+
+// esqlRow is a row of an ES|QL result. Name is empty if the result does not have a name column.
+type esqlRow struct {
+	Name   string
+	Metric timestampedMetric
+}
+
+// esqlResult holds the rows of an ES|QL result.
+type esqlResult struct {
+	// HasNames is true if the result has a name column, i.e. one row per object.
+	HasNames bool
+	Rows     []esqlRow
+}
+
+// esqlParamsFor returns the ES|QL named parameters for a query: ?pod, ?namespace, ?objects, and one ?selector_<label>
+// parameter for each label of the selector used to list the objects, the characters which are not allowed in a
+// parameter name being replaced by "_".
+func esqlParamsFor(params customQueryParams) []map[string]interface{} {
+	result := []map[string]interface{}{
+		{"pod": params.Pod},
+		{"namespace": params.Namespace},
+	}
+	if len(params.Objects) > 0 {
+		result = append(result, map[string]interface{}{"objects": params.Objects})
+	}
+	selectors := make([]string, 0, len(params.PodSelectors))
+	for label := range params.PodSelectors {
+		selectors = append(selectors, label)
+	}
+	sort.Strings(selectors)
+	for _, label := range selectors {
+		name := "selector_" + invalidParamChars.ReplaceAllString(label, "_")
+		result = append(result, map[string]interface{}{name: params.PodSelectors[label]})
+	}
+	return result
+}
+
+// esqlRequestFor builds the request to run the ES|QL query of a static field. The metric selector is converted into a
+// Query DSL filter.
+func esqlRequestFor(metadata MetricMetadata, params customQueryParams, metricSelector labels.Selector) ([]byte, error) {
+	// Only the metric name and the environment can be used in the template, other values are passed as parameters.
+	query, err := executeTemplate(metadata.Search, customQueryParams{Metric: params.Metric, Env: params.Env})
+	if err != nil {
+		return nil, err
+	}
+	request := esqlRequest{
+		Query:  query,
+		Params: esqlParamsFor(params),
+	}
+	if f := selectorFilters(metricSelector, metadata.fieldFor); !f.isEmpty() {
+		boolQuery := make(map[string]interface{})
+		if len(f.Filter) > 0 {
+			boolQuery["filter"] = f.Filter
+		}
+		if len(f.MustNot) > 0 {
+			boolQuery["must_not"] = f.MustNot
+		}
+		request.Filter = map[string]interface{}{"bool": boolQuery}
+	}
+	return json.Marshal(request)
+}
+
+// getESQLResult runs the ES|QL query of a static field.
+func getESQLResult(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	params customQueryParams,
+	metricSelector labels.Selector,
+) (*esqlResult, error) {
+	defer tracing.Span(ctx)()
+	body, err := esqlRequestFor(metadata, params, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	res, err := esClient.EsqlQuery(
+		bytes.NewReader(body),
+		esClient.EsqlQuery.WithContext(*ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decodeResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	return readESQLResult(metadata.Search, r)
+}
+
+// readESQLResult reads the value, timestamp and name columns of an ES|QL response. Rows without a value are ignored.
+func readESQLResult(search *config.Search, r map[string]interface{}) (*esqlResult, error) {
+	columns, ok := r["columns"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert columns: %v", r["columns"])
+	}
+	valueColumn, timestampColumn, nameColumn := -1, -1, -1
+	for i, c := range columns {
+		column, ok := c.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert column: %v", c)
+		}
+		switch column["name"] {
+		case search.GetValueColumn():
+			valueColumn = i
+		case search.GetTimestampColumn():
+			timestampColumn = i
+		case search.GetNameColumn():
+			nameColumn = i
+		}
+	}
+	if valueColumn < 0 {
+		return nil, fmt.Errorf("no %s column in ES|QL result", search.GetValueColumn())
+	}
+	if timestampColumn < 0 {
+		return nil, fmt.Errorf("no %s column in ES|QL result", search.GetTimestampColumn())
+	}
+
+	values, ok := r["values"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot convert values: %v", r["values"])
+	}
+	result := &esqlResult{HasNames: nameColumn >= 0, Rows: make([]esqlRow, 0, len(values))}
+	for _, v := range values {
+		row, ok := v.([]interface{})
+		if !ok || len(row) != len(columns) {
+			return nil, fmt.Errorf("cannot convert row: %v", v)
+		}
+		if row[valueColumn] == nil {
+			continue
+		}
+		value, err := getFloat(row[valueColumn])
+		if err != nil {
+			return nil, err
+		}
+		timestamp, err := getTimestamp(row[timestampColumn])
+		if err != nil {
+			return nil, err
+		}
+		var name string
+		if result.HasNames {
+			if name, ok = row[nameColumn].(string); !ok {
+				return nil, fmt.Errorf("object name is not a string: %v", row[nameColumn])
+			}
+		}
+		result.Rows = append(result.Rows, esqlRow{
+			Name:   name,
+			Metric: timestampedMetric{Value: newQuantity(value), Timestamp: timestamp},
+		})
+	}
+	return result, nil
+}
+
+// metricFor returns the value of an object. If the result has a name column the row of the object is returned, otherwise
+// the first row.
+func (r *esqlResult) metricFor(name string) (timestampedMetric, bool) {
+	for _, row := range r.Rows {
+		if !r.HasNames || row.Name == name {
+			return row.Metric, true
+		}
+	}
+	return timestampedMetric{}, false
+}
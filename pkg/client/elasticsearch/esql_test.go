@@ -0,0 +1,147 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+func newESQLSearch(query string) *config.Search {
+	return &config.Search{
+		ESQL:     query,
+		Template: template.Must(template.New("").Parse(query)),
+	}
+}
+
+func Test_getMetricsForObjects_esql(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		response     string
+		wantRequests int
+		wantBody     string
+		wantResults  map[string]float64
+	}{
+		{
+			name: "one row per object",
+			query: `FROM metrics-* | WHERE kubernetes.namespace == ?namespace AND kubernetes.pod.name IN (?objects)` +
+				` | STATS value = AVG({{ .Metric }}), timestamp = MAX(@timestamp) BY name = kubernetes.pod.name`,
+			response: `{"columns":[{"name":"value","type":"double"},{"name":"timestamp","type":"date"},{"name":"name","type":"keyword"}],` +
+				`"values":[[1.5,"2023-04-03T09:20:48.000Z","pod-a"],[null,"2023-04-03T09:20:48.000Z","pod-b"],[3,"2023-04-03T09:20:48.000Z","pod-c"]]}`,
+			wantRequests: 1,
+			wantBody: `{"query":"FROM metrics-* | WHERE kubernetes.namespace == ?namespace AND kubernetes.pod.name IN (?objects)` +
+				` | STATS value = AVG(kibana.stats.load), timestamp = MAX(@timestamp) BY name = kubernetes.pod.name",` +
+				`"params":[{"pod":"pod-a"},{"namespace":"ns1"},{"objects":["pod-a","pod-b","pod-c"]},{"selector_app_kubernetes_io_name":"kibana"}],` +
+				`"filter":{"bool":{"filter":[{"term":{"container":"web"}}]}}}`,
+			wantResults: map[string]float64{"pod-a": 1.5, "pod-c": 3},
+		},
+		{
+			name:  "one query per object",
+			query: `FROM metrics-* | WHERE kubernetes.pod.name == ?pod | STATS value = MAX({{ .Metric }}), timestamp = MAX(@timestamp)`,
+			response: `{"columns":[{"name":"value","type":"double"},{"name":"timestamp","type":"date"}],` +
+				`"values":[[2,"2023-04-03T09:20:48.000Z"]]}`,
+			wantRequests: 3,
+			wantBody: `{"query":"FROM metrics-* | WHERE kubernetes.pod.name == ?pod | STATS value = MAX(kibana.stats.load), timestamp = MAX(@timestamp)",` +
+				`"params":[{"pod":"pod-a"},{"namespace":"ns1"},{"objects":["pod-a","pod-b","pod-c"]},{"selector_app_kubernetes_io_name":"kibana"}],` +
+				`"filter":{"bool":{"filter":[{"term":{"container":"web"}}]}}}`,
+			wantResults: map[string]float64{"pod-a": 2, "pod-b": 2, "pod-c": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			esClient, transport := newFakeClient(t, tt.response)
+			metadata := MetricMetadata{Search: newESQLSearch(tt.query)}
+			ctx := context.Background()
+			got, err := getMetricsForObjects(
+				&ctx, esClient, metadata, "ns1", []string{"pod-a", "pod-b", "pod-c"}, podMetric,
+				labels.SelectorFromSet(labels.Set{"container": "web"}),
+				labels.SelectorFromSet(labels.Set{"app.kubernetes.io/name": "kibana"}),
+			)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantRequests, len(transport.requests))
+			assert.Equal(t, "/_query", transport.requests[0].URL.Path)
+			assert.Equal(t, tt.wantBody, transport.bodies[0])
+			values := make(map[string]float64, len(got))
+			for name, value := range got {
+				values[name] = value.Value.AsApproximateFloat64()
+			}
+			assert.Equal(t, tt.wantResults, values)
+		})
+	}
+}
+
+func Test_readESQLResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		search   config.Search
+		response map[string]interface{}
+		want     *esqlResult
+		wantErr  string
+	}{
+		{
+			name:   "custom columns",
+			search: config.Search{ValueColumn: "load", TimestampColumn: "@timestamp"},
+			response: map[string]interface{}{
+				"columns": []interface{}{
+					map[string]interface{}{"name": "@timestamp", "type": "date"},
+					map[string]interface{}{"name": "load", "type": "double"},
+				},
+				"values": []interface{}{[]interface{}{"2023-04-03T09:20:48Z", 0.5}},
+			},
+			want: &esqlResult{Rows: []esqlRow{{Metric: timestampedMetric{
+				Value:     newQuantity(0.5),
+				Timestamp: mustTimestamp(t, "2023-04-03T09:20:48Z"),
+			}}}},
+		},
+		{
+			name: "missing value column",
+			response: map[string]interface{}{
+				"columns": []interface{}{map[string]interface{}{"name": "timestamp", "type": "date"}},
+				"values":  []interface{}{},
+			},
+			wantErr: "no value column in ES|QL result",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readESQLResult(&tt.search, tt.response)
+			if len(tt.wantErr) > 0 {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func mustTimestamp(t *testing.T, value string) metav1.Time {
+	t.Helper()
+	timestamp, err := getTimestamp(value)
+	assert.NoError(t, err)
+	return timestamp
+}
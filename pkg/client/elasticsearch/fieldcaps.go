@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	esv8 "github.com/elastic/go-elasticsearch/v9"
+	"github.com/elastic/go-elasticsearch/v9/esapi"
+	"github.com/go-logr/logr"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// labelTypes are the types, in addition to the metric ones, of the fields which are usually used as labels.
+var labelTypes = []string{"keyword", "constant_keyword", "wildcard", "ip", "boolean"}
+
+// downsampledMetrics are the sub-metrics stored by the downsampling of an index. The field capabilities API does not
+// return the sub-metrics of aggregate_metric_double fields, downsampled indices are assumed.
+var downsampledMetrics = []interface{}{"min", "max", "sum", "value_count"}
+
+const downsampledDefaultMetric = "max"
+
+// fieldCapsTypes returns the types of the fields requested to the field capabilities API.
+func fieldCapsTypes() []string {
+	types := make([]string, 0, len(allowedTypes)+len(labelTypes)+1)
+	for t := range allowedTypes {
+		types = append(types, t)
+	}
+	types = append(types, aggregateMetricDoubleType)
+	types = append(types, labelTypes...)
+	sort.Strings(types)
+	return types
+}
+
+// getFieldCapsFor discovers the fields of a metric set using the field capabilities API, which returns a single entry per
+// field for all the indices instead of the whole mapping of each index.
+func getFieldCapsFor(ctx context.Context, logger logr.Logger, metricSet config.MetricSet, esClient *esv8.Client, recorder *recorder) error {
+	timeSeries, err := isTimeSeriesMode(ctx, esClient, metricSet.Indices)
+	if err != nil {
+		return err
+	}
+	recorder.timeSeries = timeSeries
+	includeUnmapped := false
+	req := esapi.FieldCapsRequest{
+		Index:           metricSet.Indices,
+		Fields:          []string{"*"},
+		Types:           fieldCapsTypes(),
+		IncludeUnmapped: &includeUnmapped,
+	}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return fmt.Errorf("discovery error, got response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("[%s] Error getting field capabilities %v", res.Status(), metricSet.Indices)
+	}
+	var r map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("error parsing the response body: %s", err)
+	}
+	fields, ok := r["fields"].(map[string]interface{})
+	if !ok || len(fields) == 0 {
+		logger.Info("Field capabilities are empty", "index_pattern", strings.Join(metricSet.Indices, ","))
+		return nil
+	}
+	for _, warning := range recorder.processFieldCaps(fields, metricSet.Fields, metricSet.Indices) {
+		logger.Info("Discovery warning", "index_pattern", strings.Join(metricSet.Indices, ","), "warning", warning)
+	}
+	return nil
+}
+
+// processFieldCaps records the fields returned by the field capabilities API. Fields which have different types, or are
+// different kinds of time series metrics, across the indices are reported in the returned warnings. A field which
+// has several types is not recorded as a metric.
+func (r *recorder) processFieldCaps(fieldCaps map[string]interface{}, fieldsSet config.FieldsSet, indices []string) []string {
+	var warnings []string
+	// Sort the fields to get the same warnings, in the same order, on each discovery.
+	fieldNames := make([]string, 0, len(fieldCaps))
+	for fieldName := range fieldCaps {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		types, ok := fieldCaps[fieldName].(map[string]interface{})
+		if !ok || len(types) == 0 {
+			continue
+		}
+		if len(types) > 1 {
+			typeNames := make([]string, 0, len(types))
+			for typeName := range types {
+				typeNames = append(typeNames, typeName)
+			}
+			sort.Strings(typeNames)
+			warnings = append(warnings, fmt.Sprintf("field %s has conflicting types across indices: %s", fieldName, strings.Join(typeNames, ", ")))
+			// The field can still be used as a label.
+			r.recordLabel(fieldName, fieldsSet, indices)
+			continue
+		}
+		for _, c := range types {
+			capabilities, ok := c.(map[string]interface{})
+			if !ok || capabilities["metadata_field"] == true {
+				continue
+			}
+			if conflicts, ok := capabilities["metric_conflicts_in"].([]interface{}); ok && len(conflicts) > 0 {
+				warnings = append(warnings, fmt.Sprintf("field %s has conflicting time series metric types in indices: %v", fieldName, conflicts))
+			}
+			if capabilities["type"] == aggregateMetricDoubleType {
+				capabilities["metrics"] = downsampledMetrics
+				capabilities["default_metric"] = downsampledDefaultMetric
+			}
+			r.recordField(fieldName, capabilities, fieldsSet, indices)
+		}
+	}
+	return warnings
+}
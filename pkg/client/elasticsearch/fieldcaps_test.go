@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+const fieldCapsResponse = `{
+  "indices": [ ".ds-metrics-a-000001", ".ds-metrics-b-000001" ],
+  "fields": {
+    "_seq_no": { "_seq_no": { "type": "_seq_no", "metadata_field": true, "searchable": true, "aggregatable": true } },
+    "labels.queue": { "keyword": { "type": "keyword", "metadata_field": false, "searchable": true, "aggregatable": true } },
+    "container": { "keyword": { "type": "keyword", "metadata_field": false, "searchable": true, "aggregatable": true, "time_series_dimension": true } },
+    "nginx.stats.active": { "long": { "type": "long", "metadata_field": false, "searchable": true, "aggregatable": true, "time_series_metric": "gauge" } },
+    "nginx.stats.handled": { "long": { "type": "long", "metadata_field": false, "searchable": true, "aggregatable": true, "time_series_metric": "counter" } },
+    "nginx.stats.requests": {
+      "long": { "type": "long", "metadata_field": false, "searchable": true, "aggregatable": true, "indices": [ ".ds-metrics-a-000001" ] },
+      "keyword": { "type": "keyword", "metadata_field": false, "searchable": true, "aggregatable": true, "indices": [ ".ds-metrics-b-000001" ] }
+    },
+    "nginx.stats.dropped": { "long": { "type": "long", "metadata_field": false, "searchable": true, "aggregatable": true, "metric_conflicts_in": [ ".ds-metrics-a-000001", ".ds-metrics-b-000001" ] } },
+    "memory.usage": { "aggregate_metric_double": { "type": "aggregate_metric_double", "metadata_field": false, "searchable": true, "aggregatable": true, "time_series_metric": "gauge" } }
+  }
+}`
+
+func Test_getFieldCapsFor(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        discovery: fieldCaps
+        fields:
+          - patterns: [ '^.*$' ]
+            labels: [ '^labels\.(.*)$' ]
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	esClient, transport := newFakeClient(t, fieldCapsResponse)
+	transport.responses = map[string]string{
+		"/metrics-*/_settings/index.mode": `{
+  ".ds-metrics-a-000001": { "settings": { "index.mode": "time_series" } },
+  ".ds-metrics-b-000001": { "settings": { "index.mode": "time_series" } }
+}`,
+	}
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, allNamespaced)
+	assert.NoError(t, getFieldCapsFor(context.Background(), logr.Discard(), metricSet, esClient, metricRecorder))
+
+	assert.Equal(t, 2, len(transport.requests))
+	assert.Equal(t, "/metrics-*/_settings/index.mode", transport.requests[0].URL.Path)
+	assert.Equal(t, "true", transport.requests[0].URL.Query().Get("flat_settings"))
+	assert.Equal(t, "/metrics-*/_field_caps", transport.requests[1].URL.Path)
+	query := transport.requests[1].URL.Query()
+	assert.Equal(t, "*", query.Get("fields"))
+	assert.Equal(t, "false", query.Get("include_unmapped"))
+	assert.Equal(t,
+		"aggregate_metric_double,boolean,byte,constant_keyword,double,float,half_float,integer,ip,keyword,long,scaled_float,short,unsigned_long,wildcard",
+		query.Get("types"),
+	)
+
+	type want struct {
+		timeSeries      bool
+		counter         bool
+		aggregateMetric string
+	}
+	for metric, want := range map[string]want{
+		"nginx.stats.active":  {timeSeries: true},
+		"nginx.stats.handled": {timeSeries: true, counter: true},
+		"nginx.stats.dropped": {},
+		"memory.usage":        {timeSeries: true, aggregateMetric: "max"},
+	} {
+		metadata, ok := metricRecorder.indexedMetrics[metric]
+		assert.True(t, ok, metric)
+		assert.Equal(t, want.timeSeries, metadata.TimeSeries, metric)
+		assert.Equal(t, want.counter, metadata.Counter, metric)
+		assert.Equal(t, want.aggregateMetric, metadata.AggregateMetric, metric)
+	}
+	assert.Equal(t, 4, len(metricRecorder.indexedMetrics), "fields with conflicting types must not be recorded")
+	assert.Equal(t,
+		map[string]string{"container": "container", "queue": "labels.queue"},
+		metricRecorder.indexedMetrics["nginx.stats.active"].Labels,
+	)
+}
+
+func Test_recorder_processFieldCaps_warnings(t *testing.T) {
+	testConfig, err := config.From(
+		[]byte(`
+metricServers:
+  - name: k8s-region-observability-cluster
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        discovery: fieldCaps
+`),
+	)
+	assert.NoError(t, err)
+	metricSet := testConfig.MetricServers[0].MetricSets[0]
+	esClient, _ := newFakeClient(t, fieldCapsResponse)
+	r, err := esClient.FieldCaps()
+	assert.NoError(t, err)
+	response, err := decodeResponse(r)
+	assert.NoError(t, err)
+
+	noopNamer, err := config.NewNamer(nil)
+	assert.NoError(t, err)
+	metricRecorder := newRecorder(noopNamer, allNamespaced)
+	warnings := metricRecorder.processFieldCaps(response["fields"].(map[string]interface{}), metricSet.Fields, metricSet.Indices)
+	assert.Equal(t, []string{
+		"field nginx.stats.dropped has conflicting time series metric types in indices: [.ds-metrics-a-000001 .ds-metrics-b-000001]",
+		"field nginx.stats.requests has conflicting types across indices: keyword, long",
+	}, warnings)
+}
@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// filters holds the Elasticsearch clauses built from a label selector.
+type filters struct {
+	// Filter clauses the documents must match.
+	Filter []interface{}
+	// MustNot clauses the documents must not match.
+	MustNot []interface{}
+}
+
+func (f filters) isEmpty() bool {
+	return len(f.Filter) == 0 && len(f.MustNot) == 0
+}
+
+// selectorFilters converts a label selector into a set of Elasticsearch clauses. fieldFor returns the field in which a
+// label, as referenced in the selector, is stored.
+func selectorFilters(selector labels.Selector, fieldFor func(label string) string) filters {
+	var result filters
+	if selector == nil {
+		return result
+	}
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		field := fieldFor(requirement.Key())
+		values := requirement.Values().List()
+		switch requirement.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			result.Filter = append(result.Filter, term(field, values[0]))
+		case selection.In:
+			result.Filter = append(result.Filter, terms(field, values))
+		case selection.NotEquals:
+			result.MustNot = append(result.MustNot, term(field, values[0]))
+		case selection.NotIn:
+			result.MustNot = append(result.MustNot, terms(field, values))
+		case selection.Exists:
+			result.Filter = append(result.Filter, exists(field))
+		case selection.DoesNotExist:
+			result.MustNot = append(result.MustNot, exists(field))
+		case selection.GreaterThan:
+			result.Filter = append(result.Filter, rangeQuery(field, "gt", values[0]))
+		case selection.LessThan:
+			result.Filter = append(result.Filter, rangeQuery(field, "lt", values[0]))
+		}
+	}
+	return result
+}
+
+// withFilters adds the provided clauses to the query of a search body, the original query is kept as a "must" clause.
+func withFilters(body string, f filters) (string, error) {
+	if f.isEmpty() {
+		return body, nil
+	}
+	var search map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &search); err != nil {
+		return "", fmt.Errorf("failed to parse search body: %w", err)
+	}
+	if search == nil {
+		search = make(map[string]interface{})
+	}
+	boolQuery := make(map[string]interface{})
+	if originalQuery, hasQuery := search["query"]; hasQuery {
+		boolQuery["must"] = []interface{}{originalQuery}
+	}
+	if len(f.Filter) > 0 {
+		boolQuery["filter"] = f.Filter
+	}
+	if len(f.MustNot) > 0 {
+		boolQuery["must_not"] = f.MustNot
+	}
+	search["query"] = map[string]interface{}{"bool": boolQuery}
+	result, err := json.Marshal(search)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+func term(field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
+
+func terms(field string, values interface{}) map[string]interface{} {
+	return map[string]interface{}{"terms": map[string]interface{}{field: values}}
+}
+
+func exists(field string) map[string]interface{} {
+	return map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+}
+
+func rangeQuery(field, operator string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{operator: value}}}
+}
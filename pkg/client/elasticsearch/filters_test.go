@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func Test_withFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		selector string
+		fieldFor func(string) string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "no selector",
+			body:     `{ "query": { "match_all": {} } }`,
+			selector: "",
+			fieldFor: identity,
+			want:     `{ "query": { "match_all": {} } }`,
+		},
+		{
+			name:     "equality and set based requirements",
+			body:     `{"query":{"match_all":{}},"size":1}`,
+			selector: "service.name=foo,queue.name in (high,low),env!=dev,!deleted",
+			fieldFor: identity,
+			want: `{"query":{"bool":{` +
+				`"filter":[{"terms":{"queue.name":["high","low"]}},{"term":{"service.name":"foo"}}],` +
+				`"must":[{"match_all":{}}],` +
+				`"must_not":[{"exists":{"field":"deleted"}},{"term":{"env":"dev"}}]}},"size":1}`,
+		},
+		{
+			name:     "body without query",
+			body:     `{"size":0}`,
+			selector: "service.name=foo",
+			fieldFor: identity,
+			want:     `{"query":{"bool":{"filter":[{"term":{"service.name":"foo"}}]}},"size":0}`,
+		},
+		{
+			name:     "discovered labels",
+			body:     `{"query":{"match_all":{}}}`,
+			selector: "container=web,queue=high",
+			fieldFor: MetricMetadata{Labels: map[string]string{"container": "prometheus.labels.container"}}.fieldFor,
+			want: `{"query":{"bool":{` +
+				`"filter":[{"term":{"prometheus.labels.container":"web"}},{"term":{"queue":"high"}}],` +
+				`"must":[{"match_all":{}}]}}}`,
+		},
+		{
+			name:     "invalid body",
+			body:     `{"size":`,
+			selector: "service.name=foo",
+			fieldFor: identity,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := labels.Parse(tt.selector)
+			assert.NoError(t, err)
+			got, err := withFilters(tt.body, selectorFilters(selector, tt.fieldFor))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func identity(label string) string {
+	return label
+}
+
+func Test_selectorLabels(t *testing.T) {
+	selector, err := labels.Parse("service.name=foo,queue.name in (high),env in (dev,prod),!deleted")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"service.name": "foo", "queue.name": "high"}, selectorLabels(selector))
+	assert.Equal(t, map[string]string{}, selectorLabels(labels.Everything()))
+}
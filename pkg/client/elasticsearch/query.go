@@ -37,12 +37,24 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
 )
 
 type QueryParams struct {
 	Metric string
 	Name   types.NamespacedName
+	// Field holds the name of the object in the documents.
+	Field      string
+	Namespaced bool
+	// Identity holds the namespace and timestamp fields of the documents.
+	Identity config.Identity
+	// Aggregation, if set, is used to compute the value over a time window.
+	Aggregation *config.Aggregation
+	// Counter is true if the value is the per-second rate of a counter.
+	Counter bool
+	// Series are the fields which identify the series of a counter.
+	Series []string
 }
 
 var (
@@ -71,10 +83,82 @@ type customQueryParams struct {
 type timestampedMetric struct {
 	Value     resource.Quantity
 	Timestamp metav1.Time
+	// WindowSeconds is the length of the window used to compute the value, nil if the value is not aggregated.
+	WindowSeconds *int64
 }
 
-func queryFor(params QueryParams) string {
-	return fmt.Sprintf(query, params.Metric, params.Name.Namespace, params.Name.Name)
+// filtersFor returns the filters used to select the documents of an object.
+func filtersFor(params QueryParams) []interface{} {
+	filter := []interface{}{exists(params.Metric)}
+	if params.Namespaced {
+		filter = append(filter, term(params.Identity.GetNamespaceField(), params.Name.Namespace))
+	}
+	return append(filter, term(params.Field, params.Name.Name))
+}
+
+// queryFor returns the default query used to get the latest value of a metric for an object.
+func queryFor(params QueryParams) (string, error) {
+	filter := filtersFor(params)
+	if w := windowedFor(params.Metric, params.Identity, params.Aggregation, params.Counter, params.Series); w != nil {
+		return w.query(filter)
+	}
+	return latestDocumentQuery(filter, params.Identity.GetTimestampField())
+}
+
+// externalQueryFor returns the default query used to get the value of an external metric.
+func externalQueryFor(metric string, metadata MetricMetadata) (string, error) {
+	filter := []interface{}{exists(metric)}
+	if w := metadata.windowed(metric); w != nil {
+		return w.query(filter)
+	}
+	return latestDocumentQuery(filter, metadata.Fields.Identity.GetTimestampField())
+}
+
+// latestDocumentQuery returns a query for the most recent document matching all the filters.
+func latestDocumentQuery(filter []interface{}, timestampField string) (string, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filter,
+			},
+		},
+		"size": 1,
+		"sort": []interface{}{latestFirst(timestampField)},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(query), nil
+}
+
+// latestFirst sorts the documents from the most recent to the oldest one.
+func latestFirst(timestampField string) map[string]interface{} {
+	return map[string]interface{}{timestampField: map[string]interface{}{"order": "desc"}}
+}
+
+// podSelectorsFor returns the first value of each requirement in the selector used to list the objects.
+func podSelectorsFor(originalSelector labels.Selector) map[string]string {
+	podSelectors := make(map[string]string)
+	requirements, _ := originalSelector.Requirements()
+	for _, requirement := range requirements {
+		values := requirement.Values()
+		if len(values) == 0 {
+			continue
+		}
+		// Get first item in the selector
+		for selectorValue := range values {
+			podSelectors[requirement.Key()] = selectorValue
+		}
+	}
+	return podSelectors
+}
+
+func executeTemplate(search *config.Search, params customQueryParams) (string, error) {
+	tplBuffer := bytes.Buffer{}
+	if err := search.Template.Execute(&tplBuffer, params); err != nil {
+		return "", err
+	}
+	return tplBuffer.String(), nil
 }
 
 func getMetricForPod(
@@ -88,125 +172,287 @@ func getMetricForPod(
 	objects []string,
 ) (timestampedMetric, error) {
 	defer tracing.Span(ctx)()
+	if metadata.Search != nil && metadata.Search.IsESQL() {
+		result, err := getESQLResult(ctx, esClient, metadata, customQueryParams{
+			Metric:       info.Metric,
+			Pod:          name.Name,
+			PodSelectors: podSelectorsFor(originalSelector),
+			Namespace:    name.Namespace,
+			Objects:      objects,
+			Env:          Env,
+		}, metricSelector)
+		if err != nil {
+			return timestampedMetric{}, err
+		}
+		value, found := result.metricFor(name.Name)
+		if !found {
+			return timestampedMetric{}, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
+		}
+		return value, nil
+	}
+
 	var query string
 	if metadata.Search != nil {
 		// User specified a custom query
-		podSelectors := make(map[string]string)
-		requirements, _ := originalSelector.Requirements()
-		for _, requirement := range requirements {
-			values := requirement.Values()
-			if len(values) == 0 {
-				continue
-			}
-			// Get first item in the selector
-			for selectorValue := range values {
-				podSelectors[requirement.Key()] = selectorValue
-			}
-		}
-
-		tplBuffer := bytes.Buffer{}
-
-		if err := metadata.Search.Template.Execute(&tplBuffer, customQueryParams{
+		var err error
+		query, err = executeTemplate(metadata.Search, customQueryParams{
 			Metric:       info.Metric,
 			Pod:          name.Name,
-			PodSelectors: podSelectors,
+			PodSelectors: podSelectorsFor(originalSelector),
 			Namespace:    name.Namespace,
 			Objects:      objects,
 			Env:          Env,
-		}); err != nil {
+		})
+		if err != nil {
 			return timestampedMetric{}, err
 		}
-
-		query = tplBuffer.String()
 	} else {
-		query = queryFor(QueryParams{
-			Metric: info.Metric,
-			Name:   name,
+		resource, ok := metadata.resourceFor(info.GroupResource)
+		if !ok {
+			return timestampedMetric{}, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+		}
+		params := QueryParams{
+			Metric:      info.Metric,
+			Name:        name,
+			Field:       resource.Field,
+			Namespaced:  info.Namespaced,
+			Identity:    metadata.Fields.Identity,
+			Aggregation: metadata.Fields.Aggregation,
+			Counter:     metadata.Counter,
+			Series:      metadata.seriesFields(),
+		}
+		if metadata.useTimeSeries() {
+			results, err := getTimeSeriesMetrics(ctx, esClient, metadata, info.Metric, filtersFor(params), resource.Field, metricSelector)
+			if err != nil {
+				return timestampedMetric{}, err
+			}
+			value, found := results[name.Name]
+			if !found {
+				return timestampedMetric{}, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
+			}
+			return value, nil
+		}
+		var err error
+		query, err = queryFor(params)
+		if err != nil {
+			return timestampedMetric{}, err
+		}
+	}
+
+	// Only keep the documents matching the metric selector.
+	query, err := withFilters(query, selectorFilters(metricSelector, metadata.fieldFor))
+	if err != nil {
+		return timestampedMetric{}, err
+	}
+
+	r, err := doSearch(ctx, esClient, metadata, query)
+	if err != nil {
+		return timestampedMetric{}, err
+	}
+
+	if metadata.Search != nil {
+		return getSearchResult(metadata.Search, r)
+	}
+
+	if w := metadata.windowed(info.Metric); w != nil {
+		aggregations, _ := r["aggregations"].(map[string]interface{})
+		result, err := w.result(aggregations)
+		if err != nil {
+			return timestampedMetric{}, err
+		}
+		if result == nil {
+			return timestampedMetric{}, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
+		}
+		return *result, nil
+	}
+
+	// Get the result from the document.
+	metricDocument, err := getMetricDocument(info, name, metricSelector, r)
+	if err != nil {
+		return timestampedMetric{}, err
+	}
+	return getDocumentResult(ctx, info.Metric, metadata, metricDocument)
+}
+
+// getExternalMetric returns the value of an external metric, or nil if no document matches the selector.
+func getExternalMetric(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	metric string,
+	namespace string,
+	selector labels.Selector,
+) (*timestampedMetric, error) {
+	defer tracing.Span(ctx)()
+	if metadata.Search != nil && metadata.Search.IsESQL() {
+		result, err := getESQLResult(ctx, esClient, metadata, customQueryParams{
+			Metric:    metric,
+			Namespace: namespace,
+			Env:       Env,
+		}, selector)
+		if err != nil || len(result.Rows) == 0 {
+			return nil, err
+		}
+		return &result.Rows[0].Metric, nil
+	}
+
+	var query string
+	if metadata.Search != nil {
+		var err error
+		query, err = executeTemplate(metadata.Search, customQueryParams{
+			Metric:    metric,
+			Namespace: namespace,
+			Env:       Env,
 		})
+		if err != nil {
+			return nil, err
+		}
+	} else if metadata.useTimeSeries() {
+		results, err := getTimeSeriesMetrics(ctx, esClient, metadata, metric, []interface{}{exists(metric)}, "", selector)
+		if err != nil {
+			return nil, err
+		}
+		value, found := results[""]
+		if !found {
+			return nil, nil
+		}
+		return &value, nil
+	} else {
+		var err error
+		query, err = externalQueryFor(metric, metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query, err := withFilters(query, selectorFilters(selector, metadata.fieldFor))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := doSearch(ctx, esClient, metadata, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Search != nil {
+		result, err := getSearchResult(metadata.Search, r)
+		if err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+
+	if w := metadata.windowed(metric); w != nil {
+		aggregations, _ := r["aggregations"].(map[string]interface{})
+		return w.result(aggregations)
 	}
 
+	metricDocument, err := firstHit(r)
+	if err != nil || metricDocument == nil {
+		return nil, err
+	}
+	result, err := getDocumentResult(ctx, metric, metadata, metricDocument)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// doSearch runs a query and decodes the response.
+func doSearch(ctx *context.Context, esClient *esv8.Client, metadata MetricMetadata, query string) (map[string]interface{}, error) {
 	res, err := search(ctx, esClient, metadata, query)
 	if err != nil {
-		return timestampedMetric{}, err
+		return nil, err
 	}
+	return decodeResponse(res)
+}
+
+// decodeResponse decodes the body of a response, or returns the Elasticsearch error if the request failed.
+func decodeResponse(res *esapi.Response) (map[string]interface{}, error) {
 	defer res.Body.Close()
 
 	if res.IsError() {
 		bodyBytes, err := io.ReadAll(res.Body)
 		if err != nil {
-			return timestampedMetric{}, fmt.Errorf("[%s] failed to read search response body: %w", res.Status(), err)
+			return nil, fmt.Errorf("[%s] failed to read search response body: %w", res.Status(), err)
 		}
 		var errorResponse estypes.ElasticsearchError
 		if err := json.Unmarshal(bodyBytes, &errorResponse); err != nil {
-			return timestampedMetric{}, fmt.Errorf("[%s] failed to unmarshal search response '%s' with error %w", res.Status(), string(bodyBytes), err)
+			return nil, fmt.Errorf("[%s] failed to unmarshal search response '%s' with error %w", res.Status(), string(bodyBytes), err)
 		}
-		return timestampedMetric{}, errorResponse
+		return nil, errorResponse
 	}
 
 	var r map[string]interface{}
 	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		return timestampedMetric{}, fmt.Errorf("error parsing the response body: %s", err)
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
 	}
+	return r, nil
+}
 
+// getSearchResult evaluates the metric and timestamp paths of a custom search against its response.
+func getSearchResult(search *config.Search, r interface{}) (timestampedMetric, error) {
 	var value float64
 	var timestamp metav1.Time
-
-	if metadata.Search != nil {
-		iter := metadata.Search.MetricResultQuery.Run(r)
-		for {
-			v, ok := iter.Next()
-			if !ok {
-				break
-			}
-			if err, ok := v.(error); ok {
-				return timestampedMetric{}, err
-			}
-			if value, err = getFloat(v); err != nil {
-				return timestampedMetric{}, err
-			}
+	var err error
+	iter := search.MetricResultQuery.Run(r)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
 		}
-		iter = metadata.Search.TimestampResultQuery.Run(r)
-		for {
-			v, ok := iter.Next()
-			if !ok {
-				break
-			}
-			if err, ok := v.(error); ok {
-				return timestampedMetric{}, err
-			}
-			if timestamp, err = getTimestamp(v); err != nil {
-				return timestampedMetric{}, err
-			}
+		if err, ok := v.(error); ok {
+			return timestampedMetric{}, err
 		}
-	} else {
-		// Get the result from the document.
-		metricDocument, err := getMetricDocument(info, name, metricSelector, r)
-		if err != nil {
+		if value, err = getFloat(v); err != nil {
 			return timestampedMetric{}, err
 		}
-
-		if value, err = getMetricValue(ctx, "_source."+info.Metric, metricDocument); err != nil {
+	}
+	iter = search.TimestampResultQuery.Run(r)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := v.(error); ok {
 			return timestampedMetric{}, err
 		}
-
-		if timestamp, err = getTimestampFromDocument(ctx, "_source.@timestamp", metricDocument); err != nil {
+		if timestamp, err = getTimestamp(v); err != nil {
 			return timestampedMetric{}, err
 		}
 	}
+	return timestampedMetric{
+		Value:     newQuantity(value),
+		Timestamp: timestamp,
+	}, nil
+}
+
+// getDocumentResult reads the metric value and the timestamp from a document returned by the default query.
+func getDocumentResult(ctx *context.Context, metric string, metadata MetricMetadata, metricDocument map[string]interface{}) (timestampedMetric, error) {
+	value, err := getMetricValue(ctx, "_source."+metric, metricDocument, metadata.AggregateMetric)
+	if err != nil {
+		return timestampedMetric{}, err
+	}
 
-	var q *resource.Quantity
-	if math.IsNaN(value) {
-		q = resource.NewQuantity(0, resource.DecimalSI)
-	} else {
-		q = resource.NewMilliQuantity(int64(value*1000.0), resource.DecimalSI)
+	timestamp, err := getTimestampFromDocument(ctx, "_source."+metadata.Fields.Identity.GetTimestampField(), metricDocument)
+	if err != nil {
+		return timestampedMetric{}, err
 	}
 
 	return timestampedMetric{
-		Value:     *q,
+		Value:     newQuantity(value),
 		Timestamp: timestamp,
 	}, nil
 }
 
+func newQuantity(value float64) resource.Quantity {
+	if math.IsNaN(value) {
+		return *resource.NewQuantity(0, resource.DecimalSI)
+	}
+	return *resource.NewMilliQuantity(int64(value*1000.0), resource.DecimalSI)
+}
+
 func search(ctx *context.Context, esClient *esv8.Client, metadata MetricMetadata, query string) (*esapi.Response, error) {
 	defer tracing.Span(ctx)()
 	return esClient.Search(
@@ -236,26 +482,32 @@ func getValue(path string, doc map[string]interface{}) (interface{}, error) {
 	if !(len(segments) > 0) {
 		return 0, fmt.Errorf("no segment in path")
 	}
-	isLeaf := len(segments) == 1
 
-	root, segments := segments[0], segments[1:]
-	rootDoc, exists := doc[root]
-	if !exists {
-		keys := make([]string, 0, len(doc))
-		for k := range doc {
-			keys = append(keys, k)
+	// Keys may contain dots, for example OpenTelemetry attributes like "k8s.pod.name", try the longest keys first.
+	for i := len(segments); i > 0; i-- {
+		key := strings.Join(segments[:i], ".")
+		value, exists := doc[key]
+		if !exists {
+			continue
+		}
+		if i == len(segments) {
+			// Value is expected
+			return value, nil
 		}
-		return 0, fmt.Errorf("can't find leaf %s in [%s]", root, strings.Join(keys, ","))
+		if innerDoc, ok := value.(map[string]interface{}); ok {
+			if v, err := getValue(strings.Join(segments[i:], "."), innerDoc); err == nil {
+				return v, nil
+			}
+			continue
+		}
+		return 0, fmt.Errorf("not a document: %v", value)
 	}
 
-	if isLeaf {
-		// Value is expected
-		return rootDoc, nil
-	}
-	if innerDoc, ok := rootDoc.(map[string]interface{}); ok {
-		return getValue(strings.Join(segments, "."), innerDoc)
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
 	}
-	return 0, fmt.Errorf("not a document: %v", rootDoc)
+	return 0, fmt.Errorf("can't find leaf %s in [%s]", path, strings.Join(keys, ","))
 }
 
 func getTimestampFromDocument(ctx *context.Context, path string, doc map[string]interface{}) (metav1.Time, error) {
@@ -281,12 +533,17 @@ func getTimestamp(v interface{}) (metav1.Time, error) {
 	return metav1.Unix(0, 0), fmt.Errorf("not a string: %v", v)
 }
 
-func getMetricValue(ctx *context.Context, path string, doc map[string]interface{}) (float64, error) {
+// getMetricValue reads the value of a metric in a document. aggregateMetric is the sub-metric to be read if the value
+// is an aggregate_metric_double.
+func getMetricValue(ctx *context.Context, path string, doc map[string]interface{}, aggregateMetric string) (float64, error) {
 	defer tracing.Span(ctx)()
 	raw, err := getValue(path, doc)
 	if err != nil {
 		return 0, err
 	}
+	if len(aggregateMetric) > 0 {
+		return getAggregateMetricValue(raw, aggregateMetric)
+	}
 
 	switch v := raw.(type) {
 	case int:
@@ -305,9 +562,21 @@ func getMetricDocument(
 	metricSelector labels.Selector,
 	doc map[string]interface{},
 ) (map[string]interface{}, error) {
+	result, err := firstHit(doc)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
+	}
+	return result, nil
+}
+
+// firstHit returns the first document of a search response, or nil if there is no document in the response.
+func firstHit(doc map[string]interface{}) (map[string]interface{}, error) {
 	metaHits, ok := doc["hits"]
 	if !ok {
-		return nil, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
+		return nil, nil
 	}
 
 	hits, ok := metaHits.(map[string]interface{})
@@ -317,15 +586,14 @@ func getMetricDocument(
 
 	docs, ok := hits["hits"]
 	if !ok {
-		return nil, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
-
+		return nil, nil
 	}
 	documents, ok := docs.([]interface{})
 	if !ok {
 		return nil, fmt.Errorf("cannot convert docs: %v", docs)
 	}
 	if len(documents) == 0 {
-		return nil, provider.NewMetricNotFoundForSelectorError(info.GroupResource, info.Metric, name.Name, metricSelector)
+		return nil, nil
 	}
 
 	document := documents[0]
@@ -30,6 +30,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 )
 
 func Test_getMetricDocument(t *testing.T) {
@@ -134,3 +136,95 @@ func newStatusError(msg string) *apierr.StatusError {
 		Message: msg,
 	}}
 }
+
+func Test_queryFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		params QueryParams
+		want   string
+	}{
+		{
+			name: "default identity",
+			params: QueryParams{
+				Metric:     "kibana.stats.load",
+				Name:       types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+				Field:      "kubernetes.pod.name",
+				Namespaced: true,
+			},
+			want: `{"query":{"bool":{"filter":[{"exists":{"field":"kibana.stats.load"}},` +
+				`{"term":{"kubernetes.namespace":"ns1"}},{"term":{"kubernetes.pod.name":"pod1"}}]}},` +
+				`"size":1,"sort":[{"@timestamp":{"order":"desc"}}]}`,
+		},
+		{
+			name: "OpenTelemetry identity",
+			params: QueryParams{
+				Metric:     "metrics.k8s.pod.cpu.usage",
+				Name:       types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+				Field:      "resource.attributes.k8s.pod.name",
+				Namespaced: true,
+				Identity: config.Identity{
+					NamespaceField: "resource.attributes.k8s.namespace.name",
+					TimestampField: "observed_timestamp",
+				},
+			},
+			want: `{"query":{"bool":{"filter":[{"exists":{"field":"metrics.k8s.pod.cpu.usage"}},` +
+				`{"term":{"resource.attributes.k8s.namespace.name":"ns1"}},{"term":{"resource.attributes.k8s.pod.name":"pod1"}}]}},` +
+				`"size":1,"sort":[{"observed_timestamp":{"order":"desc"}}]}`,
+		},
+		{
+			name: "cluster scoped resource",
+			params: QueryParams{
+				Metric: "system.load.1",
+				Name:   types.NamespacedName{Name: "node1"},
+				Field:  "kubernetes.node.name",
+			},
+			want: `{"query":{"bool":{"filter":[{"exists":{"field":"system.load.1"}},{"term":{"kubernetes.node.name":"node1"}}]}},` +
+				`"size":1,"sort":[{"@timestamp":{"order":"desc"}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryFor(tt.params)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_getValue(t *testing.T) {
+	doc := map[string]interface{}{
+		"@timestamp": "2023-04-03T09:20:48Z",
+		"kibana": map[string]interface{}{
+			"stats": map[string]interface{}{"load": 1.5},
+		},
+		"metrics": map[string]interface{}{
+			"k8s.pod.cpu.usage": 0.25,
+		},
+		"resource": map[string]interface{}{
+			"attributes": map[string]interface{}{"k8s.pod.name": "pod1"},
+		},
+	}
+	tests := []struct {
+		path    string
+		want    interface{}
+		wantErr bool
+	}{
+		{path: "@timestamp", want: "2023-04-03T09:20:48Z"},
+		{path: "kibana.stats.load", want: 1.5},
+		{path: "metrics.k8s.pod.cpu.usage", want: 0.25},
+		{path: "resource.attributes.k8s.pod.name", want: "pod1"},
+		{path: "kibana.stats.missing", wantErr: true},
+		{path: "@timestamp.value", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := getValue(tt.path, doc)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/elastic-transport-go/v8/elastictransport"
+	"github.com/go-logr/logr"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// retryableStatus are the status codes returned when a search can be retried later. 502 is not included since the
+// request is immediately sent to another node by the Elasticsearch transport.
+var retryableStatus = map[int]struct{}{
+	http.StatusTooManyRequests:    {},
+	http.StatusServiceUnavailable: {},
+	http.StatusGatewayTimeout:     {},
+}
+
+// searchEndpoints are the endpoints which only read data, requests sent with POST to them can be retried.
+var searchEndpoints = []string{"_search", "_msearch", "_query", "_field_caps"}
+
+// resilientTransport retries the idempotent requests with an exponential backoff, and sends the requests through the
+// circuit breaker of the metric server. It wraps the Elasticsearch transport, the requests which fail on a node are
+// first sent to the other nodes.
+type resilientTransport struct {
+	logger  logr.Logger
+	client  string
+	next    elastictransport.Interface
+	policy  *config.RetryPolicy
+	breaker *client.CircuitBreaker
+
+	// sleep waits for the given duration, it returns early with an error if the context is done.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newResilientTransport(
+	logger logr.Logger,
+	metricServerCfg config.MetricServer,
+	next elastictransport.Interface,
+	breaker *client.CircuitBreaker,
+) *resilientTransport {
+	return &resilientTransport{
+		logger:  logger,
+		client:  metricServerCfg.Name,
+		next:    next,
+		policy:  metricServerCfg.Retry,
+		breaker: breaker,
+		sleep:   sleep,
+	}
+}
+
+var (
+	_ elastictransport.Interface    = &resilientTransport{}
+	_ elastictransport.Measurable   = &resilientTransport{}
+	_ elastictransport.Discoverable = &resilientTransport{}
+)
+
+// Perform sends a request, retrying it if it is idempotent and the server is overloaded or unavailable.
+func (t *resilientTransport) Perform(req *http.Request) (*http.Response, error) {
+	maxAttempts := 1
+	if isIdempotent(req) {
+		maxAttempts = t.policy.GetMaxAttempts()
+	}
+	if maxAttempts > 1 && req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body must be sent again for each attempt.
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+		}
+	}
+
+	backoff := t.policy.GetInitialBackoff()
+	for attempt := 1; ; attempt++ {
+		res, err := t.performOnce(req, attempt)
+		if attempt >= maxAttempts || !shouldRetry(req.Context(), res, err) {
+			return res, err
+		}
+		delay := jitter(backoff)
+		if retryAfter, ok := getRetryAfter(res); ok {
+			if retryAfter > t.policy.GetMaxBackoff() {
+				// The server is not expected to recover soon enough.
+				return res, err
+			}
+			delay = retryAfter
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+		t.logger.V(1).Info("Retrying request", "client", t.client, "path", req.URL.Path, "attempt", attempt, "delay", delay, "error", err)
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		backoff = min(2*backoff, t.policy.GetMaxBackoff())
+	}
+}
+
+// performOnce sends a copy of the request through the circuit breaker, the Elasticsearch transport updates the request.
+func (t *resilientTransport) performOnce(req *http.Request, attempt int) (*http.Response, error) {
+	if err := t.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	attemptReq := req
+	if attempt > 1 || req.GetBody != nil {
+		attemptReq = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+	res, err := t.next.Perform(attemptReq)
+	t.breaker.RecordResult(req.Context(), res, err)
+	return res, err
+}
+
+// Metrics returns the metrics of the Elasticsearch transport.
+func (t *resilientTransport) Metrics() (elastictransport.Metrics, error) {
+	if measurable, ok := t.next.(elastictransport.Measurable); ok {
+		return measurable.Metrics()
+	}
+	return elastictransport.Metrics{}, errors.New("transport is missing method Metrics()")
+}
+
+// DiscoverNodes updates the nodes of the Elasticsearch transport.
+func (t *resilientTransport) DiscoverNodes() error {
+	if discoverable, ok := t.next.(elastictransport.Discoverable); ok {
+		return discoverable.DiscoverNodes()
+	}
+	return errors.New("transport is missing method DiscoverNodes()")
+}
+
+// Close closes the Elasticsearch transport, in-flight requests are awaited until the context is done.
+func (t *resilientTransport) Close(ctx context.Context) error {
+	if closeable, ok := t.next.(elastictransport.Closeable); ok {
+		return closeable.Close(ctx)
+	}
+	return nil
+}
+
+// isIdempotent returns true if sending the request several times has the same effect as sending it once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		for _, endpoint := range searchEndpoints {
+			if strings.HasSuffix(req.URL.Path, "/"+endpoint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shouldRetry returns true if the server is overloaded or unavailable, and the request has not been cancelled.
+func shouldRetry(ctx context.Context, res *http.Response, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, client.ErrCircuitOpen) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	_, retryable := retryableStatus[res.StatusCode]
+	return retryable
+}
+
+// getRetryAfter returns the delay requested by the server in the Retry-After header, either in seconds or as a date.
+func getRetryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+	retryAfter := res.Header.Get("Retry-After")
+	if len(retryAfter) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// jitter returns a random delay between half and the whole backoff, so clients do not retry at the same time.
+func jitter(backoff time.Duration) time.Duration {
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,232 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// scriptedTransport returns the responses in order, a response with a zero status code is a network error.
+type scriptedTransport struct {
+	responses []scriptedResponse
+	bodies    []string
+}
+
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+}
+
+func (s *scriptedTransport) Perform(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.bodies = append(s.bodies, string(body))
+	response := s.responses[len(s.bodies)-1]
+	if response.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	header := http.Header{}
+	if len(response.retryAfter) > 0 {
+		header.Set("Retry-After", response.retryAfter)
+	}
+	return &http.Response{StatusCode: response.status, Header: header, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func Test_resilientTransport_Perform(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		responses    []scriptedResponse
+		wantAttempts int
+		wantDelays   []time.Duration
+		wantStatus   int
+		wantErr      bool
+	}{
+		{
+			name:         "search is retried until it succeeds",
+			method:       http.MethodPost,
+			path:         "/metrics-*/_search",
+			responses:    []scriptedResponse{{status: 503}, {status: 0}, {status: 200}},
+			wantAttempts: 3,
+			wantDelays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+			wantStatus:   200,
+		},
+		{
+			name:         "last response is returned once all the attempts failed",
+			method:       http.MethodPost,
+			path:         "/metrics-*/_msearch",
+			responses:    []scriptedResponse{{status: 429}, {status: 429}, {status: 429}},
+			wantAttempts: 3,
+			wantDelays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+			wantStatus:   429,
+		},
+		{
+			name:         "Retry-After is respected",
+			method:       http.MethodPost,
+			path:         "/_query",
+			responses:    []scriptedResponse{{status: 429, retryAfter: "2"}, {status: 200}},
+			wantAttempts: 2,
+			wantDelays:   []time.Duration{2 * time.Second},
+			wantStatus:   200,
+		},
+		{
+			name:         "Retry-After greater than the max backoff",
+			method:       http.MethodPost,
+			path:         "/metrics-*/_search",
+			responses:    []scriptedResponse{{status: 503, retryAfter: "60"}},
+			wantAttempts: 1,
+			wantStatus:   503,
+		},
+		{
+			name:         "client errors are not retried",
+			method:       http.MethodPost,
+			path:         "/metrics-*/_search",
+			responses:    []scriptedResponse{{status: 400}},
+			wantAttempts: 1,
+			wantStatus:   400,
+		},
+		{
+			name:         "requests which are not idempotent are not retried",
+			method:       http.MethodPost,
+			path:         "/metrics-*/_doc",
+			responses:    []scriptedResponse{{status: 503}},
+			wantAttempts: 1,
+			wantStatus:   503,
+		},
+		{
+			name:         "network errors are returned",
+			method:       http.MethodGet,
+			path:         "/_mapping",
+			responses:    []scriptedResponse{{status: 0}, {status: 0}, {status: 0}},
+			wantAttempts: 3,
+			wantDelays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &scriptedTransport{responses: tt.responses}
+			transport := newResilientTransport(logr.Discard(), config.MetricServer{Name: "es"}, next, nil)
+			var delays []time.Duration
+			transport.sleep = func(_ context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+			req, err := http.NewRequest(tt.method, tt.path, io.NopCloser(strings.NewReader(`{"size":0}`)))
+			assert.NoError(t, err)
+			res, err := transport.Perform(req)
+			assert.Equal(t, tt.wantAttempts, len(next.bodies))
+			for _, body := range next.bodies {
+				assert.Equal(t, `{"size":0}`, body, "body must be sent with each attempt")
+			}
+			assert.Equal(t, len(tt.wantDelays), len(delays))
+			for i, delay := range delays {
+				// The jitter delays the retries by half to the whole backoff.
+				if tt.wantDelays[i] >= time.Second {
+					assert.Equal(t, tt.wantDelays[i], delay)
+					continue
+				}
+				assert.LessOrEqual(t, tt.wantDelays[i]/2, delay)
+				assert.GreaterOrEqual(t, tt.wantDelays[i], delay)
+			}
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+		})
+	}
+}
+
+func Test_resilientTransport_cancelled(t *testing.T) {
+	next := &scriptedTransport{responses: []scriptedResponse{{status: 503}, {status: 200}}}
+	transport := newResilientTransport(logr.Discard(), config.MetricServer{Name: "es"}, next, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/metrics-*/_search", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	res, err := transport.Perform(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 503, res.StatusCode, "request must not be retried once the context is done")
+	assert.Equal(t, 1, len(next.bodies))
+}
+
+func Test_resilientTransport_circuitBreaker(t *testing.T) {
+	next := &scriptedTransport{responses: []scriptedResponse{{status: 503}, {status: 503}, {status: 200}}}
+	metricServer := config.MetricServer{
+		Name:           "es",
+		Retry:          &config.RetryPolicy{MaxAttempts: 5},
+		CircuitBreaker: &config.CircuitBreaker{FailureThreshold: 2},
+	}
+	breaker := client.NewCircuitBreaker(metricServer)
+	transport := newResilientTransport(logr.Discard(), metricServer, next, breaker)
+	transport.sleep = func(context.Context, time.Duration) error { return nil }
+
+	req, err := http.NewRequest(http.MethodPost, "/metrics-*/_search", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	_, err = transport.Perform(req)
+	assert.ErrorIs(t, err, client.ErrCircuitOpen)
+	assert.Equal(t, 2, len(next.bodies), "retries must stop once the circuit is open")
+	assert.Equal(t, client.BreakerOpen, breaker.State())
+
+	// Requests fail fast while the circuit is open.
+	_, err = transport.Perform(req)
+	assert.ErrorIs(t, err, client.ErrCircuitOpen)
+	assert.Equal(t, 2, len(next.bodies))
+}
+
+func Test_getRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+		wantOk     bool
+	}{
+		{name: "no header"},
+		{name: "seconds", retryAfter: "3", want: 3 * time.Second, wantOk: true},
+		{name: "past date", retryAfter: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0, wantOk: true},
+		{name: "invalid", retryAfter: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{Header: http.Header{}}
+			if len(tt.retryAfter) > 0 {
+				res.Header.Set("Retry-After", tt.retryAfter)
+			}
+			got, ok := getRetryAfter(res)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
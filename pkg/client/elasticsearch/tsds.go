@@ -0,0 +1,263 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	esv8 "github.com/elastic/go-elasticsearch/v9"
+	"github.com/elastic/go-elasticsearch/v9/esapi"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
+)
+
+const (
+	timeSeriesAggregation = "series"
+	timeSeriesIndexMode   = "time_series"
+)
+
+// isTimeSeriesMode returns true if all the indices matching the patterns are in time series mode. Fields can be
+// time series metrics in the mappings of standard indices, on which the time_series aggregation cannot be used.
+func isTimeSeriesMode(ctx context.Context, esClient *esv8.Client, indices []string) (bool, error) {
+	flatSettings := true
+	req := esapi.IndicesGetSettingsRequest{Index: indices, Name: []string{"index.mode"}, FlatSettings: &flatSettings}
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return false, fmt.Errorf("discovery error, got response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return false, fmt.Errorf("[%s] Error getting index settings %v", res.Status(), indices)
+	}
+	var r map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return false, fmt.Errorf("error parsing the response body: %s", err)
+	}
+	if len(r) == 0 {
+		return false, nil
+	}
+	for _, index := range r {
+		if index.Settings["index.mode"] != timeSeriesIndexMode {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// useTimeSeries returns true if the value of the metric is computed for each time series, using the time_series
+// aggregation: the latest value of a gauge, or the rate of a counter. The values of the time series of an object are then
+// added. Other aggregations are computed over all the documents.
+func (m MetricMetadata) useTimeSeries() bool {
+	return m.TimeSeries && (m.Counter || m.Fields.Aggregation == nil)
+}
+
+// timeSeriesWindow returns the window in which the samples of the time series are searched.
+func (m MetricMetadata) timeSeriesWindow(metric string) *windowed {
+	return &windowed{
+		metric:      metric,
+		identity:    m.Fields.Identity,
+		aggregation: m.Fields.Aggregation,
+		counter:     m.Counter,
+	}
+}
+
+// timeSeriesQueryFor returns a query which gets the samples of each time series of a metric in the window. nameField,
+// if not empty, is the field which holds the name of the objects.
+func timeSeriesQueryFor(filter []interface{}, metric string, metadata MetricMetadata, nameField string) (string, error) {
+	w := metadata.timeSeriesWindow(metric)
+	samples := 1
+	if w.counter {
+		samples = maxRateSamples
+	}
+	includes := []string{metric, w.identity.GetTimestampField()}
+	if len(nameField) > 0 {
+		includes = append(includes, nameField)
+	}
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": append(filter, w.filter()),
+			},
+		},
+		"size": 0,
+		"aggs": map[string]interface{}{
+			timeSeriesAggregation: map[string]interface{}{
+				"time_series": map[string]interface{}{
+					"keyed": false,
+				},
+				"aggs": map[string]interface{}{
+					samplesAggregation: map[string]interface{}{
+						"top_hits": map[string]interface{}{
+							"size":    samples,
+							"sort":    []interface{}{latestFirst(w.identity.GetTimestampField())},
+							"_source": map[string]interface{}{"includes": includes},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(query), nil
+}
+
+// getTimeSeriesMetrics gets the value of a metric for each object, by adding the values of the time series of each
+// object. If nameField is empty all the time series are added, and the result is stored with an empty name.
+func getTimeSeriesMetrics(
+	ctx *context.Context,
+	esClient *esv8.Client,
+	metadata MetricMetadata,
+	metric string,
+	filter []interface{},
+	nameField string,
+	metricSelector labels.Selector,
+) (map[string]timestampedMetric, error) {
+	defer tracing.Span(ctx)()
+	query, err := timeSeriesQueryFor(filter, metric, metadata, nameField)
+	if err != nil {
+		return nil, err
+	}
+	query, err = withFilters(query, selectorFilters(metricSelector, metadata.fieldFor))
+	if err != nil {
+		return nil, err
+	}
+	r, err := doSearch(ctx, esClient, metadata, query)
+	if err != nil {
+		return nil, err
+	}
+	return getTimeSeriesResults(ctx, r, metric, metadata, nameField)
+}
+
+// getTimeSeriesResults reads the response of a query built by timeSeriesQueryFor.
+func getTimeSeriesResults(
+	ctx *context.Context,
+	r map[string]interface{},
+	metric string,
+	metadata MetricMetadata,
+	nameField string,
+) (map[string]timestampedMetric, error) {
+	buckets, err := getBuckets(r, timeSeriesAggregation)
+	if err != nil {
+		return nil, err
+	}
+	w := metadata.timeSeriesWindow(metric)
+
+	sums := make(map[string]*seriesSum)
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert bucket: %v", b)
+		}
+		samples, ok := bucket[samplesAggregation].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert samples: %v", bucket[samplesAggregation])
+		}
+		hits, ok := samples["hits"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert hits: %v", samples["hits"])
+		}
+		documents, ok := hits["hits"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert docs: %v", hits["hits"])
+		}
+		if len(documents) == 0 {
+			continue
+		}
+		latest, ok := documents[0].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot convert document: %v", documents[0])
+		}
+
+		var name string
+		if len(nameField) > 0 {
+			v, err := getValue("_source."+nameField, latest)
+			if err != nil {
+				return nil, err
+			}
+			if name, ok = v.(string); !ok {
+				return nil, fmt.Errorf("object name is not a string: %v", v)
+			}
+		}
+
+		var value *timestampedMetric
+		if w.counter {
+			if value, err = w.rateOf(documents); err != nil {
+				return nil, err
+			}
+			if value == nil {
+				// Not enough samples to compute the rate of this time series.
+				continue
+			}
+		} else {
+			result, err := getDocumentResult(ctx, metric, metadata, latest)
+			if err != nil {
+				return nil, err
+			}
+			value = &result
+		}
+
+		s, exists := sums[name]
+		if !exists {
+			s = &seriesSum{}
+			sums[name] = s
+		}
+		s.add(*value)
+	}
+
+	result := make(map[string]timestampedMetric, len(sums))
+	for name, s := range sums {
+		value := s.result()
+		if w.counter && value.WindowSeconds == nil {
+			windowSeconds := w.windowSeconds()
+			value.WindowSeconds = &windowSeconds
+		}
+		result[name] = *value
+	}
+	return result, nil
+}
+
+// getAggregateMetricValue reads a sub-metric of an aggregate_metric_double value, avg is computed from sum and value_count.
+func getAggregateMetricValue(raw interface{}, subMetric string) (float64, error) {
+	value, ok := raw.(map[string]interface{})
+	if !ok {
+		// Documents which have not been downsampled store a single value.
+		return getFloat(raw)
+	}
+	if subMetric != "avg" {
+		return getFloat(value[subMetric])
+	}
+	sum, err := getFloat(value["sum"])
+	if err != nil {
+		return 0, err
+	}
+	count, err := getFloat(value["value_count"])
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no value in aggregate metric: %v", raw)
+	}
+	return sum / count, nil
+}
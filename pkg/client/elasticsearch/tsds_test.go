@@ -0,0 +1,120 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func Test_getTimeSeriesMetrics(t *testing.T) {
+	series := func(pod, container string, samples ...string) string {
+		hits := ""
+		for i, sample := range samples {
+			if i > 0 {
+				hits += ","
+			}
+			hits += `{"_source":{"kubernetes":{"pod":{"name":"` + pod + `"}},` + sample + `}}`
+		}
+		return `{"key":{"kubernetes.pod.name":"` + pod + `","container":"` + container + `"},"samples":{"hits":{"hits":[` + hits + `]}}}`
+	}
+	tests := []struct {
+		name        string
+		metadata    MetricMetadata
+		response    string
+		wantBody    string
+		wantResults map[string]float64
+		wantWindow  bool
+	}{
+		{
+			name:     "gauge",
+			metadata: MetricMetadata{TimeSeries: true, Indices: []string{"metrics-*"}},
+			response: `{"aggregations":{"series":{"buckets":[` +
+				series("pod-a", "web", `"memory":{"usage":10},"@timestamp":"2023-04-03T09:20:48Z"`) + `,` +
+				series("pod-a", "sidecar", `"memory":{"usage":5},"@timestamp":"2023-04-03T09:20:40Z"`) + `,` +
+				series("pod-b", "web", `"memory":{"usage":7},"@timestamp":"2023-04-03T09:20:48Z"`) +
+				`]}}}`,
+			wantBody: `{"aggs":{"series":{"aggs":{"samples":{"top_hits":{"_source":{"includes":["memory.usage","@timestamp","kubernetes.pod.name"]},` +
+				`"size":1,"sort":[{"@timestamp":{"order":"desc"}}]}}},"time_series":{"keyed":false}}},` +
+				`"query":{"bool":{"filter":[{"exists":{"field":"memory.usage"}},{"terms":{"kubernetes.pod.name":["pod-a","pod-b"]}},` +
+				`{"term":{"kubernetes.namespace":"ns1"}},{"range":{"@timestamp":{"gte":"now-300s"}}}]}},"size":0}`,
+			wantResults: map[string]float64{"pod-a": 15, "pod-b": 7},
+		},
+		{
+			name:     "downsampled gauge",
+			metadata: MetricMetadata{TimeSeries: true, AggregateMetric: "avg", Indices: []string{"metrics-*"}},
+			response: `{"aggregations":{"series":{"buckets":[` +
+				series("pod-a", "web", `"memory":{"usage":{"min":1,"max":5,"sum":12,"value_count":4}},"@timestamp":"2023-04-03T09:20:00Z"`) +
+				`]}}}`,
+			wantResults: map[string]float64{"pod-a": 3},
+		},
+		{
+			name:     "counter",
+			metadata: MetricMetadata{TimeSeries: true, Counter: true, Indices: []string{"metrics-*"}},
+			response: `{"aggregations":{"series":{"buckets":[` +
+				series("pod-a", "web",
+					`"memory":{"usage":160},"@timestamp":"2023-04-03T09:21:00Z"`,
+					`"memory":{"usage":100},"@timestamp":"2023-04-03T09:20:00Z"`) + `,` +
+				series("pod-a", "sidecar",
+					`"memory":{"usage":20},"@timestamp":"2023-04-03T09:21:00Z"`,
+					`"memory":{"usage":80},"@timestamp":"2023-04-03T09:20:00Z"`) + `,` +
+				series("pod-b", "web",
+					`"memory":{"usage":5},"@timestamp":"2023-04-03T09:21:00Z"`) +
+				`]}}}`,
+			// pod-a: 60/60s + 20/60s after the reset, pod-b only has a single sample.
+			wantResults: map[string]float64{"pod-a": 80.0 / 60},
+			wantWindow:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			esClient, transport := newFakeClient(t, tt.response)
+			ctx := context.Background()
+			got, err := getMetricsForObjects(&ctx, esClient, tt.metadata, "ns1", []string{"pod-a", "pod-b"},
+				podMetricFor("memory.usage"), labels.Everything(), labels.Everything())
+			assert.NoError(t, err)
+			if len(tt.wantBody) > 0 {
+				assert.Equal(t, tt.wantBody, transport.bodies[0])
+			}
+			values := make(map[string]float64, len(got))
+			for name, value := range got {
+				values[name] = value.Value.AsApproximateFloat64()
+				assert.Equal(t, tt.wantWindow, value.WindowSeconds != nil)
+			}
+			assert.InDeltaMapValues(t, tt.wantResults, values, 0.001)
+		})
+	}
+}
+
+func Test_getAggregateMetricValue(t *testing.T) {
+	var value interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"min":1,"max":5,"sum":12,"value_count":4}`), &value))
+	for subMetric, want := range map[string]float64{"min": 1, "max": 5, "sum": 12, "value_count": 4, "avg": 3} {
+		got, err := getAggregateMetricValue(value, subMetric)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, subMetric)
+	}
+	got, err := getAggregateMetricValue(2.5, "max")
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, got)
+}
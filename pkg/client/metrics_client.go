@@ -18,6 +18,11 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
@@ -27,13 +32,60 @@ import (
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 )
 
+// Interface is implemented by the clients of the metric servers. The context of the request received by the adapter is
+// given to the clients, requests to the metric servers are cancelled when it is done.
 type Interface interface {
 	GetConfiguration() config.MetricServer
 
-	ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error)
-	GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error)
-	GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error)
+	ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error)
+	GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error)
+	GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error)
+
+	ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error)
+	GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error)
+}
+
+// ErrQueryTimeout is the cause of the cancellation of a context returned by WithQueryTimeout once the query timeout has
+// elapsed.
+var ErrQueryTimeout = errors.New("query timeout exceeded")
+
+// WithQueryTimeout returns a context which is cancelled once the query timeout of the metric server has elapsed, unless
+// the parent context is done earlier.
+func WithQueryTimeout(ctx context.Context, c Interface) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, c.GetConfiguration().GetQueryTimeout(), ErrQueryTimeout)
+}
+
+// Closer is implemented by the clients which hold resources, like connections or file watchers, released when the
+// adapter stops.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// Close releases the resources held by the clients, in-flight requests are awaited until the context is done.
+func Close(ctx context.Context, clients ...Interface) error {
+	var errs []error
+	for _, c := range clients {
+		if closer, ok := c.(Closer); ok {
+			if err := closer.Close(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", c.GetConfiguration().Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NodesReporter is implemented by the clients which connect to several nodes of a metric server.
+type NodesReporter interface {
+	// NodesHealth returns the health of each node the client is connected to.
+	NodesHealth() ([]NodeHealth, error)
+}
 
-	ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error)
-	GetExternalMetric(name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error)
+// NodeHealth is the health of a node, as seen by a client.
+type NodeHealth struct {
+	URL string `json:"url"`
+	// Name of the node, if it has been discovered.
+	Name      string     `json:"name,omitempty"`
+	Healthy   bool       `json:"healthy"`
+	Failures  int        `json:"failures,omitempty"`
+	DeadSince *time.Time `json:"deadSince,omitempty"`
 }
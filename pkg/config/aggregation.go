@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	AvgReducer        Reducer = "avg"
+	MaxReducer        Reducer = "max"
+	MinReducer        Reducer = "min"
+	SumReducer        Reducer = "sum"
+	LastReducer       Reducer = "last"
+	PercentileReducer Reducer = "percentile"
+)
+
+// Reducer is the function used to compute a single value from all the values in a time window.
+type Reducer string
+
+// Aggregation computes the value of a metric from all the documents in a time window, instead of using the latest document.
+type Aggregation struct {
+	// Window is the duration over which the values are aggregated, for example 2m
+	Window time.Duration `yaml:"window"`
+	// Reducer is one of avg, max, min, sum, last or percentile. Default is avg
+	Reducer Reducer `yaml:"reducer,omitempty"`
+	// Percentile to be computed, only used by the percentile reducer, for example 95
+	Percentile float64 `yaml:"percentile,omitempty"`
+}
+
+// GetReducer returns the reducer of the aggregation.
+func (a *Aggregation) GetReducer() Reducer {
+	if len(a.Reducer) == 0 {
+		return AvgReducer
+	}
+	return a.Reducer
+}
+
+// WindowSeconds returns the length of the window in seconds.
+func (a *Aggregation) WindowSeconds() int64 {
+	return int64(a.Window / time.Second)
+}
+
+func (a *Aggregation) validate() error {
+	if a.Window < time.Second {
+		return fmt.Errorf("aggregation window must be at least 1s, got %s", a.Window)
+	}
+	switch a.GetReducer() {
+	case AvgReducer, MaxReducer, MinReducer, SumReducer, LastReducer:
+		if a.Percentile != 0 {
+			return fmt.Errorf("percentile can only be set with the %s reducer", PercentileReducer)
+		}
+	case PercentileReducer:
+		if a.Percentile <= 0 || a.Percentile > 100 {
+			return fmt.Errorf("percentile must be greater than 0 and less than or equal to 100, got %v", a.Percentile)
+		}
+	default:
+		return fmt.Errorf("unknown aggregation reducer: %s", a.Reducer)
+	}
+	return nil
+}
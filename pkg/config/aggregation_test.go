@@ -0,0 +1,132 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrom_aggregation(t *testing.T) {
+	tests := []struct {
+		name       string
+		metricSets string
+		want       []*Aggregation
+		wantErr    string
+	}{
+		{
+			name: "inherited from the metric set",
+			metricSets: `
+      - indices: [ 'metricbeat-*' ]
+        aggregation:
+          window: 2m
+        fields:
+          - patterns: [ '^kibana\.' ]
+          - patterns: [ '^system\.' ]
+            aggregation:
+              window: 30s
+              reducer: percentile
+              percentile: 95
+          - name: static
+            search:
+              body: "{}"`,
+			want: []*Aggregation{
+				{Window: 2 * time.Minute},
+				{Window: 30 * time.Second, Reducer: PercentileReducer, Percentile: 95},
+				nil,
+			},
+		},
+		{
+			name: "unknown reducer",
+			metricSets: `
+      - indices: [ 'metricbeat-*' ]
+        aggregation:
+          window: 2m
+          reducer: median`,
+			wantErr: "es: unknown aggregation reducer: median",
+		},
+		{
+			name: "missing window",
+			metricSets: `
+      - indices: [ 'metricbeat-*' ]
+        fields:
+          - patterns: [ '^kibana\.' ]
+            aggregation:
+              reducer: max`,
+			wantErr: "es: aggregation window must be at least 1s, got 0s",
+		},
+		{
+			name: "invalid percentile",
+			metricSets: `
+      - indices: [ 'metricbeat-*' ]
+        aggregation:
+          window: 2m
+          reducer: percentile
+          percentile: 101`,
+			wantErr: "es: percentile must be greater than 0 and less than or equal to 100, got 101",
+		},
+		{
+			name: "invalid aggregation of a metric set with static fields only",
+			metricSets: `
+      - indices: [ 'metricbeat-*' ]
+        aggregation:
+          reducer: max
+        fields:
+          - name: static
+            search:
+              body: "{}"`,
+			wantErr: "es: aggregation window must be at least 1s, got 0s",
+		},
+		{
+			name: "static field",
+			metricSets: `
+      - indices: [ 'metricbeat-*' ]
+        fields:
+          - name: static
+            aggregation:
+              window: 2m
+            search:
+              body: "{}"`,
+			wantErr: "es: aggregation cannot be set on the static field static",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := From([]byte(`
+metricServers:
+  - name: es
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:` + tt.metricSets))
+			if len(tt.wantErr) > 0 {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			fields := got.MetricServers[0].MetricSets[0].Fields
+			aggregations := make([]*Aggregation, len(fields))
+			for i := range fields {
+				aggregations[i] = fields[i].Aggregation
+			}
+			assert.Equal(t, tt.want, aggregations)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Cache defines how long the metric values returned by a server are cached. Requests for the same metric, objects and
+// selectors received while a value is cached are served without querying the server.
+type Cache struct {
+	// TTL is how long a value is cached.
+	TTL time.Duration `yaml:"ttl"`
+	// StaleIfError is how long a value can still be served after it has expired, if the server returns an error.
+	// Disabled if not set.
+	StaleIfError time.Duration `yaml:"staleIfError,omitempty"`
+	// Metrics overrides the TTL of some metrics.
+	Metrics []MetricCache `yaml:"metrics,omitempty"`
+}
+
+// MetricCache sets the TTL of the metrics whose name matches a regular expression.
+type MetricCache struct {
+	// Name is a regular expression matching the names of the metrics, as exposed by the adapter.
+	Name string        `yaml:"name"`
+	TTL  time.Duration `yaml:"ttl"`
+
+	compiledName *regexp.Regexp
+}
+
+// TTLFor returns how long the values of a metric are cached, the first matching override is used.
+func (c *Cache) TTLFor(metric string) time.Duration {
+	for _, m := range c.Metrics {
+		if m.compiledName != nil && m.compiledName.MatchString(metric) {
+			return m.TTL
+		}
+	}
+	return c.TTL
+}
+
+func (c *Cache) validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("cache ttl cannot be negative, got %s", c.TTL)
+	}
+	if c.StaleIfError < 0 {
+		return fmt.Errorf("cache staleIfError cannot be negative, got %s", c.StaleIfError)
+	}
+	for i := range c.Metrics {
+		if c.Metrics[i].TTL < 0 {
+			return fmt.Errorf("cache ttl of metrics %s cannot be negative, got %s", c.Metrics[i].Name, c.Metrics[i].TTL)
+		}
+		compiledName, err := regexp.Compile(c.Metrics[i].Name)
+		if err != nil {
+			return fmt.Errorf("error while compiling regular expression %s: %v", c.Metrics[i].Name, err)
+		}
+		c.Metrics[i].compiledName = compiledName
+	}
+	return nil
+}
@@ -19,15 +19,16 @@ package config
 
 import (
 	"fmt"
-	"os"
 	"regexp"
 	"text/template"
+	"time"
 
 	"github.com/itchyny/gojq"
 	"gopkg.in/yaml.v3"
 )
 
-const configPath = "config/config.yml"
+// Path is the default path of the configuration, a file or a directory.
+const Path = "config/config.yml"
 
 // ObjectSelector defines a reference to a Kubernetes object.
 type ObjectSelector struct {
@@ -54,7 +55,36 @@ type MetricServer struct {
 	ClientConfig HTTPClientConfig `yaml:"clientConfig,omitempty"`
 	MetricSets   MetricSets       `yaml:"metricSets,omitempty"` // only valid if type is elasticsearch
 	Rename       *Matches         `yaml:"rename,omitempty"`
-	Priority     int              `yaml:"-"`
+	// Retry is the retry policy of the searches, only valid if type is elasticsearch
+	Retry *RetryPolicy `yaml:"retry,omitempty"`
+	// CircuitBreaker makes the requests to the server fail fast after consecutive failures, disabled if not set.
+	CircuitBreaker *CircuitBreaker `yaml:"circuitBreaker,omitempty"`
+	// QueryTimeout is the maximum duration of a request for metric values sent to the server. Default is 10s
+	QueryTimeout time.Duration `yaml:"queryTimeout,omitempty"`
+	// Cache caches the metric values returned by the server, disabled if not set.
+	Cache *Cache `yaml:"cache,omitempty"`
+	// Refresh defines how often the list of the metrics served by the server is refreshed.
+	Refresh *Refresh `yaml:"refresh,omitempty"`
+	// Required servers must list their metrics before the adapter starts, other servers are awaited at most
+	// initialSyncTimeout and are reported as degraded until they list their metrics. Default is true.
+	Required *bool `yaml:"required,omitempty"`
+	// Fallback defines when the next server serving a metric is queried if this one cannot answer. Default is
+	// onErrorOrNotFound.
+	Fallback Fallback `yaml:"fallback,omitempty"`
+	Priority int      `yaml:"-"`
+}
+
+// GetQueryTimeout returns the maximum duration of a request for metric values.
+func (m MetricServer) GetQueryTimeout() time.Duration {
+	if m.QueryTimeout == 0 {
+		return defaultQueryTimeout
+	}
+	return m.QueryTimeout
+}
+
+// IsRequired returns true if the server must list its metrics before the adapter starts.
+func (m MetricServer) IsRequired() bool {
+	return m.Required == nil || *m.Required
 }
 
 type Matches struct {
@@ -71,6 +101,19 @@ type MetricServers []MetricServer
 type Config struct {
 	ReadinessProbe ReadinessProbe `yaml:"failureThreshold"`
 	MetricServers  []MetricServer `yaml:"metricServers"`
+	// Routing routes metrics to metric servers, regardless of their priority.
+	Routing Routing `yaml:"routing,omitempty"`
+	// InitialSyncTimeout is how long the metric servers which are not required are awaited at startup, before the
+	// metrics of the other servers are served. Default is 30s
+	InitialSyncTimeout time.Duration `yaml:"initialSyncTimeout,omitempty"`
+}
+
+// GetInitialSyncTimeout returns how long the metric servers which are not required are awaited at startup.
+func (c *Config) GetInitialSyncTimeout() time.Duration {
+	if c.InitialSyncTimeout == 0 {
+		return defaultInitialSyncTimeout
+	}
+	return c.InitialSyncTimeout
 }
 
 type MetricSets []MetricSet
@@ -80,6 +123,70 @@ type MetricSet struct {
 	Indices []string `yaml:"indices"`
 	// Fields exposed within the Indices
 	Fields FieldsSet `yaml:"fields"`
+	// Identity declares the fields used to identify the Kubernetes objects in the documents.
+	Identity Identity `yaml:"identity,omitempty"`
+	// Aggregation is the default aggregation of the discovered fields.
+	Aggregation *Aggregation `yaml:"aggregation,omitempty"`
+	// Discovery is the API used to discover the fields of the indices, default is "mapping".
+	Discovery Discovery `yaml:"discovery,omitempty"`
+}
+
+// Discovery is the API used to discover the fields of a metric set.
+type Discovery string
+
+const (
+	// MappingDiscovery reads the mapping of each index.
+	MappingDiscovery Discovery = "mapping"
+	// FieldCapsDiscovery uses the field capabilities API, which returns a single entry per field for all the indices.
+	FieldCapsDiscovery Discovery = "fieldCaps"
+)
+
+// GetDiscovery returns the API used to discover the fields of the metric set.
+func (m MetricSet) GetDiscovery() Discovery {
+	if len(m.Discovery) == 0 {
+		return MappingDiscovery
+	}
+	return m.Discovery
+}
+
+// Identity holds the fields which identify the Kubernetes objects, and the time of the metrics, in the documents.
+type Identity struct {
+	// NamespaceField holds the namespace of the objects, default is kubernetes.namespace
+	NamespaceField string `yaml:"namespaceField,omitempty"`
+	// NameField holds the name of the objects associated with the default "pods" resource, default is kubernetes.pod.name
+	NameField string `yaml:"nameField,omitempty"`
+	// TimestampField holds the time of the metrics, default is @timestamp
+	TimestampField string `yaml:"timestampField,omitempty"`
+}
+
+const (
+	defaultNamespaceField = "kubernetes.namespace"
+	defaultNameField      = "kubernetes.pod.name"
+	defaultTimestampField = "@timestamp"
+)
+
+// GetNamespaceField returns the field which holds the namespace of the objects.
+func (i Identity) GetNamespaceField() string {
+	if len(i.NamespaceField) == 0 {
+		return defaultNamespaceField
+	}
+	return i.NamespaceField
+}
+
+// GetNameField returns the field which holds the name of the objects associated with the default resource.
+func (i Identity) GetNameField() string {
+	if len(i.NameField) == 0 {
+		return defaultNameField
+	}
+	return i.NameField
+}
+
+// GetTimestampField returns the field which holds the time of the metrics.
+func (i Identity) GetTimestampField() string {
+	if len(i.TimestampField) == 0 {
+		return defaultTimestampField
+	}
+	return i.TimestampField
 }
 
 type FieldsSet []Fields
@@ -92,9 +199,40 @@ type Fields struct {
 	// Search is the search associated to the static field
 	Search Search `yaml:"search"`
 	// Help to determine which fields are labels, for example ^prometheus\.labels\.(.*)
-	Labels []string `yaml:"labels"`
-	// Resource associated with the metrics, default is {group: "", resource: "pod"}
-	Resources GroupResource
+	// The first capture group, if any, is the name of the label as it can be used in a metric selector.
+	Labels         []string        `yaml:"labels"`
+	compiledLabels []regexp.Regexp `yaml:"-"`
+	// Resources associated with the metrics, default is the "pods" resource identified by the name field of the metric set.
+	Resources []Resource `yaml:"resources"`
+	// Identity is inherited from the metric set.
+	Identity Identity `yaml:"-"`
+	// Aggregation computes the value of the metrics over a time window, default is the one of the metric set if any.
+	// If not set the value of a metric is the one of the latest document.
+	Aggregation *Aggregation `yaml:"aggregation,omitempty"`
+	// Counter must be set to true if the fields are monotonic counters, the value of the metrics is then the per-second
+	// rate of the counters over the window of the aggregation. Fields mapped with "time_series_metric: counter" are
+	// automatically considered as counters.
+	Counter bool `yaml:"counter,omitempty"`
+	// AggregateMetric is the sub-metric used to read the value of aggregate_metric_double fields, as found in downsampled
+	// indices. One of min, max, sum, value_count or avg. Default is the default_metric of the field.
+	AggregateMetric string `yaml:"aggregateMetric,omitempty"`
+}
+
+// aggregateMetrics are the sub-metrics which can be read from an aggregate_metric_double field, avg is computed from sum
+// and value_count.
+var aggregateMetrics = map[string]struct{}{
+	"min":         {},
+	"max":         {},
+	"sum":         {},
+	"value_count": {},
+	"avg":         {},
+}
+
+// Resource associates a Kubernetes resource with the field which holds the name of the objects in the documents.
+type Resource struct {
+	// Field holds the name of the Kubernetes object, for example kubernetes.node.name
+	Field         string `yaml:"field"`
+	GroupResource `yaml:",inline"`
 }
 
 type Search struct {
@@ -102,20 +240,137 @@ type Search struct {
 	MetricPath string `yaml:"metricPath"`
 	// TimestampPath is the path to be used to get the result timestamp
 	TimestampPath string `yaml:"timestampPath"`
+	// ObjectsPath enables the per-object mode: the search is run once for all the objects, and ObjectsPath is the path
+	// to the results of each object. MetricPath, TimestampPath and NamePath are then relative to each result.
+	ObjectsPath string `yaml:"objectsPath,omitempty"`
+	// NamePath is the path to the name of the object in a result, only used in per-object mode. Default is ".key"
+	NamePath string `yaml:"namePath,omitempty"`
 	// Body is the body to be used to search the metric.
 	Body string `json:"body"`
+	// ESQL is an ES|QL query which can be used instead of Body. Pod, Namespace, Objects and PodSelectors are passed as
+	// named parameters, only Metric and Env can be used in the template.
+	ESQL string `yaml:"esql,omitempty"`
+	// ValueColumn is the ES|QL column which holds the value of the metric. Default is "value"
+	ValueColumn string `yaml:"valueColumn,omitempty"`
+	// TimestampColumn is the ES|QL column which holds the timestamp of the metric. Default is "timestamp"
+	TimestampColumn string `yaml:"timestampColumn,omitempty"`
+	// NameColumn is the ES|QL column which holds the name of the objects, if the query returns one row per object.
+	// Default is "name"
+	NameColumn string `yaml:"nameColumn,omitempty"`
 	// Template is the template version of the body
 	Template *template.Template `yaml:"-"`
 	// MetricResultQuery is the template version of metricPath
 	MetricResultQuery *gojq.Query `yaml:"-"`
 	// TimestampResultQuery is the template version of metricPath
 	TimestampResultQuery *gojq.Query `yaml:"-"`
+	// ObjectsResultQuery is the compiled version of objectsPath, nil if per-object mode is not enabled
+	ObjectsResultQuery *gojq.Query `yaml:"-"`
+	// NameResultQuery is the compiled version of namePath
+	NameResultQuery *gojq.Query `yaml:"-"`
+}
+
+const (
+	defaultNamePath        = ".key"
+	defaultValueColumn     = "value"
+	defaultTimestampColumn = "timestamp"
+	defaultNameColumn      = "name"
+)
+
+// IsESQL returns true if the metric is computed using an ES|QL query.
+func (s *Search) IsESQL() bool {
+	return len(s.ESQL) > 0
+}
+
+// GetValueColumn returns the ES|QL column which holds the value of the metric.
+func (s *Search) GetValueColumn() string {
+	if len(s.ValueColumn) == 0 {
+		return defaultValueColumn
+	}
+	return s.ValueColumn
+}
+
+// GetTimestampColumn returns the ES|QL column which holds the timestamp of the metric.
+func (s *Search) GetTimestampColumn() string {
+	if len(s.TimestampColumn) == 0 {
+		return defaultTimestampColumn
+	}
+	return s.TimestampColumn
+}
+
+// GetNameColumn returns the ES|QL column which holds the name of the objects.
+func (s *Search) GetNameColumn() string {
+	if len(s.NameColumn) == 0 {
+		return defaultNameColumn
+	}
+	return s.NameColumn
+}
+
+// GetNamePath returns the path to the name of the object in a per-object result.
+func (s *Search) GetNamePath() string {
+	if len(s.NamePath) == 0 {
+		return defaultNamePath
+	}
+	return s.NamePath
+}
+
+// Compile compiles the template of the search and its paths.
+func (s *Search) Compile() error {
+	if s.IsESQL() {
+		esqlTemplate, err := template.New("").Parse(s.ESQL)
+		if err != nil {
+			return fmt.Errorf("cannot parse esql: %w", err)
+		}
+		s.Template = esqlTemplate
+		return nil
+	}
+	bodyTemplate, err := template.New("").Parse(s.Body)
+	if err != nil {
+		return fmt.Errorf("cannot parse body: %w", err)
+	}
+	s.Template = bodyTemplate
+	if s.MetricResultQuery, err = parsePath("metricPath", s.MetricPath); err != nil {
+		return err
+	}
+	if s.TimestampResultQuery, err = parsePath("timestampPath", s.TimestampPath); err != nil {
+		return err
+	}
+	s.ObjectsResultQuery, s.NameResultQuery = nil, nil
+	if len(s.ObjectsPath) > 0 {
+		if s.ObjectsResultQuery, err = parsePath("objectsPath", s.ObjectsPath); err != nil {
+			return err
+		}
+		if s.NameResultQuery, err = parsePath("namePath", s.GetNamePath()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePath(name, path string) (*gojq.Query, error) {
+	query, err := gojq.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", name, err)
+	}
+	return query, nil
 }
 
 var defaultFieldSet = Fields{
 	Patterns: []string{"^.*$"},
 }
 
+// GetResources returns the resources associated with the fields.
+func (f *Fields) GetResources() []Resource {
+	if len(f.Resources) == 0 {
+		return []Resource{
+			{
+				Field:         f.Identity.GetNameField(),
+				GroupResource: GroupResource{Resource: "pods"},
+			},
+		}
+	}
+	return f.Resources
+}
+
 func (f FieldsSet) FindMetadata(fieldName string) *Fields {
 	for _, fieldSet := range f {
 		for _, pattern := range fieldSet.compiledPatterns {
@@ -127,19 +382,26 @@ func (f FieldsSet) FindMetadata(fieldName string) *Fields {
 	return nil
 }
 
+// LabelName returns the name of the label stored in a field, if the field matches one of the label patterns.
+func (f *Fields) LabelName(fieldName string) (string, bool) {
+	for _, pattern := range f.compiledLabels {
+		matches := pattern.FindStringSubmatch(fieldName)
+		if matches == nil {
+			continue
+		}
+		if len(matches) > 1 && len(matches[1]) > 0 {
+			return matches[1], true
+		}
+		return fieldName, true
+	}
+	return "", false
+}
+
 type GroupResource struct {
 	Group    string `yaml:"group"`
 	Resource string `yaml:"resource"`
 }
 
-func Parse() (*Config, error) {
-	config, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
-	}
-	return From(config)
-}
-
 func From(source []byte) (*Config, error) {
 	config := &Config{}
 	// Read file as yaml
@@ -161,8 +423,16 @@ func From(source []byte) (*Config, error) {
 }
 
 func validate(config *Config) error {
+	if config.InitialSyncTimeout < 0 {
+		return fmt.Errorf("initialSyncTimeout cannot be negative, got %s", config.InitialSyncTimeout)
+	}
+	names := make(map[string]struct{}, len(config.MetricServers))
 	for i := range config.MetricServers {
 		server := config.MetricServers[i]
+		if _, duplicate := names[server.Name]; duplicate {
+			return fmt.Errorf("%s: duplicate metric server name", server.Name)
+		}
+		names[server.Name] = struct{}{}
 		if server.Rename != nil {
 			if len(server.Rename.Matches) == 0 || len(server.Rename.As) == 0 {
 				return fmt.Errorf("%s: rename directive must contain both \"matches\" and \"as\" fields", server.Name)
@@ -171,6 +441,27 @@ func validate(config *Config) error {
 		if server.ServerType == "" {
 			return fmt.Errorf("%s: server type is not set", server.Name)
 		}
+		if server.QueryTimeout < 0 {
+			return fmt.Errorf("%s: queryTimeout cannot be negative, got %s", server.Name, server.QueryTimeout)
+		}
+		if server.CircuitBreaker != nil {
+			if err := server.CircuitBreaker.validate(); err != nil {
+				return fmt.Errorf("%s: %w", server.Name, err)
+			}
+		}
+		if server.Refresh != nil {
+			if err := server.Refresh.validate(); err != nil {
+				return fmt.Errorf("%s: %w", server.Name, err)
+			}
+		}
+		if err := server.Fallback.validate(); err != nil {
+			return fmt.Errorf("%s: %w", server.Name, err)
+		}
+		if server.Cache != nil {
+			if err := server.Cache.validate(); err != nil {
+				return fmt.Errorf("%s: %w", server.Name, err)
+			}
+		}
 		switch server.ServerType {
 		case "custom":
 			if !server.ClientConfig.IsDefined() {
@@ -179,6 +470,12 @@ func validate(config *Config) error {
 			if len(server.MetricSets) > 0 {
 				return fmt.Errorf("%s: metricSets is not allowed in upstream custom metric server", server.Name)
 			}
+			if err := server.ClientConfig.validateCustom(); err != nil {
+				return fmt.Errorf("%s: %w", server.Name, err)
+			}
+			if server.Retry != nil {
+				return fmt.Errorf("%s: retry is not allowed in upstream custom metric server", server.Name)
+			}
 		case "elasticsearch":
 			if len(server.MetricSets) == 0 {
 				return fmt.Errorf("%s: no metricSets defined", server.Name)
@@ -187,6 +484,14 @@ func validate(config *Config) error {
 			if !server.ClientConfig.IsDefined() {
 				return fmt.Errorf("%s: Elasticsearch requires clientConfig to be set", server.Name)
 			}
+			if err := server.ClientConfig.validateElasticsearch(); err != nil {
+				return fmt.Errorf("%s: %w", server.Name, err)
+			}
+			if server.Retry != nil {
+				if err := server.Retry.validate(); err != nil {
+					return fmt.Errorf("%s: %w", server.Name, err)
+				}
+			}
 			// Compile the regular expressions
 			for i := range server.MetricSets {
 				if len(server.MetricSets[i].Fields) == 0 {
@@ -194,8 +499,51 @@ func validate(config *Config) error {
 					server.MetricSets[i].Fields = append(server.MetricSets[i].Fields, defaultFieldSet)
 				}
 				metricSet := server.MetricSets[i]
+				if discovery := metricSet.GetDiscovery(); discovery != MappingDiscovery && discovery != FieldCapsDiscovery {
+					return fmt.Errorf("%s: unknown discovery: %s", server.Name, discovery)
+				}
+				if metricSet.Aggregation != nil {
+					if err := metricSet.Aggregation.validate(); err != nil {
+						return fmt.Errorf("%s: %w", server.Name, err)
+					}
+				}
 				for j := range metricSet.Fields {
+					metricSet.Fields[j].Identity = metricSet.Identity
+					if len(metricSet.Fields[j].Name) > 0 && metricSet.Fields[j].Aggregation != nil {
+						return fmt.Errorf("%s: aggregation cannot be set on the static field %s", server.Name, metricSet.Fields[j].Name)
+					}
+					if len(metricSet.Fields[j].Name) > 0 && metricSet.Fields[j].Counter {
+						return fmt.Errorf("%s: counter cannot be set on the static field %s", server.Name, metricSet.Fields[j].Name)
+					}
+					if aggregateMetric := metricSet.Fields[j].AggregateMetric; len(aggregateMetric) > 0 {
+						if _, ok := aggregateMetrics[aggregateMetric]; !ok {
+							return fmt.Errorf("%s: unknown aggregate metric: %s", server.Name, aggregateMetric)
+						}
+					}
+					if search := metricSet.Fields[j].Search; search.IsESQL() && (len(search.Body) > 0 || len(search.MetricPath) > 0 || len(search.TimestampPath) > 0 || len(search.ObjectsPath) > 0) {
+						return fmt.Errorf("%s: esql cannot be used with body, metricPath, timestampPath or objectsPath in the static field %s", server.Name, metricSet.Fields[j].Name)
+					}
+					if len(metricSet.Fields[j].Name) > 0 {
+						// The search is compiled by the client, it is only validated here.
+						search := metricSet.Fields[j].Search
+						if err := search.Compile(); err != nil {
+							return fmt.Errorf("%s: static field %s: %w", server.Name, metricSet.Fields[j].Name, err)
+						}
+					}
+					if len(metricSet.Fields[j].Name) == 0 && metricSet.Fields[j].Aggregation == nil {
+						metricSet.Fields[j].Aggregation = metricSet.Aggregation
+					}
+					if aggregation := metricSet.Fields[j].Aggregation; aggregation != nil {
+						if err := aggregation.validate(); err != nil {
+							return fmt.Errorf("%s: %w", server.Name, err)
+						}
+					}
 					field := metricSet.Fields[j]
+					for _, resource := range field.Resources {
+						if len(resource.Field) == 0 || len(resource.Resource) == 0 {
+							return fmt.Errorf("%s: resources must contain both \"field\" and \"resource\" fields", server.Name)
+						}
+					}
 					metricSet.Fields[j].compiledPatterns = make([]regexp.Regexp, len(field.Patterns))
 					for k, pattern := range field.Patterns {
 						compiledPattern, err := regexp.Compile(pattern)
@@ -204,11 +552,21 @@ func validate(config *Config) error {
 						}
 						metricSet.Fields[j].compiledPatterns[k] = *compiledPattern
 					}
+					if len(field.Labels) > 0 {
+						metricSet.Fields[j].compiledLabels = make([]regexp.Regexp, len(field.Labels))
+					}
+					for k, pattern := range field.Labels {
+						compiledPattern, err := regexp.Compile(pattern)
+						if err != nil {
+							return fmt.Errorf("%s: error while compiling label regular expression %s: %v", server.Name, pattern, err)
+						}
+						metricSet.Fields[j].compiledLabels[k] = *compiledPattern
+					}
 				}
 			}
 		default:
 			return fmt.Errorf("%s: unknown metric server type: %s", server.Name, server.ServerType)
 		}
 	}
-	return nil
+	return config.Routing.validate(config.MetricServers)
 }
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -144,3 +145,606 @@ func newMetricTypes(metricTypes ...string) *MetricTypes {
 	}
 	return &result
 }
+
+func TestFrom_identity(t *testing.T) {
+	got, err := From([]byte(`
+metricServers:
+  - name: otel
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*.otel-*' ]
+        identity:
+          namespaceField: resource.attributes.k8s.namespace.name
+          nameField: resource.attributes.k8s.pod.name
+        fields:
+          - patterns: [ '^metrics\.' ]
+          - patterns: [ '^metrics\.k8s\.node\.' ]
+            resources:
+              - field: resource.attributes.k8s.node.name
+                resource: nodes
+      - indices: [ 'metricbeat-*' ]
+`))
+	assert.NoError(t, err)
+	otel := got.MetricServers[0].MetricSets[0]
+	assert.Equal(t, "resource.attributes.k8s.namespace.name", otel.Fields[0].Identity.GetNamespaceField())
+	assert.Equal(t, "@timestamp", otel.Fields[0].Identity.GetTimestampField())
+	assert.Equal(t, []Resource{{Field: "resource.attributes.k8s.pod.name", GroupResource: GroupResource{Resource: "pods"}}}, otel.Fields[0].GetResources())
+	assert.Equal(t, []Resource{{Field: "resource.attributes.k8s.node.name", GroupResource: GroupResource{Resource: "nodes"}}}, otel.Fields[1].GetResources())
+
+	ecs := got.MetricServers[0].MetricSets[1]
+	assert.Equal(t, "kubernetes.namespace", ecs.Fields[0].Identity.GetNamespaceField())
+	assert.Equal(t, []Resource{{Field: "kubernetes.pod.name", GroupResource: GroupResource{Resource: "pods"}}}, ecs.Fields[0].GetResources())
+}
+
+func TestFrom_esql(t *testing.T) {
+	source := func(search string) []byte {
+		return []byte(`
+metricServers:
+  - name: es
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - name: kibana.load
+            search:` + search)
+	}
+	got, err := From(source(`
+              esql: "FROM metrics-* | STATS value = MAX(kibana.stats.load), timestamp = MAX(@timestamp) BY name = kubernetes.pod.name"
+              valueColumn: value`))
+	assert.NoError(t, err)
+	search := got.MetricServers[0].MetricSets[0].Fields[0].Search
+	assert.True(t, search.IsESQL())
+	assert.Equal(t, "value", search.GetValueColumn())
+	assert.Equal(t, "timestamp", search.GetTimestampColumn())
+	assert.Equal(t, "name", search.GetNameColumn())
+
+	_, err = From(source(`
+              esql: "FROM metrics-*"
+              metricPath: ".hits"`))
+	assert.EqualError(t, err, "es: esql cannot be used with body, metricPath, timestampPath or objectsPath in the static field kibana.load")
+}
+
+func TestFrom_search(t *testing.T) {
+	source := func(search string) []byte {
+		return []byte(`
+metricServers:
+  - name: es
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - name: kibana.load
+            search:` + search)
+	}
+	tests := []struct {
+		name    string
+		search  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			search: `
+              body: '{ "query": { "term": { "kubernetes.pod.name": "{{ .Pod }}" } } }'
+              metricPath: ".hits.hits[0]._source.kibana.stats.load"
+              timestampPath: ".hits.hits[0]._source[\"@timestamp\"]"`,
+		},
+		{
+			name: "invalid body",
+			search: `
+              body: '{ "query": {{ .Unclosed '
+              metricPath: ".hits"
+              timestampPath: ".hits"`,
+			wantErr: "es: static field kibana.load: cannot parse body: template: :1: unclosed action",
+		},
+		{
+			name: "invalid metricPath",
+			search: `
+              body: '{}'
+              metricPath: ".hits["
+              timestampPath: ".hits"`,
+			wantErr: "es: static field kibana.load: cannot parse metricPath: unexpected EOF",
+		},
+		{
+			name: "invalid namePath",
+			search: `
+              body: '{}'
+              metricPath: ".value"
+              timestampPath: ".timestamp"
+              objectsPath: ".buckets[]"
+              namePath: "key |"`,
+			wantErr: "es: static field kibana.load: cannot parse namePath: unexpected EOF",
+		},
+		{
+			name: "invalid esql",
+			search: `
+              esql: "FROM {{ .Metric"`,
+			wantErr: "es: static field kibana.load: cannot parse esql: template: :1: unclosed action",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := From(source(tt.search))
+			if len(tt.wantErr) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestFrom_discovery(t *testing.T) {
+	source := func(discovery string) []byte {
+		return []byte(`
+metricServers:
+  - name: es
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*' ]` + discovery)
+	}
+	got, err := From(source(``))
+	assert.NoError(t, err)
+	assert.Equal(t, MappingDiscovery, got.MetricServers[0].MetricSets[0].GetDiscovery())
+
+	got, err = From(source(`
+        discovery: fieldCaps`))
+	assert.NoError(t, err)
+	assert.Equal(t, FieldCapsDiscovery, got.MetricServers[0].MetricSets[0].GetDiscovery())
+
+	_, err = From(source(`
+        discovery: fields`))
+	assert.EqualError(t, err, "es: unknown discovery: fields")
+}
+
+func TestFrom_authentication(t *testing.T) {
+	source := func(serverType, clientConfig string) []byte {
+		config := `
+metricServers:
+  - name: es
+    serverType: ` + serverType + `
+    clientConfig:` + clientConfig
+		if serverType == "elasticsearch" {
+			config += `
+    metricSets:
+      - indices: [ 'metrics-*' ]`
+		}
+		return []byte(config)
+	}
+	tests := []struct {
+		name         string
+		serverType   string
+		clientConfig string
+		wantErr      string
+	}{
+		{
+			name:       "API key",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        apiKey: ${API_KEY}`,
+		},
+		{
+			name:       "Cloud ID and service account token",
+			serverType: "elasticsearch",
+			clientConfig: `
+      cloudID: my-deployment:ZXUtY2VudHJhbC0xLmF3cy5jbG91ZC5lcy5pbyRjZWM2ZjI2MWE3NGJmMjRjZTMzYmI4ODExYjg0Mjk0ZiRjNmMyY2E2ZDA0MjI0OWFmMGNjN2Q3YTllOTYyNTc0Mw==
+      authentication:
+        tokenFile: /mnt/elasticsearch/token`,
+		},
+		{
+			name:       "client certificate",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        certFile: /mnt/elasticsearch/tls.crt
+        keyFile: /mnt/elasticsearch/tls.key`,
+		},
+		{
+			name:       "hosts and sniffing",
+			serverType: "elasticsearch",
+			clientConfig: `
+      hosts:
+        - https://elasticsearch-es-coord-0.elasticsearch-es-coord.default.svc:9200
+        - https://elasticsearch-es-coord-1.elasticsearch-es-coord.default.svc:9200
+      sniffing:
+        onStart: true
+        interval: 5m`,
+		},
+		{
+			name:       "host and hosts",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      hosts: [ https://elasticsearch-es-coord-0.elasticsearch-es-coord.default.svc:9200 ]`,
+			wantErr: "es: host and hosts cannot be both set",
+		},
+		{
+			name:       "sniffing and Cloud ID",
+			serverType: "elasticsearch",
+			clientConfig: `
+      cloudID: my-deployment:ZXUtY2VudHJhbC0xLmF3cy5jbG91ZC5lcy5pbyQ=
+      sniffing:
+        onStart: true`,
+			wantErr: "es: sniffing cannot be used with cloudID",
+		},
+		{
+			name:       "hosts with a custom server",
+			serverType: "custom",
+			clientConfig: `
+      hosts: [ https://custom-metrics-apiserver.custom-metrics.svc ]`,
+			wantErr: "es: hosts and sniffing can only be used with Elasticsearch servers",
+		},
+		{
+			name:       "host and Cloud ID",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      cloudID: my-deployment:ZXUtY2VudHJhbC0xLmF3cy5jbG91ZC5lcy5pbyQ=`,
+			wantErr: "es: host and cloudID cannot be both set",
+		},
+		{
+			name:       "basic and API key authentication",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        username: metrics-adapter
+        password: ${PASSWORD}
+        apiKeyFile: /mnt/elasticsearch/api-key`,
+			wantErr: "es: only one authentication method can be used, got username, apiKeyFile",
+		},
+		{
+			name:       "API key and API key file",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        apiKey: ${API_KEY}
+        apiKeyFile: /mnt/elasticsearch/api-key`,
+			wantErr: "es: only one authentication method can be used, got apiKey, apiKeyFile",
+		},
+		{
+			name:       "username without password",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        username: metrics-adapter`,
+			wantErr: "es: basic authentication requires both username and password",
+		},
+		{
+			name:       "password from a file",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        username: metrics-adapter
+        passwordFile: /mnt/elasticsearch/password`,
+		},
+		{
+			name:       "password and password file",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        username: metrics-adapter
+        password: ${PASSWORD}
+        passwordFile: /mnt/elasticsearch/password`,
+			wantErr: "es: password and passwordFile cannot be both set",
+		},
+		{
+			name:       "certificate without key",
+			serverType: "elasticsearch",
+			clientConfig: `
+      host: https://elasticsearch-es-http.default.svc:9200
+      authentication:
+        certFile: /mnt/elasticsearch/tls.crt`,
+			wantErr: "es: client certificate authentication requires both certFile and keyFile",
+		},
+		{
+			name:       "API key with a custom server",
+			serverType: "custom",
+			clientConfig: `
+      host: https://custom-metrics-apiserver.custom-metrics.svc
+      authentication:
+        apiKey: ${API_KEY}`,
+			wantErr: "es: API key authentication can only be used with Elasticsearch servers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := From(source(tt.serverType, tt.clientConfig))
+			if len(tt.wantErr) > 0 {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestFrom_resilience(t *testing.T) {
+	source := func(serverType, resilience string) []byte {
+		config := `
+metricServers:
+  - name: es
+    serverType: ` + serverType + `
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200` + resilience
+		if serverType == "elasticsearch" {
+			config += `
+    metricSets:
+      - indices: [ 'metrics-*' ]`
+		}
+		return []byte(config)
+	}
+	tests := []struct {
+		name       string
+		serverType string
+		resilience string
+		want       MetricServer
+		wantErr    string
+	}{
+		{
+			name:       "retry and circuit breaker",
+			serverType: "elasticsearch",
+			resilience: `
+    retry:
+      maxAttempts: 5
+      initialBackoff: 200ms
+    circuitBreaker:
+      failureThreshold: 5
+      openDuration: 1m`,
+			want: MetricServer{
+				Retry:          &RetryPolicy{MaxAttempts: 5, InitialBackoff: 200 * time.Millisecond},
+				CircuitBreaker: &CircuitBreaker{FailureThreshold: 5, OpenDuration: time.Minute},
+			},
+		},
+		{
+			name:       "circuit breaker with a custom server",
+			serverType: "custom",
+			resilience: `
+    circuitBreaker:
+      failureThreshold: 3`,
+			want: MetricServer{
+				CircuitBreaker: &CircuitBreaker{FailureThreshold: 3},
+			},
+		},
+		{
+			name:       "retry with a custom server",
+			serverType: "custom",
+			resilience: `
+    retry:
+      maxAttempts: 5`,
+			wantErr: "es: retry is not allowed in upstream custom metric server",
+		},
+		{
+			name:       "negative attempts",
+			serverType: "elasticsearch",
+			resilience: `
+    retry:
+      maxAttempts: -1`,
+			wantErr: "es: retry maxAttempts cannot be negative, got -1",
+		},
+		{
+			name:       "initial backoff greater than max backoff",
+			serverType: "elasticsearch",
+			resilience: `
+    retry:
+      initialBackoff: 10s`,
+			wantErr: "es: retry initialBackoff 10s cannot be greater than maxBackoff 5s",
+		},
+		{
+			name:       "cache",
+			serverType: "custom",
+			resilience: `
+    cache:
+      ttl: 5s
+      staleIfError: 1m
+      metrics:
+        - name: '^kibana\.'
+          ttl: 30s`,
+			want: MetricServer{
+				Cache: &Cache{
+					TTL:          5 * time.Second,
+					StaleIfError: time.Minute,
+					Metrics:      []MetricCache{{Name: `^kibana\.`, TTL: 30 * time.Second, compiledName: regexp.MustCompile(`^kibana\.`)}},
+				},
+			},
+		},
+		{
+			name:       "invalid metric name in cache",
+			serverType: "custom",
+			resilience: `
+    cache:
+      ttl: 5s
+      metrics:
+        - name: '^kibana('
+          ttl: 30s`,
+			wantErr: "es: error while compiling regular expression ^kibana(: error parsing regexp: missing closing ): `^kibana(`",
+		},
+		{
+			name:       "negative query timeout",
+			serverType: "elasticsearch",
+			resilience: `
+    queryTimeout: -1s`,
+			wantErr: "es: queryTimeout cannot be negative, got -1s",
+		},
+		{
+			name:       "refresh",
+			serverType: "custom",
+			resilience: `
+    refresh:
+      interval: 24h
+      jitter: 0.1
+      maxBackoff: 10m`,
+			want: MetricServer{
+				Refresh: &Refresh{Interval: 24 * time.Hour, Jitter: 0.1, MaxBackoff: 10 * time.Minute},
+			},
+		},
+		{
+			name:       "refresh jitter out of range",
+			serverType: "elasticsearch",
+			resilience: `
+    refresh:
+      jitter: 1.5`,
+			wantErr: "es: refresh jitter must be between 0 and 1, got 1.5",
+		},
+		{
+			name:       "refresh initial backoff greater than max backoff",
+			serverType: "elasticsearch",
+			resilience: `
+    refresh:
+      initialBackoff: 1m
+      maxBackoff: 30s`,
+			wantErr: "es: refresh initialBackoff 1m0s cannot be greater than maxBackoff 30s",
+		},
+		{
+			name:       "optional server",
+			serverType: "elasticsearch",
+			resilience: `
+    required: false`,
+			want: MetricServer{
+				Required: new(bool),
+			},
+		},
+		{
+			name:       "fallback",
+			serverType: "custom",
+			resilience: `
+    fallback: onError`,
+			want: MetricServer{
+				Fallback: FallbackOnError,
+			},
+		},
+		{
+			name:       "unknown fallback",
+			serverType: "elasticsearch",
+			resilience: `
+    fallback: always`,
+			wantErr: "es: unknown fallback: always",
+		},
+		{
+			name:       "circuit breaker without threshold",
+			serverType: "elasticsearch",
+			resilience: `
+    circuitBreaker:
+      openDuration: 1m`,
+			wantErr: "es: circuit breaker failureThreshold must be at least 1, got 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := From(source(tt.serverType, tt.resilience))
+			if len(tt.wantErr) > 0 {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want.Retry, got.MetricServers[0].Retry)
+			assert.Equal(t, tt.want.CircuitBreaker, got.MetricServers[0].CircuitBreaker)
+			assert.Equal(t, tt.want.Cache, got.MetricServers[0].Cache)
+			assert.Equal(t, tt.want.Fallback, got.MetricServers[0].Fallback)
+			assert.Equal(t, tt.want.Refresh, got.MetricServers[0].Refresh)
+			assert.Equal(t, tt.want.Required, got.MetricServers[0].Required)
+		})
+	}
+}
+
+func TestFrom_routing(t *testing.T) {
+	source := func(routing string) []byte {
+		return []byte(`
+metricServers:
+  - name: es
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metrics-*' ]
+  - name: prometheus
+    serverType: custom
+    metricTypes: [ 'custom' ]
+    clientConfig:
+      host: https://custom-metrics-apiserver.custom-metrics.svc
+routing:` + routing)
+	}
+	tests := []struct {
+		name    string
+		routing string
+		route   RoutedMetric
+		want    int
+		wantErr string
+	}{
+		{
+			name: "first matching rule",
+			routing: `
+  - metric: '^kibana\.'
+    resource: pods
+    server: es
+  - metric: '^kibana\.'
+    server: prometheus`,
+			route: RoutedMetric{Type: CustomMetricType, Metric: "kibana.stats.load", Resource: "deployments.apps"},
+			want:  1,
+		},
+		{
+			name: "no matching rule",
+			routing: `
+  - metricType: external
+    namespace: team-a
+    server: es`,
+			route: RoutedMetric{Type: ExternalMetricType, Metric: "queue.length", Namespace: "team-b"},
+			want:  -1,
+		},
+		{
+			name: "unknown server",
+			routing: `
+  - metric: '^kibana\.'
+    server: missing`,
+			wantErr: "routing rule 0: unknown server missing",
+		},
+		{
+			name: "server does not serve the metric type",
+			routing: `
+  - metricType: external
+    server: prometheus`,
+			wantErr: "routing rule 0: server prometheus does not serve external metrics",
+		},
+		{
+			name: "resource of an external metric",
+			routing: `
+  - metricType: external
+    resource: pods
+    server: es`,
+			wantErr: "routing rule 0: resource cannot be set for external metrics",
+		},
+		{
+			name: "invalid regular expression",
+			routing: `
+  - metric: '^kibana('
+    server: es`,
+			wantErr: "routing rule 0: error while compiling regular expression ^kibana(: error parsing regexp: missing closing ): `^kibana(`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := From(source(tt.routing))
+			if len(tt.wantErr) > 0 {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			index, _ := got.Routing.Route(tt.route)
+			assert.Equal(t, tt.want, index)
+		})
+	}
+}
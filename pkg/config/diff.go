@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServersDiff holds the metric servers which have been added, removed or changed between two configurations. Servers
+// are identified by their name.
+type ServersDiff struct {
+	Added   []MetricServer
+	Removed []MetricServer
+	// Changed holds the new version of the servers which have been changed.
+	Changed []MetricServer
+	// Reprioritized holds the new version of the servers of which only the priority has been changed.
+	Reprioritized []MetricServer
+}
+
+// IsEmpty returns true if no metric server has been added, removed, changed or reprioritized.
+func (d ServersDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Reprioritized) == 0
+}
+
+// DiffMetricServers compares the metric servers of two configurations. A server is changed if any of its settings is
+// not the same, it is reprioritized if only its priority is not the same.
+func DiffMetricServers(previous, next []MetricServer) (ServersDiff, error) {
+	var diff ServersDiff
+	previousByName := make(map[string]MetricServer, len(previous))
+	for _, server := range previous {
+		previousByName[server.Name] = server
+	}
+	nextNames := make(map[string]struct{}, len(next))
+	for _, server := range next {
+		nextNames[server.Name] = struct{}{}
+		previousServer, exists := previousByName[server.Name]
+		if !exists {
+			diff.Added = append(diff.Added, server)
+			continue
+		}
+		equal, err := previousServer.equal(server)
+		if err != nil {
+			return ServersDiff{}, err
+		}
+		switch {
+		case !equal:
+			diff.Changed = append(diff.Changed, server)
+		case previousServer.Priority != server.Priority:
+			diff.Reprioritized = append(diff.Reprioritized, server)
+		}
+	}
+	for _, server := range previous {
+		if _, exists := nextNames[server.Name]; !exists {
+			diff.Removed = append(diff.Removed, server)
+		}
+	}
+	return diff, nil
+}
+
+// equal compares the settings of two servers. The compiled templates and patterns are not compared, they are built
+// from the settings, nor is the priority.
+func (m MetricServer) equal(other MetricServer) (bool, error) {
+	source, err := yaml.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	otherSource, err := yaml.Marshal(other)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(source, otherSource), nil
+}
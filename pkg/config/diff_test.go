@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffMetricServers(t *testing.T) {
+	previous, err := From([]byte(`
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+  - name: b
+    serverType: elasticsearch
+    clientConfig:
+      host: https://b
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - patterns: [ '^kibana\.' ]
+  - name: c
+    serverType: custom
+    clientConfig:
+      host: https://c
+`))
+	assert.NoError(t, err)
+	nextSource := []byte(`
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+  - name: b
+    serverType: elasticsearch
+    queryTimeout: 5s
+    clientConfig:
+      host: https://b
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - patterns: [ '^kibana\.' ]
+  - name: d
+    serverType: custom
+    clientConfig:
+      host: https://d
+`)
+	next, err := From(nextSource)
+	assert.NoError(t, err)
+
+	diff, err := DiffMetricServers(previous.MetricServers, next.MetricServers)
+	assert.NoError(t, err)
+	assert.Equal(t, []MetricServer{next.MetricServers[2]}, diff.Added)
+	assert.Equal(t, []MetricServer{previous.MetricServers[2]}, diff.Removed)
+	assert.Equal(t, []MetricServer{next.MetricServers[1]}, diff.Changed)
+
+	// Same configuration parsed again, only the compiled patterns are different.
+	again, err := From(nextSource)
+	assert.NoError(t, err)
+	diff, err = DiffMetricServers(next.MetricServers, again.MetricServers)
+	assert.NoError(t, err)
+	assert.True(t, diff.IsEmpty())
+
+	// The priority of a server depends on its position, the clients are not created again if only their priority is changed.
+	reordered, err := From([]byte(`
+metricServers:
+  - name: d
+    serverType: custom
+    clientConfig:
+      host: https://d
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+`))
+	assert.NoError(t, err)
+	diff, err = DiffMetricServers([]MetricServer{next.MetricServers[0], next.MetricServers[2]}, reordered.MetricServers)
+	assert.NoError(t, err)
+	assert.Empty(t, diff.Changed)
+	assert.Equal(t, reordered.MetricServers, diff.Reprioritized)
+	assert.False(t, diff.IsEmpty())
+}
+
+func TestFrom_duplicateName(t *testing.T) {
+	_, err := From([]byte(`
+metricServers:
+  - name: a
+    serverType: custom
+  - name: a
+    serverType: custom
+`))
+	assert.EqualError(t, err, "a: duplicate metric server name")
+}
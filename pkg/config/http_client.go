@@ -19,6 +19,9 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -26,18 +29,49 @@ import (
 )
 
 type HTTPClientConfig struct {
-	Host    string       `yaml:"host"`
+	Host string `yaml:"host"`
+	// Hosts can be used instead of Host to connect to several Elasticsearch nodes, a failed request is retried on another
+	// node. Only for Elasticsearch servers.
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Sniffing discovers the nodes of the Elasticsearch cluster, only for Elasticsearch servers.
+	Sniffing *Sniffing `yaml:"sniffing,omitempty"`
+	// CloudID can be used instead of Host to connect to an Elastic Cloud deployment, only for Elasticsearch servers.
+	CloudID string       `yaml:"cloudID,omitempty"`
 	Timeout *v1.Duration `yaml:"timeout,omitempty"`
 
 	AuthenticationConfig *AuthenticationConfig `yaml:"authentication,omitempty"`
 	TLSClientConfig      *TLSClientConfig      `yaml:"tls,omitempty"`
 }
 
+// Sniffing holds the settings used to discover the nodes of an Elasticsearch cluster.
+type Sniffing struct {
+	// OnStart discovers the nodes when the client is created.
+	OnStart bool `yaml:"onStart,omitempty"`
+	// Interval between two discoveries of the nodes, disabled if not set.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// GetHosts returns the Elasticsearch nodes the client initially connects to.
+func (hc *HTTPClientConfig) GetHosts() []string {
+	if len(hc.Hosts) > 0 {
+		return hc.Hosts
+	}
+	if len(hc.Host) > 0 {
+		return []string{hc.Host}
+	}
+	return nil
+}
+
 type AuthenticationConfig struct {
-	// Basic authentication
-	Username string `yaml:"username,omitempty"`
-	Password string `yaml:"password,omitempty"`
-	// Bearer
+	// Basic authentication, the password can also be read from a file, only for Elasticsearch servers.
+	Username     string `yaml:"username,omitempty"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	// API key authentication, only for Elasticsearch servers. APIKey is the encoded API key, it can be read from an
+	// environment variable, for example ${API_KEY}. APIKeyFile is a file which holds the encoded API key.
+	APIKey     string `yaml:"apiKey,omitempty"`
+	APIKeyFile string `yaml:"apiKeyFile,omitempty"`
+	// Bearer, for example an Elasticsearch service account token
 	BearerTokenFile string `yaml:"tokenFile,omitempty"`
 	// TLS client certificate authentication
 	CertFile string `yaml:"certFile,omitempty"`
@@ -52,6 +86,72 @@ func (AuthenticationConfig) String() string {
 	return "config.AuthenticationConfig(--- REDACTED ---)"
 }
 
+// validateElasticsearch checks that the settings used to connect to an Elasticsearch server do not contradict each other.
+func (hc *HTTPClientConfig) validateElasticsearch() error {
+	if len(hc.Host) > 0 && len(hc.Hosts) > 0 {
+		return errors.New("host and hosts cannot be both set")
+	}
+	if len(hc.GetHosts()) > 0 && len(hc.CloudID) > 0 {
+		return errors.New("host and cloudID cannot be both set")
+	}
+	if hc.Sniffing != nil && len(hc.CloudID) > 0 {
+		return errors.New("sniffing cannot be used with cloudID")
+	}
+	if hc.Sniffing != nil && hc.Sniffing.Interval < 0 {
+		return errors.New("sniffing interval cannot be negative")
+	}
+	auth := hc.AuthenticationConfig
+	if auth == nil {
+		return nil
+	}
+	var methods []string
+	if len(auth.Username) > 0 || len(auth.Password) > 0 || len(auth.PasswordFile) > 0 {
+		if len(auth.Username) == 0 || len(auth.Password) == 0 && len(auth.PasswordFile) == 0 {
+			return errors.New("basic authentication requires both username and password")
+		}
+		if len(auth.Password) > 0 && len(auth.PasswordFile) > 0 {
+			return errors.New("password and passwordFile cannot be both set")
+		}
+		methods = append(methods, "username")
+	}
+	if len(auth.APIKey) > 0 {
+		methods = append(methods, "apiKey")
+	}
+	if len(auth.APIKeyFile) > 0 {
+		methods = append(methods, "apiKeyFile")
+	}
+	if len(auth.BearerTokenFile) > 0 {
+		methods = append(methods, "tokenFile")
+	}
+	if len(auth.CertFile) > 0 || len(auth.KeyFile) > 0 {
+		if len(auth.CertFile) == 0 || len(auth.KeyFile) == 0 {
+			return errors.New("client certificate authentication requires both certFile and keyFile")
+		}
+		methods = append(methods, "certFile")
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf("only one authentication method can be used, got %s", strings.Join(methods, ", "))
+	}
+	return nil
+}
+
+// validateCustom checks that only the settings supported by custom servers are used.
+func (hc *HTTPClientConfig) validateCustom() error {
+	if len(hc.CloudID) > 0 {
+		return errors.New("cloudID can only be used with Elasticsearch servers")
+	}
+	if len(hc.Hosts) > 0 || hc.Sniffing != nil {
+		return errors.New("hosts and sniffing can only be used with Elasticsearch servers")
+	}
+	if auth := hc.AuthenticationConfig; auth != nil && (len(auth.APIKey) > 0 || len(auth.APIKeyFile) > 0) {
+		return errors.New("API key authentication can only be used with Elasticsearch servers")
+	}
+	if auth := hc.AuthenticationConfig; auth != nil && len(auth.PasswordFile) > 0 {
+		return errors.New("passwordFile can only be used with Elasticsearch servers")
+	}
+	return nil
+}
+
 // TLSClientConfig contains settings to enable transport layer security.
 type TLSClientConfig struct {
 	Insecure bool `yaml:"insecureSkipTLSVerify"` // insecureSkipTLSVerify to match original APIService setting
@@ -0,0 +1,256 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	metricServersKey = "metricServers"
+	routingKey       = "routing"
+	priorityKey      = "priority"
+)
+
+// Files returns the configuration files read from path. If path is a directory all the *.yml files of the directory
+// are returned, sorted by name.
+func Files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, match)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.yml file in %s", path)
+	}
+	return files, nil
+}
+
+// Load reads the configuration from a file, or from the *.yml fragments of a directory merged in the order of their
+// names:
+//   - the metricServers and the routing rules of the fragments are concatenated,
+//   - the other settings can only be set in one fragment.
+//
+// The metric servers are then sorted by increasing priority, a server without priority has the priority 0, servers with
+// the same priority keep the order in which they are read. Two servers cannot have the same name, or set the same
+// priority.
+//
+// The settings are decoded where they are read, the errors report the file and the line of the invalid settings.
+func Load(path string) (*Config, error) {
+	files, err := Files(path)
+	if err != nil {
+		return nil, err
+	}
+	m := newMerger()
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.add(file, source); err != nil {
+			return nil, err
+		}
+	}
+	return m.merged()
+}
+
+// position is the position of a setting in the configuration files.
+type position struct {
+	file string
+	line int
+}
+
+func (p position) String() string {
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+// serverNode is a metric server read from a configuration file.
+type serverNode struct {
+	server   MetricServer
+	name     string
+	position position
+	// priority is the priority of the server, nil if it is not set.
+	priority *int
+	// priorityPosition is the position of the priority, if it is set.
+	priorityPosition position
+}
+
+// merger merges configuration fragments.
+type merger struct {
+	config   Config
+	settings map[string]position
+	servers  []serverNode
+	names    map[string]position
+	priority map[int]serverNode
+}
+
+func newMerger() *merger {
+	return &merger{
+		settings: make(map[string]position),
+		names:    make(map[string]position),
+		priority: make(map[int]serverNode),
+	}
+}
+
+// add merges a configuration fragment.
+func (m *merger) add(file string, source []byte) error {
+	var document yaml.Node
+	if err := yaml.Unmarshal(source, &document); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if len(document.Content) == 0 {
+		// Empty file.
+		return nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: configuration must be a mapping", position{file: file, line: root.Line})
+	}
+	settings := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		at := position{file: file, line: key.Line}
+		switch key.Value {
+		case metricServersKey:
+			if err := m.addServers(file, value); err != nil {
+				return err
+			}
+		case routingKey:
+			if value.Kind != yaml.SequenceNode && value.Tag != "!!null" {
+				return fmt.Errorf("%s: routing must be a list", at)
+			}
+			var routing Routing
+			if err := value.Decode(&routing); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			m.config.Routing = append(m.config.Routing, routing...)
+		default:
+			if previous, exists := m.settings[key.Value]; exists {
+				return fmt.Errorf("%s: %s is already set in %s", at, key.Value, previous)
+			}
+			m.settings[key.Value] = at
+			settings.Content = append(settings.Content, key, value)
+		}
+	}
+	// The settings of the previous fragments are kept, they cannot be set again.
+	if err := settings.Decode(&m.config); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// addServers merges the metric servers of a fragment.
+func (m *merger) addServers(file string, servers *yaml.Node) error {
+	if servers.Tag == "!!null" {
+		return nil
+	}
+	if servers.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s: metricServers must be a list", position{file: file, line: servers.Line})
+	}
+	for _, node := range servers.Content {
+		server := serverNode{position: position{file: file, line: node.Line}}
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s: metric server must be a mapping", server.position)
+		}
+		content := make([]*yaml.Node, 0, len(node.Content))
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			switch key.Value {
+			case "name":
+				server.name = value.Value
+			case priorityKey:
+				priority, err := strconv.Atoi(value.Value)
+				if err != nil || value.Kind != yaml.ScalarNode {
+					return fmt.Errorf("%s: priority must be an integer, got %q", position{file: file, line: value.Line}, value.Value)
+				}
+				server.priority = &priority
+				server.priorityPosition = position{file: file, line: key.Line}
+				// The priority is not a field of the metric server, it only sets its position.
+				continue
+			}
+			content = append(content, key, value)
+		}
+		node.Content = content
+		if err := node.Decode(&server.server); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		if previous, exists := m.names[server.name]; exists {
+			return fmt.Errorf("%s: duplicate metric server name %q, already defined in %s", server.position, server.name, previous)
+		}
+		m.names[server.name] = server.position
+		if server.priority != nil {
+			if previous, exists := m.priority[*server.priority]; exists {
+				return fmt.Errorf(
+					"%s: priority %d of metric server %q is already set for metric server %q in %s",
+					server.priorityPosition, *server.priority, server.name, previous.name, previous.priorityPosition,
+				)
+			}
+			m.priority[*server.priority] = server
+		}
+		m.servers = append(m.servers, server)
+	}
+	return nil
+}
+
+// merged returns the merged configuration. Each metric server is validated alone first, to report the position of an
+// invalid one.
+func (m *merger) merged() (*Config, error) {
+	sort.SliceStable(m.servers, func(i, j int) bool {
+		return m.servers[i].getPriority() < m.servers[j].getPriority()
+	})
+	config := m.config
+	config.MetricServers = make([]MetricServer, 0, len(m.servers))
+	for i, server := range m.servers {
+		if err := validate(&Config{MetricServers: []MetricServer{server.server}}); err != nil {
+			return nil, fmt.Errorf("%s: %w", server.position, err)
+		}
+		server.server.Priority = i
+		config.MetricServers = append(config.MetricServers, server.server)
+	}
+	if err := validate(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (s serverNode) getPriority() int {
+	if s.priority == nil {
+		return 0
+	}
+	return *s.priority
+}
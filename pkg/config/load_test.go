@@ -0,0 +1,178 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	clusterFragment = `initialSyncTimeout: 1m
+metricServers:
+  - name: cluster
+    serverType: elasticsearch
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'metricbeat-*' ]
+routing:
+  - metric: "^system\\."
+    server: cluster
+`
+	teamFragment = `metricServers:
+  - name: team-a
+    serverType: elasticsearch
+    priority: -1
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'team-a-*' ]
+  - name: existing-adapter
+    serverType: custom
+    clientConfig:
+      host: https://custom-metrics-apiserver.custom-metrics.svc
+`
+	otherTeamFragment = `metricServers:
+  - name: team-b
+    serverType: elasticsearch
+    priority: 10
+    clientConfig:
+      host: https://elasticsearch-es-http.default.svc:9200
+    metricSets:
+      - indices: [ 'team-b-*' ]
+routing:
+  - metric: "^team-b\\."
+    server: team-b
+`
+)
+
+func writeFragments(t *testing.T, fragments map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, fragment := range fragments {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(fragment), 0o600))
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeFragments(t, map[string]string{
+		"10-cluster.yml": clusterFragment,
+		"20-team-a.yml":  teamFragment,
+		"30-team-b.yml":  otherTeamFragment,
+		"README.md":      "not a configuration file",
+	})
+
+	config, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "1m0s", config.InitialSyncTimeout.String())
+	var names []string
+	for i, server := range config.MetricServers {
+		names = append(names, server.Name)
+		assert.Equal(t, i, server.Priority)
+	}
+	// Servers are sorted by priority, then in the order of the files.
+	assert.Equal(t, []string{"team-a", "cluster", "existing-adapter", "team-b"}, names)
+	assert.Equal(t, 2, len(config.Routing))
+	assert.Equal(t, "cluster", config.Routing[0].Server)
+	assert.Equal(t, "team-b", config.Routing[1].Server)
+
+	// A single file can also be loaded.
+	config, err = Load(filepath.Join(dir, "10-cluster.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.MetricServers))
+}
+
+func TestLoad_conflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "no fragment",
+			fragments: map[string]string{"config.yaml": clusterFragment},
+			wantErr:   "no *.yml file in {dir}",
+		},
+		{
+			name: "duplicate server name",
+			fragments: map[string]string{
+				"a.yml": clusterFragment,
+				"b.yml": "metricServers:\n  - name: other\n    serverType: custom\n  - name: cluster\n    serverType: custom\n",
+			},
+			wantErr: "{dir}/b.yml:4: duplicate metric server name \"cluster\", already defined in {dir}/a.yml:3",
+		},
+		{
+			name: "conflicting priorities",
+			fragments: map[string]string{
+				"a.yml": otherTeamFragment,
+				"b.yml": "metricServers:\n  - name: other\n    serverType: custom\n    priority: 10\n",
+			},
+			wantErr: "{dir}/b.yml:4: priority 10 of metric server \"other\" is already set for metric server \"team-b\" in {dir}/a.yml:4",
+		},
+		{
+			name: "invalid priority",
+			fragments: map[string]string{
+				"a.yml": "metricServers:\n  - name: other\n    serverType: custom\n    priority: high\n",
+			},
+			wantErr: "{dir}/a.yml:4: priority must be an integer, got \"high\"",
+		},
+		{
+			name: "setting set twice",
+			fragments: map[string]string{
+				"a.yml": clusterFragment,
+				"b.yml": teamFragment + "initialSyncTimeout: 2m\n",
+			},
+			wantErr: "{dir}/b.yml:13: initialSyncTimeout is already set in {dir}/a.yml:1",
+		},
+		{
+			name: "invalid server",
+			fragments: map[string]string{
+				"a.yml": "metricServers:\n  - name: other\n",
+			},
+			wantErr: "{dir}/a.yml:2: other: server type is not set",
+		},
+		{
+			name: "invalid server setting",
+			fragments: map[string]string{
+				"a.yml": clusterFragment,
+				"b.yml": "metricServers:\n  - name: other\n    serverType: custom\n    queryTimeout: notaduration\n",
+			},
+			wantErr: "{dir}/b.yml: yaml: unmarshal errors:\n  line 4: cannot unmarshal !!str `notadur...` into time.Duration",
+		},
+		{
+			name: "invalid setting",
+			fragments: map[string]string{
+				"a.yml": teamFragment + "initialSyncTimeout: soon\n",
+			},
+			wantErr: "{dir}/a.yml: yaml: unmarshal errors:\n  line 13: cannot unmarshal !!str `soon` into time.Duration",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFragments(t, tt.fragments)
+			_, err := Load(dir)
+			assert.EqualError(t, err, strings.ReplaceAll(tt.wantErr, "{dir}", dir))
+		})
+	}
+}
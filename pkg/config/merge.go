@@ -0,0 +1,34 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// WithMetricServers returns a copy of the configuration with additional metric servers, which have a higher priority
+// than the servers of the configuration, in order. The resulting configuration is validated.
+func (c *Config) WithMetricServers(metricServers ...MetricServer) (*Config, error) {
+	merged := *c
+	merged.MetricServers = append(append([]MetricServer{}, c.MetricServers...), metricServers...)
+	source, err := yaml.Marshal(&merged)
+	if err != nil {
+		return nil, err
+	}
+	return From(source)
+}
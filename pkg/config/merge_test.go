@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_WithMetricServers(t *testing.T) {
+	source, err := os.ReadFile(filepath.Join("testdata", "config1.yaml"))
+	assert.NoError(t, err)
+	config, err := From(source)
+	assert.NoError(t, err)
+
+	// The configuration is not changed if no server is added.
+	same, err := config.WithMetricServers()
+	assert.NoError(t, err)
+	diff, err := DiffMetricServers(config.MetricServers, same.MetricServers)
+	assert.NoError(t, err)
+	assert.True(t, diff.IsEmpty())
+
+	added := MetricServer{
+		Name:         "added",
+		ServerType:   "custom",
+		ClientConfig: HTTPClientConfig{Host: "https://custom-metrics-apiserver.custom-metrics.svc"},
+	}
+	count := len(config.MetricServers)
+	merged, err := config.WithMetricServers(added)
+	assert.NoError(t, err)
+	assert.Equal(t, count, len(config.MetricServers), "configuration should not be changed")
+	assert.Equal(t, count+1, len(merged.MetricServers))
+	assert.Equal(t, "added", merged.MetricServers[count].Name)
+	assert.Equal(t, count, merged.MetricServers[count].Priority, "added servers should have the highest priority")
+
+	// The added servers are validated.
+	_, err = config.WithMetricServers(MetricServer{Name: "elasticsearch-metrics-cluster", ServerType: "custom", ClientConfig: added.ClientConfig})
+	assert.EqualError(t, err, "elasticsearch-metrics-cluster: duplicate metric server name")
+}
@@ -0,0 +1,109 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// metricNames describes the names of the metrics exposed by a field set, before they are renamed.
+type metricNames struct {
+	// name is the name of a static field.
+	name string
+	// pattern matches the names of the discovered fields. If anchored, all the names it matches start with prefix.
+	pattern  *regexp.Regexp
+	anchored bool
+	prefix   string
+}
+
+func (n metricNames) String() string {
+	if n.pattern == nil {
+		return fmt.Sprintf("static field %s", n.name)
+	}
+	return fmt.Sprintf("pattern %s", n.pattern.String())
+}
+
+// overlaps returns true if some metrics may be exposed with the same name, patterns are only compared using their
+// literal prefix.
+func (n metricNames) overlaps(other metricNames) bool {
+	switch {
+	case n.pattern == nil && other.pattern == nil:
+		return n.name == other.name
+	case n.pattern == nil:
+		return other.pattern.MatchString(n.name)
+	case other.pattern == nil:
+		return n.pattern.MatchString(other.name)
+	case !n.anchored || !other.anchored:
+		return true
+	}
+	return strings.HasPrefix(n.prefix, other.prefix) || strings.HasPrefix(other.prefix, n.prefix)
+}
+
+// metricNames returns the names of the metrics exposed by each field set of a metric set. Patterns which cannot be
+// compiled are ignored, they are reported when the configuration is validated.
+func (m MetricSet) metricNames() []metricNames {
+	fields := m.Fields
+	if len(fields) == 0 {
+		fields = FieldsSet{defaultFieldSet}
+	}
+	var names []metricNames
+	for _, field := range fields {
+		if len(field.Name) > 0 {
+			names = append(names, metricNames{name: field.Name})
+			continue
+		}
+		for _, pattern := range field.Patterns {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				continue
+			}
+			parsed, err := syntax.Parse(pattern, syntax.Perl)
+			if err != nil {
+				continue
+			}
+			prefix, _ := compiled.LiteralPrefix()
+			names = append(names, metricNames{pattern: compiled, anchored: isAnchored(parsed), prefix: prefix})
+		}
+	}
+	return names
+}
+
+// isAnchored returns true if a regular expression only matches at the beginning of the text.
+func isAnchored(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpConcat && len(re.Sub) > 0 {
+		re = re.Sub[0]
+	}
+	return re.Op == syntax.OpBeginText
+}
+
+// Overlap returns an error if the metric sets may expose metrics with the same name: the metrics of one of them would
+// replace the ones of the other. The check is conservative, the fields which actually exist in the indices are not
+// known before the discovery.
+func (m MetricSet) Overlap(other MetricSet) error {
+	for _, names := range m.metricNames() {
+		for _, otherNames := range other.metricNames() {
+			if names.overlaps(otherNames) {
+				return fmt.Errorf("%s may expose the same metrics as %s", names, otherNames)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricSet_Overlap(t *testing.T) {
+	patterns := func(patterns ...string) MetricSet {
+		return MetricSet{Fields: FieldsSet{{Patterns: patterns}}}
+	}
+	static := func(name string) MetricSet {
+		return MetricSet{Fields: FieldsSet{{Name: name}}}
+	}
+	tests := []struct {
+		name        string
+		a, b        MetricSet
+		wantOverlap string
+	}{
+		{name: "distinct prefixes", a: patterns(`^team_a\.`), b: patterns(`^team_b\.`, `^team_c\.`)},
+		{name: "same prefix", a: patterns(`^app\.`), b: patterns(`^app\.requests$`), wantOverlap: `pattern ^app\. may expose the same metrics as pattern ^app\.requests$`},
+		{name: "no fields", a: patterns(`^app\.`), b: MetricSet{}, wantOverlap: `pattern ^app\. may expose the same metrics as pattern ^.*$`},
+		{name: "not anchored", a: patterns(`^app\.`), b: patterns(`requests$`), wantOverlap: `pattern ^app\. may expose the same metrics as pattern requests$`},
+		{name: "static field matching a pattern", a: static("app.load"), b: patterns(`^app\.`), wantOverlap: `static field app.load may expose the same metrics as pattern ^app\.`},
+		{name: "static field not matching a pattern", a: static("load"), b: patterns(`^app\.`)},
+		{name: "same static field", a: static("load"), b: static("load"), wantOverlap: `static field load may expose the same metrics as static field load`},
+		{name: "distinct static fields", a: static("load"), b: static("latency")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.a.Overlap(tt.b)
+			if tt.wantOverlap == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantOverlap)
+		})
+	}
+}
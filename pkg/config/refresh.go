@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultRefreshInterval       = time.Minute
+	defaultRefreshInitialBackoff = 5 * time.Second
+	defaultRefreshMaxBackoff     = 5 * time.Minute
+)
+
+// Refresh defines how often the list of the metrics served by a server is refreshed.
+type Refresh struct {
+	// Interval is the delay between two refreshes. Default is 1m
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Jitter is the fraction of the delay, between 0 and 1, randomly added to or removed from each delay, so that the
+	// servers are not all refreshed at the same time. Default is 0, no jitter.
+	Jitter float64 `yaml:"jitter,omitempty"`
+	// InitialBackoff is the delay before the next refresh after a failure, it is doubled after each consecutive
+	// failure. Default is 5s
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+	// MaxBackoff is the maximum delay between two refreshes after consecutive failures. Default is 5m
+	MaxBackoff time.Duration `yaml:"maxBackoff,omitempty"`
+}
+
+// GetInterval returns the delay between two refreshes.
+func (r *Refresh) GetInterval() time.Duration {
+	if r == nil || r.Interval == 0 {
+		return defaultRefreshInterval
+	}
+	return r.Interval
+}
+
+// GetJitter returns the fraction of the delay randomly added to or removed from each delay.
+func (r *Refresh) GetJitter() float64 {
+	if r == nil {
+		return 0
+	}
+	return r.Jitter
+}
+
+// GetInitialBackoff returns the delay before the next refresh after a failure.
+func (r *Refresh) GetInitialBackoff() time.Duration {
+	if r == nil || r.InitialBackoff == 0 {
+		return defaultRefreshInitialBackoff
+	}
+	return r.InitialBackoff
+}
+
+// GetMaxBackoff returns the maximum delay between two refreshes after consecutive failures.
+func (r *Refresh) GetMaxBackoff() time.Duration {
+	if r == nil || r.MaxBackoff == 0 {
+		return defaultRefreshMaxBackoff
+	}
+	return r.MaxBackoff
+}
+
+func (r *Refresh) validate() error {
+	if r.Interval < 0 || r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("refresh interval and backoffs cannot be negative")
+	}
+	if r.Jitter < 0 || r.Jitter >= 1 {
+		return fmt.Errorf("refresh jitter must be between 0 and 1, got %v", r.Jitter)
+	}
+	if r.GetInitialBackoff() > r.GetMaxBackoff() {
+		return fmt.Errorf("refresh initialBackoff %s cannot be greater than maxBackoff %s", r.GetInitialBackoff(), r.GetMaxBackoff())
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	defaultOpenDuration   = 30 * time.Second
+	defaultQueryTimeout   = 10 * time.Second
+
+	defaultInitialSyncTimeout = 30 * time.Second
+)
+
+// RetryPolicy defines how the searches sent to an Elasticsearch server are retried when the server is overloaded or
+// unavailable.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a search is sent, including the first one. Default is 3, 1 disables the
+	// retries.
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+	// InitialBackoff is the delay before the first retry, it is doubled after each retry. Default is 100ms
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+	// MaxBackoff is the maximum delay between two attempts. A search is not retried if the server asks to wait longer
+	// using Retry-After. Default is 5s
+	MaxBackoff time.Duration `yaml:"maxBackoff,omitempty"`
+}
+
+// GetMaxAttempts returns the maximum number of times a search is sent.
+func (r *RetryPolicy) GetMaxAttempts() int {
+	if r == nil || r.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return r.MaxAttempts
+}
+
+// GetInitialBackoff returns the delay before the first retry.
+func (r *RetryPolicy) GetInitialBackoff() time.Duration {
+	if r == nil || r.InitialBackoff == 0 {
+		return defaultInitialBackoff
+	}
+	return r.InitialBackoff
+}
+
+// GetMaxBackoff returns the maximum delay between two attempts.
+func (r *RetryPolicy) GetMaxBackoff() time.Duration {
+	if r == nil || r.MaxBackoff == 0 {
+		return defaultMaxBackoff
+	}
+	return r.MaxBackoff
+}
+
+func (r *RetryPolicy) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("retry maxAttempts cannot be negative, got %d", r.MaxAttempts)
+	}
+	if r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("retry backoffs cannot be negative")
+	}
+	if r.GetInitialBackoff() > r.GetMaxBackoff() {
+		return fmt.Errorf("retry initialBackoff %s cannot be greater than maxBackoff %s", r.GetInitialBackoff(), r.GetMaxBackoff())
+	}
+	return nil
+}
+
+// CircuitBreaker stops sending requests to a metric server after consecutive failures, requests then fail fast until a
+// trial request succeeds.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failed requests which opens the circuit.
+	FailureThreshold int `yaml:"failureThreshold"`
+	// OpenDuration is how long the circuit stays open before a trial request is sent. Default is 30s
+	OpenDuration time.Duration `yaml:"openDuration,omitempty"`
+}
+
+// GetOpenDuration returns how long the circuit stays open before a trial request is sent.
+func (c *CircuitBreaker) GetOpenDuration() time.Duration {
+	if c.OpenDuration == 0 {
+		return defaultOpenDuration
+	}
+	return c.OpenDuration
+}
+
+func (c *CircuitBreaker) validate() error {
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("circuit breaker failureThreshold must be at least 1, got %d", c.FailureThreshold)
+	}
+	if c.OpenDuration < 0 {
+		return fmt.Errorf("circuit breaker openDuration cannot be negative, got %s", c.OpenDuration)
+	}
+	return nil
+}
+
+// Fallback defines when the next metric server serving a metric, in priority order, is queried if a server cannot
+// answer.
+type Fallback string
+
+const (
+	// FallbackOnErrorOrNotFound queries the next server if the server returns an error or no value.
+	FallbackOnErrorOrNotFound Fallback = "onErrorOrNotFound"
+	// FallbackOnError queries the next server if the server returns an error.
+	FallbackOnError Fallback = "onError"
+	// FallbackOnNotFound queries the next server if the server returns no value.
+	FallbackOnNotFound Fallback = "onNotFound"
+	// FallbackNever never queries the next server.
+	FallbackNever Fallback = "never"
+)
+
+// Allows returns true if the next server can be queried, after a server returned an error or no value.
+func (f Fallback) Allows(err error, notFound bool) bool {
+	switch f {
+	case FallbackNever:
+		return false
+	case FallbackOnError:
+		return err != nil && !notFound
+	case FallbackOnNotFound:
+		return notFound
+	default:
+		return err != nil || notFound
+	}
+}
+
+func (f Fallback) validate() error {
+	switch f {
+	case "", FallbackOnErrorOrNotFound, FallbackOnError, FallbackOnNotFound, FallbackNever:
+		return nil
+	}
+	return fmt.Errorf("unknown fallback: %s", f)
+}
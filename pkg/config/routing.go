@@ -0,0 +1,118 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Routing is an ordered list of routing rules, the first rule which matches a metric is used.
+type Routing []RoutingRule
+
+// RoutingRule routes the metrics it matches to a metric server. All the conditions of the rule must match, a condition
+// which is not set matches all the metrics.
+type RoutingRule struct {
+	// Metric is a regular expression matching the names of the metrics, as exposed by the adapter.
+	Metric string `yaml:"metric,omitempty" json:"metric,omitempty"`
+	// Resource is the resource described by a custom metric, for example pods or deployments.apps.
+	Resource string `yaml:"resource,omitempty" json:"resource,omitempty"`
+	// MetricType is the type of the metric, custom or external.
+	MetricType MetricType `yaml:"metricType,omitempty" json:"metricType,omitempty"`
+	// Namespace is the namespace of the request.
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	// Server is the name of the metric server which serves the matching metrics.
+	Server string `yaml:"server" json:"server"`
+
+	compiledMetric *regexp.Regexp
+}
+
+// RoutedMetric identifies a metric requested from the adapter.
+type RoutedMetric struct {
+	Type   MetricType `json:"type"`
+	Metric string     `json:"metric"`
+	// Resource is the resource described by a custom metric, empty for an external metric.
+	Resource  string `json:"resource,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Matches returns true if all the conditions of the rule match the metric.
+func (r *RoutingRule) Matches(metric RoutedMetric) bool {
+	if len(r.MetricType) > 0 && r.MetricType != metric.Type {
+		return false
+	}
+	if len(r.Resource) > 0 && r.Resource != metric.Resource {
+		return false
+	}
+	if len(r.Namespace) > 0 && r.Namespace != metric.Namespace {
+		return false
+	}
+	return r.compiledMetric == nil || r.compiledMetric.MatchString(metric.Metric)
+}
+
+// Route returns the index of the first rule which matches the metric, and the rule, or -1 and nil if no rule matches.
+func (r Routing) Route(metric RoutedMetric) (int, *RoutingRule) {
+	for i := range r {
+		if r[i].Matches(metric) {
+			return i, &r[i]
+		}
+	}
+	return -1, nil
+}
+
+func (r Routing) validate(servers []MetricServer) error {
+	for i := range r {
+		rule := &r[i]
+		server := findServer(servers, rule.Server)
+		switch {
+		case len(rule.Server) == 0:
+			return fmt.Errorf("routing rule %d: server is not set", i)
+		case server == nil:
+			return fmt.Errorf("routing rule %d: unknown server %s", i, rule.Server)
+		}
+		switch rule.MetricType {
+		case "":
+		case CustomMetricType, ExternalMetricType:
+			if !server.MetricTypes.HasType(rule.MetricType) {
+				return fmt.Errorf("routing rule %d: server %s does not serve %s metrics", i, rule.Server, rule.MetricType)
+			}
+		default:
+			return fmt.Errorf("routing rule %d: unknown metric type: %s", i, rule.MetricType)
+		}
+		if rule.MetricType == ExternalMetricType && len(rule.Resource) > 0 {
+			return fmt.Errorf("routing rule %d: resource cannot be set for external metrics", i)
+		}
+		if len(rule.Metric) > 0 {
+			compiledMetric, err := regexp.Compile(rule.Metric)
+			if err != nil {
+				return fmt.Errorf("routing rule %d: error while compiling regular expression %s: %v", i, rule.Metric, err)
+			}
+			rule.compiledMetric = compiledMetric
+		}
+	}
+	return nil
+}
+
+func findServer(servers []MetricServer, name string) *MetricServer {
+	for i := range servers {
+		if servers[i].Name == name {
+			return &servers[i]
+		}
+	}
+	return nil
+}
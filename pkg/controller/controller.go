@@ -0,0 +1,403 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/scheduler"
+)
+
+// syncKey is the single item of the work queue: the metric servers are built from all the resources.
+const syncKey = "sync"
+
+// Reloader applies the metric servers read from the resources.
+type Reloader interface {
+	// ValidateResource validates a metric server read from a resource.
+	ValidateResource(metricServer config.MetricServer) error
+	// ReloadResources applies the metric servers read from the resources, in increasing priority.
+	ReloadResources(ctx context.Context, metricServers []config.MetricServer) error
+}
+
+var (
+	_ scheduler.MetricListener = &Controller{}
+	_ scheduler.ErrorListener  = &Controller{}
+)
+
+// Controller watches the MetricServer and ElasticsearchMetricSet resources, converts them into metric servers and
+// applies them. The status conditions of the resources report whether they are valid, and the result of the discovery
+// of the metrics of their server.
+type Controller struct {
+	logger   logr.Logger
+	client   dynamic.Interface
+	reloader Reloader
+
+	informers     dynamicinformer.DynamicSharedInformerFactory
+	metricServers cache.GenericLister
+	metricSets    cache.GenericLister
+	queue         workqueue.TypedRateLimitingInterface[string]
+
+	lock sync.Mutex
+	// discoveries are the results of the discovery of the metrics, by metric server.
+	discoveries map[string]*discovery
+	// applied are the metric servers applied by the last sync.
+	applied []config.MetricServer
+}
+
+// NewController creates a controller for the MetricServer and ElasticsearchMetricSet resources.
+func NewController(client dynamic.Interface, reloader Reloader) *Controller {
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	c := &Controller{
+		logger:        log.ForPackage("controller"),
+		client:        client,
+		reloader:      reloader,
+		informers:     informers,
+		metricServers: informers.ForResource(MetricServerResource).Lister(),
+		metricSets:    informers.ForResource(ElasticsearchMetricSetResource).Lister(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "metric-servers"},
+		),
+		discoveries: make(map[string]*discovery),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { c.queue.Add(syncKey) },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldResource, oldOk := oldObj.(*unstructured.Unstructured)
+			newResource, newOk := newObj.(*unstructured.Unstructured)
+			if oldOk && newOk && oldResource.GetGeneration() == newResource.GetGeneration() {
+				// Only the status, or the metadata, has been updated.
+				return
+			}
+			c.queue.Add(syncKey)
+		},
+		DeleteFunc: func(interface{}) { c.queue.Add(syncKey) },
+	}
+	for _, resource := range []schema.GroupVersionResource{MetricServerResource, ElasticsearchMetricSetResource} {
+		if _, err := informers.ForResource(resource).Informer().AddEventHandler(handler); err != nil {
+			// Only returned if the informer is stopped.
+			c.logger.Error(err, "Failed to watch resources", "resource", resource.String())
+		}
+	}
+	return c
+}
+
+// Start watches the resources until the context is done. It blocks until the metric servers of the existing resources
+// have been applied once.
+func (c *Controller) Start(ctx context.Context) error {
+	c.informers.Start(ctx.Done())
+	for resource, synced := range c.informers.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to list %s", resource.Resource)
+		}
+	}
+	c.queue.Add(syncKey)
+	c.processNextItem(ctx)
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	go func() {
+		for c.processNextItem(ctx) {
+		}
+	}()
+	return nil
+}
+
+// processNextItem syncs the resources, it returns false once the queue is shut down.
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+	if err := c.sync(ctx); err != nil {
+		c.logger.Error(err, "Failed to sync metric server resources")
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// serverState is the state of a MetricServer resource during a sync.
+type serverState struct {
+	resource     *unstructured.Unstructured
+	metricServer config.MetricServer
+	priority     int64
+	metricSets   []*metricSetState
+	err          error
+	reason       string
+}
+
+// metricSetState is the state of an ElasticsearchMetricSet resource during a sync.
+type metricSetState struct {
+	resource  *unstructured.Unstructured
+	metricSet config.MetricSet
+	server    *serverState
+	err       error
+	reason    string
+}
+
+// conflict returns an error if the metric set may expose the same metrics as a metric set of its MetricServer, or of an
+// ElasticsearchMetricSet already added to the server. The metrics of one of them would silently replace the other ones.
+func (m *metricSetState) conflict() error {
+	for _, metricSet := range m.server.metricServer.MetricSets {
+		if err := m.metricSet.Overlap(metricSet); err != nil {
+			return fmt.Errorf("conflicts with metric server %s: %w", m.server.metricServer.Name, err)
+		}
+	}
+	for _, other := range m.server.metricSets {
+		if err := m.metricSet.Overlap(other.metricSet); err != nil {
+			return fmt.Errorf("conflicts with %s %s: %w", other.resource.GetKind(), cache.MetaObjectToName(other.resource).String(), err)
+		}
+	}
+	return nil
+}
+
+// sync converts all the resources into metric servers, applies the valid ones and updates the status of the resources.
+func (c *Controller) sync(ctx context.Context) error {
+	servers, err := c.listServers()
+	if err != nil {
+		return err
+	}
+	metricSets, err := c.listMetricSets(servers)
+	if err != nil {
+		return err
+	}
+
+	// Each metric set is validated with its server alone, an invalid metric set does not prevent the others from being
+	// served.
+	for _, metricSet := range metricSets {
+		if metricSet.err != nil {
+			continue
+		}
+		candidate := metricSet.server.metricServer
+		candidate.MetricSets = append(append(config.MetricSets{}, candidate.MetricSets...), metricSet.metricSet)
+		if err := c.reloader.ValidateResource(candidate); err != nil {
+			metricSet.err, metricSet.reason = err, InvalidSpecReason
+			continue
+		}
+		if err := metricSet.conflict(); err != nil {
+			metricSet.err, metricSet.reason = err, MetricConflictReason
+			continue
+		}
+		metricSet.server.metricSets = append(metricSet.server.metricSets, metricSet)
+	}
+
+	var valid []config.MetricServer
+	for _, server := range servers {
+		if server.err != nil {
+			continue
+		}
+		for _, metricSet := range server.metricSets {
+			server.metricServer.MetricSets = append(server.metricServer.MetricSets, metricSet.metricSet)
+		}
+		if err := c.reloader.ValidateResource(server.metricServer); err != nil {
+			server.err, server.reason = err, InvalidSpecReason
+			continue
+		}
+		valid = append(valid, server.metricServer)
+	}
+	for _, metricSet := range metricSets {
+		if metricSet.err == nil && metricSet.server.err != nil {
+			metricSet.err, metricSet.reason = fmt.Errorf("metric server %s is not valid", metricSet.server.metricServer.Name), ServerNotValidReason
+		}
+	}
+
+	if err := c.apply(ctx, valid); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, server := range servers {
+		errs = append(errs, c.updateStatus(ctx, MetricServerResource, server.resource, server.err, server.reason, server.metricServer.Name))
+	}
+	for _, metricSet := range metricSets {
+		serverName := ""
+		if metricSet.server != nil {
+			serverName = metricSet.server.metricServer.Name
+		}
+		errs = append(errs, c.updateStatus(ctx, ElasticsearchMetricSetResource, metricSet.resource, metricSet.err, metricSet.reason, serverName))
+	}
+	return errors.Join(errs...)
+}
+
+// listServers converts the MetricServer resources, by increasing priority.
+func (c *Controller) listServers() ([]*serverState, error) {
+	resources, err := c.metricServers.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]*serverState, 0, len(resources))
+	for _, object := range resources {
+		resource, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		server := &serverState{resource: resource}
+		server.metricServer, server.priority, server.err = metricServerFrom(resource)
+		server.metricServer.Name = resource.GetName()
+		if server.err != nil {
+			server.reason = InvalidSpecReason
+		}
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].priority != servers[j].priority {
+			return servers[i].priority < servers[j].priority
+		}
+		return servers[i].metricServer.Name < servers[j].metricServer.Name
+	})
+	return servers, nil
+}
+
+// listMetricSets converts the ElasticsearchMetricSet resources, by namespace and name.
+func (c *Controller) listMetricSets(servers []*serverState) ([]*metricSetState, error) {
+	resources, err := c.metricSets.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	serversByName := make(map[string]*serverState, len(servers))
+	for _, server := range servers {
+		serversByName[server.metricServer.Name] = server
+	}
+	metricSets := make([]*metricSetState, 0, len(resources))
+	for _, object := range resources {
+		resource, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		metricSet := &metricSetState{resource: resource}
+		var serverName string
+		metricSet.metricSet, serverName, metricSet.err = metricSetFrom(resource)
+		switch {
+		case metricSet.err != nil:
+			metricSet.reason = InvalidSpecReason
+		case serversByName[serverName] == nil:
+			metricSet.err, metricSet.reason = fmt.Errorf("metric server %s not found", serverName), ServerNotFoundReason
+		case serversByName[serverName].err != nil:
+			metricSet.server = serversByName[serverName]
+			metricSet.err, metricSet.reason = fmt.Errorf("metric server %s is not valid", serverName), ServerNotValidReason
+		default:
+			metricSet.server = serversByName[serverName]
+		}
+		metricSets = append(metricSets, metricSet)
+	}
+	sort.Slice(metricSets, func(i, j int) bool {
+		if metricSets[i].resource.GetNamespace() != metricSets[j].resource.GetNamespace() {
+			return metricSets[i].resource.GetNamespace() < metricSets[j].resource.GetNamespace()
+		}
+		return metricSets[i].resource.GetName() < metricSets[j].resource.GetName()
+	})
+	return metricSets, nil
+}
+
+// apply applies the metric servers if they have changed since the last sync.
+func (c *Controller) apply(ctx context.Context, metricServers []config.MetricServer) error {
+	c.lock.Lock()
+	applied := c.applied
+	diff, err := config.DiffMetricServers(applied, metricServers)
+	if err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	if applied != nil && diff.IsEmpty() {
+		c.lock.Unlock()
+		return nil
+	}
+	// The metrics of the removed and changed servers are discovered again.
+	for _, servers := range [][]config.MetricServer{diff.Removed, diff.Changed} {
+		for _, server := range servers {
+			delete(c.discoveries, server.Name)
+		}
+	}
+	c.lock.Unlock()
+
+	if err := c.reloader.ReloadResources(ctx, metricServers); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.applied = append([]config.MetricServer{}, metricServers...)
+	return nil
+}
+
+// updateStatus updates the conditions of a resource, if they have changed.
+func (c *Controller) updateStatus(
+	ctx context.Context,
+	gvr schema.GroupVersionResource,
+	resource *unstructured.Unstructured,
+	err error,
+	reason string,
+	serverName string,
+) error {
+	status, statusErr := statusOf(resource)
+	if statusErr != nil {
+		return statusErr
+	}
+	changed := status.ObservedGeneration != resource.GetGeneration()
+	status.ObservedGeneration = resource.GetGeneration()
+	valid := metav1.Condition{
+		Type:               ValidCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             ValidReason,
+		Message:            "resource is served by the adapter",
+		ObservedGeneration: resource.GetGeneration(),
+	}
+	if err != nil {
+		valid.Status, valid.Reason, valid.Message = metav1.ConditionFalse, reason, err.Error()
+	}
+	changed = meta.SetStatusCondition(&status.Conditions, valid) || changed
+	if err != nil {
+		changed = meta.RemoveStatusCondition(&status.Conditions, DiscoveredCondition) || changed
+	} else {
+		discovered := c.discoveryCondition(serverName)
+		discovered.ObservedGeneration = resource.GetGeneration()
+		changed = meta.SetStatusCondition(&status.Conditions, discovered) || changed
+	}
+	if !changed {
+		return nil
+	}
+	updated, statusErr := withStatus(resource, status)
+	if statusErr != nil {
+		return statusErr
+	}
+	_, statusErr = c.client.Resource(gvr).Namespace(resource.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if statusErr != nil {
+		return fmt.Errorf("failed to update the status of %s %s: %w", gvr.Resource, cache.MetaObjectToName(resource).String(), statusErr)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// fakeReloader validates the metric servers alone, and records the metric servers applied.
+type fakeReloader struct {
+	lock     sync.Mutex
+	reloaded [][]config.MetricServer
+}
+
+func (f *fakeReloader) ValidateResource(metricServer config.MetricServer) error {
+	_, err := (&config.Config{}).WithMetricServers(metricServer)
+	return err
+}
+
+func (f *fakeReloader) ReloadResources(_ context.Context, metricServers []config.MetricServer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reloaded = append(f.reloaded, metricServers)
+	return nil
+}
+
+// names returns the names of the metric servers of each reload.
+func (f *fakeReloader) names() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := make([][]string, len(f.reloaded))
+	for i, metricServers := range f.reloaded {
+		result[i] = []string{}
+		for _, metricServer := range metricServers {
+			result[i] = append(result[i], metricServer.Name)
+		}
+	}
+	return result
+}
+
+func newResource(kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	resource := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	resource.SetAPIVersion(Group + "/" + Version)
+	resource.SetKind(kind)
+	resource.SetNamespace(namespace)
+	resource.SetName(name)
+	resource.SetGeneration(1)
+	return resource
+}
+
+// condition returns a condition of a resource, nil if the resource or the condition does not exist.
+func condition(t *testing.T, client *fake.FakeDynamicClient, gvr schema.GroupVersionResource, namespace, name, conditionType string) *metav1.Condition {
+	t.Helper()
+	resource, err := client.Resource(gvr).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	status, err := statusOf(resource)
+	assert.NoError(t, err)
+	return meta.FindStatusCondition(status.Conditions, conditionType)
+}
+
+func TestController(t *testing.T) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			MetricServerResource:           "MetricServerList",
+			ElasticsearchMetricSetResource: "ElasticsearchMetricSetList",
+		},
+		newResource("MetricServer", "", "es", map[string]interface{}{
+			"serverType":   "elasticsearch",
+			"priority":     int64(1),
+			"queryTimeout": "5s",
+			"clientConfig": map[string]interface{}{"host": "https://es:9200"},
+		}),
+		newResource("MetricServer", "", "custom", map[string]interface{}{
+			"serverType":   "custom",
+			"clientConfig": map[string]interface{}{"host": "https://custom"},
+		}),
+		newResource("MetricServer", "", "unknown-field", map[string]interface{}{
+			"serverType": "custom",
+			"host":       "https://custom",
+		}),
+		newResource("ElasticsearchMetricSet", "team-a", "metrics", map[string]interface{}{
+			"server":  "es",
+			"indices": []interface{}{"metrics-team-a-*"},
+		}),
+		newResource("ElasticsearchMetricSet", "team-b", "metrics", map[string]interface{}{
+			"server":    "es",
+			"indices":   []interface{}{"metrics-team-b-*"},
+			"discovery": "unknown",
+		}),
+		newResource("ElasticsearchMetricSet", "team-c", "metrics", map[string]interface{}{
+			"server":  "missing",
+			"indices": []interface{}{"metrics-team-c-*"},
+		}),
+		newResource("ElasticsearchMetricSet", "team-d", "metrics", map[string]interface{}{
+			"server":  "es",
+			"indices": []interface{}{"metrics-team-d-*"},
+			"fields": []interface{}{map[string]interface{}{
+				"name": "broken",
+				"search": map[string]interface{}{
+					"body":          `{ "query": {{ .Unclosed `,
+					"metricPath":    ".value",
+					"timestampPath": ".timestamp",
+				},
+			}},
+		}),
+		newResource("ElasticsearchMetricSet", "team-e", "metrics", map[string]interface{}{
+			"server":  "es",
+			"indices": []interface{}{"metrics-team-e-*"},
+			"fields":  []interface{}{map[string]interface{}{"patterns": []interface{}{`^app\.`}}},
+		}),
+	)
+	reloader := &fakeReloader{}
+	controller := NewController(client, reloader)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, controller.Start(ctx))
+
+	// The valid servers are applied by increasing priority, with their valid metric sets.
+	assert.Equal(t, [][]string{{"custom", "es"}}, reloader.names())
+	es := reloader.reloaded[0][1]
+	assert.Equal(t, 5*time.Second, es.QueryTimeout)
+	assert.Equal(t, 1, len(es.MetricSets))
+	assert.Equal(t, []string{"metrics-team-a-*"}, es.MetricSets[0].Indices)
+
+	for _, tt := range []struct {
+		gvr             schema.GroupVersionResource
+		namespace, name string
+		status          metav1.ConditionStatus
+		reason          string
+	}{
+		{gvr: MetricServerResource, name: "es", status: metav1.ConditionTrue, reason: ValidReason},
+		{gvr: MetricServerResource, name: "custom", status: metav1.ConditionTrue, reason: ValidReason},
+		{gvr: MetricServerResource, name: "unknown-field", status: metav1.ConditionFalse, reason: InvalidSpecReason},
+		{gvr: ElasticsearchMetricSetResource, namespace: "team-a", name: "metrics", status: metav1.ConditionTrue, reason: ValidReason},
+		{gvr: ElasticsearchMetricSetResource, namespace: "team-b", name: "metrics", status: metav1.ConditionFalse, reason: InvalidSpecReason},
+		{gvr: ElasticsearchMetricSetResource, namespace: "team-c", name: "metrics", status: metav1.ConditionFalse, reason: ServerNotFoundReason},
+		// A search which cannot be compiled is rejected before it is applied.
+		{gvr: ElasticsearchMetricSetResource, namespace: "team-d", name: "metrics", status: metav1.ConditionFalse, reason: InvalidSpecReason},
+		// All the fields of the indices of team-a are exposed, the metrics of team-e would replace some of them.
+		{gvr: ElasticsearchMetricSetResource, namespace: "team-e", name: "metrics", status: metav1.ConditionFalse, reason: MetricConflictReason},
+	} {
+		valid := condition(t, client, tt.gvr, tt.namespace, tt.name, ValidCondition)
+		if assert.NotNil(t, valid, "%s %s/%s", tt.gvr.Resource, tt.namespace, tt.name) {
+			assert.Equal(t, tt.status, valid.Status, "%s %s/%s", tt.gvr.Resource, tt.namespace, tt.name)
+			assert.Equal(t, tt.reason, valid.Reason, "%s %s/%s", tt.gvr.Resource, tt.namespace, tt.name)
+		}
+	}
+	conflict := condition(t, client, ElasticsearchMetricSetResource, "team-e", "metrics", ValidCondition)
+	if assert.NotNil(t, conflict) {
+		assert.Equal(t, `conflicts with ElasticsearchMetricSet team-a/metrics: pattern ^app\. may expose the same metrics as pattern ^.*$`, conflict.Message)
+	}
+	discovered := condition(t, client, MetricServerResource, "", "es", DiscoveredCondition)
+	if assert.NotNil(t, discovered) {
+		assert.Equal(t, DiscoveryPendingReason, discovered.Reason)
+	}
+
+	// The result of the discovery is reported in the status of the server and of its metric sets.
+	controller.discovered("es", config.CustomMetricType, 2, nil)
+	controller.discovered("es", config.ExternalMetricType, 0, errors.New("connection refused"))
+	assert.Eventually(t, func() bool {
+		discovered := condition(t, client, ElasticsearchMetricSetResource, "team-a", "metrics", DiscoveredCondition)
+		return discovered != nil && discovered.Reason == DiscoveryFailedReason &&
+			discovered.Message == "failed to list external metrics: connection refused"
+	}, 5*time.Second, 10*time.Millisecond)
+	controller.discovered("es", config.ExternalMetricType, 1, nil)
+	assert.Eventually(t, func() bool {
+		discovered := condition(t, client, MetricServerResource, "", "es", DiscoveredCondition)
+		return discovered != nil && discovered.Status == metav1.ConditionTrue && discovered.Message == "2 custom metrics, 1 external metrics"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(reloader.names()), "servers should not be reloaded if they have not changed")
+
+	// The metric set of team-e is served once the one of team-a is deleted.
+	assert.NoError(t, client.Resource(ElasticsearchMetricSetResource).Namespace("team-a").Delete(ctx, "metrics", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		valid := condition(t, client, ElasticsearchMetricSetResource, "team-e", "metrics", ValidCondition)
+		return valid != nil && valid.Status == metav1.ConditionTrue
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, [][]string{{"custom", "es"}, {"custom", "es"}}, reloader.names())
+	assert.Equal(t, []string{"metrics-team-e-*"}, reloader.reloaded[1][1].MetricSets[0].Indices)
+
+	// The Elasticsearch server is not valid anymore without metric sets.
+	assert.NoError(t, client.Resource(ElasticsearchMetricSetResource).Namespace("team-e").Delete(ctx, "metrics", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		return len(reloader.names()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"custom"}, reloader.names()[2])
+	assert.Eventually(t, func() bool {
+		valid := condition(t, client, MetricServerResource, "", "es", ValidCondition)
+		return valid != nil && valid.Message == "es: no metricSets defined"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+var metricTypes = []config.MetricType{config.CustomMetricType, config.ExternalMetricType}
+
+// discovery is the result of the last discovery of the metrics of a metric server, by metric type.
+type discovery struct {
+	counts map[config.MetricType]int
+	errors map[config.MetricType]string
+}
+
+func (c *Controller) UpdateCustomMetrics(metricClient client.Interface, cms map[provider.CustomMetricInfo]struct{}) {
+	c.discovered(metricClient.GetConfiguration().Name, config.CustomMetricType, len(cms), nil)
+}
+
+func (c *Controller) UpdateExternalMetrics(metricClient client.Interface, ems map[provider.ExternalMetricInfo]struct{}) {
+	c.discovered(metricClient.GetConfiguration().Name, config.ExternalMetricType, len(ems), nil)
+}
+
+func (c *Controller) OnError(metricClient client.Interface, metricType config.MetricType, err error) {
+	c.discovered(metricClient.GetConfiguration().Name, metricType, 0, err)
+}
+
+// discovered records the result of the discovery of the metrics of a given type. The status of the resources is
+// updated if the server has been created from a resource and the result has changed.
+func (c *Controller) discovered(serverName string, metricType config.MetricType, count int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	d, exists := c.discoveries[serverName]
+	if !exists {
+		d = &discovery{
+			counts: make(map[config.MetricType]int),
+			errors: make(map[config.MetricType]string),
+		}
+		c.discoveries[serverName] = d
+	}
+	previousCount, hadCount := d.counts[metricType]
+	previousErr, hadErr := d.errors[metricType]
+	var changed bool
+	if err != nil {
+		changed = !hadErr || previousErr != err.Error()
+		d.errors[metricType] = err.Error()
+	} else {
+		changed = hadErr || !hadCount || previousCount != count
+		delete(d.errors, metricType)
+		d.counts[metricType] = count
+	}
+	if !changed {
+		return
+	}
+	for _, applied := range c.applied {
+		if applied.Name == serverName {
+			c.queue.Add(syncKey)
+			return
+		}
+	}
+}
+
+// discoveryCondition returns the Discovered condition of a metric server.
+func (c *Controller) discoveryCondition(serverName string) metav1.Condition {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	d, exists := c.discoveries[serverName]
+	if !exists || (len(d.counts) == 0 && len(d.errors) == 0) {
+		return metav1.Condition{
+			Type:    DiscoveredCondition,
+			Status:  metav1.ConditionUnknown,
+			Reason:  DiscoveryPendingReason,
+			Message: "metrics have not been listed yet",
+		}
+	}
+	var messages []string
+	if len(d.errors) > 0 {
+		for _, metricType := range metricTypes {
+			if err, exists := d.errors[metricType]; exists {
+				messages = append(messages, fmt.Sprintf("failed to list %s metrics: %s", metricType, err))
+			}
+		}
+		return metav1.Condition{
+			Type:    DiscoveredCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  DiscoveryFailedReason,
+			Message: strings.Join(messages, ", "),
+		}
+	}
+	for _, metricType := range metricTypes {
+		if count, exists := d.counts[metricType]; exists {
+			messages = append(messages, fmt.Sprintf("%d %s metrics", count, metricType))
+		}
+	}
+	return metav1.Condition{
+		Type:    DiscoveredCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  MetricsDiscoveredReason,
+		Message: strings.Join(messages, ", "),
+	}
+}
@@ -0,0 +1,144 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+const (
+	Group   = "metrics.k8s.elastic.co"
+	Version = "v1alpha1"
+
+	// ValidCondition reports whether the resource has been validated and applied.
+	ValidCondition = "Valid"
+	// DiscoveredCondition reports whether the metric server has listed its metrics.
+	DiscoveredCondition = "Discovered"
+
+	ValidReason             = "Valid"
+	InvalidSpecReason       = "InvalidSpec"
+	ServerNotFoundReason    = "ServerNotFound"
+	ServerNotValidReason    = "ServerNotValid"
+	MetricConflictReason    = "MetricConflict"
+	MetricsDiscoveredReason = "MetricsDiscovered"
+	DiscoveryFailedReason   = "DiscoveryFailed"
+	DiscoveryPendingReason  = "DiscoveryPending"
+)
+
+var (
+	// MetricServerResource is a cluster-scoped resource holding the configuration of a metric server, as an entry of
+	// the metricServers list of the configuration file.
+	MetricServerResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "metricservers"}
+	// ElasticsearchMetricSetResource is a namespaced resource holding a metric set of an Elasticsearch metric server.
+	ElasticsearchMetricSetResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "elasticsearchmetricsets"}
+)
+
+// Status is the status of the MetricServer and ElasticsearchMetricSet resources.
+type Status struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// metricServerFrom converts a MetricServer resource into the configuration of a metric server, named after the
+// resource. It also returns the priority of the server among the MetricServer resources.
+func metricServerFrom(resource *unstructured.Unstructured) (config.MetricServer, int64, error) {
+	var metricServer config.MetricServer
+	spec, _, err := unstructured.NestedMap(resource.Object, "spec")
+	if err != nil {
+		return metricServer, 0, err
+	}
+	priority, _, err := unstructured.NestedInt64(spec, "priority")
+	if err != nil {
+		return metricServer, 0, err
+	}
+	delete(spec, "priority")
+	if err := decodeSpec(spec, &metricServer); err != nil {
+		return metricServer, 0, err
+	}
+	metricServer.Name = resource.GetName()
+	return metricServer, priority, nil
+}
+
+// metricSetFrom converts an ElasticsearchMetricSet resource into a metric set, it also returns the name of the metric
+// server the metric set is added to.
+func metricSetFrom(resource *unstructured.Unstructured) (config.MetricSet, string, error) {
+	var metricSet config.MetricSet
+	spec, _, err := unstructured.NestedMap(resource.Object, "spec")
+	if err != nil {
+		return metricSet, "", err
+	}
+	server, _, err := unstructured.NestedString(spec, "server")
+	if err != nil {
+		return metricSet, "", err
+	}
+	if len(server) == 0 {
+		return metricSet, "", fmt.Errorf("server is not set")
+	}
+	delete(spec, "server")
+	if err := decodeSpec(spec, &metricSet); err != nil {
+		return metricSet, "", err
+	}
+	return metricSet, server, nil
+}
+
+// decodeSpec decodes the spec of a resource as the configuration file is decoded, unknown fields are rejected.
+func decodeSpec(spec map[string]interface{}, out interface{}) error {
+	source, err := yaml.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(source))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("invalid spec: %w", err)
+	}
+	return nil
+}
+
+// statusOf returns the status of a resource.
+func statusOf(resource *unstructured.Unstructured) (Status, error) {
+	var status Status
+	statusMap, _, err := unstructured.NestedMap(resource.Object, "status")
+	if err != nil {
+		return status, err
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(statusMap, &status)
+	return status, err
+}
+
+// withStatus returns a copy of a resource with a new status.
+func withStatus(resource *unstructured.Unstructured, status Status) (*unstructured.Unstructured, error) {
+	statusMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return nil, err
+	}
+	updated := resource.DeepCopy()
+	if err := unstructured.SetNestedField(updated.Object, statusMap, "status"); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
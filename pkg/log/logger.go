@@ -89,6 +89,7 @@ func Configure(flagSets *pflag.FlagSet, serviceType string, serviceVersion strin
 	logs.InitLogs()
 	return func() {
 		logs.FlushLogs()
+		_ = zapLogger.Sync()
 	}
 }
 
@@ -0,0 +1,47 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package monitoring
+
+import (
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+)
+
+// WithCircuitBreakers registers the clients which use a circuit breaker.
+func (m *Server) WithCircuitBreakers(clients ...client.Interface) *Server {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.addCircuitBreakers(clients...)
+	return m
+}
+
+func (m *Server) addCircuitBreakers(clients ...client.Interface) {
+	for _, c := range clients {
+		if reporter, ok := c.(client.CircuitBreakerReporter); ok && reporter.CircuitBreaker() != nil {
+			m.circuitBreakers[c.GetConfiguration().Name] = reporter.CircuitBreaker()
+		}
+	}
+}
+
+// circuitBreakersState returns the state of the circuit breakers, by client.
+func (m *Server) circuitBreakersState() map[string]client.BreakerState {
+	states := make(map[string]client.BreakerState, len(m.circuitBreakers))
+	for name, breaker := range m.circuitBreakers {
+		states[name] = breaker.State()
+	}
+	return states
+}
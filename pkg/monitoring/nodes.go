@@ -0,0 +1,85 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+)
+
+var nodeHealthyDesc = prometheus.NewDesc(
+	"node_healthy",
+	"Whether the last request sent to a node of a metrics server succeeded",
+	[]string{"client", "node"}, nil,
+)
+
+// WithNodesReporters registers the clients which report the health of the nodes they are connected to.
+func (m *Server) WithNodesReporters(clients ...client.Interface) *Server {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.addNodesReporters(clients...)
+	return m
+}
+
+func (m *Server) addNodesReporters(clients ...client.Interface) {
+	for _, c := range clients {
+		if reporter, ok := c.(client.NodesReporter); ok {
+			m.nodesReporters[c.GetConfiguration().Name] = reporter
+		}
+	}
+}
+
+// nodesHealth returns the health of the nodes, by client. Clients which cannot report the health of their nodes are ignored.
+func (m *Server) nodesHealth() map[string][]client.NodeHealth {
+	nodes := make(map[string][]client.NodeHealth, len(m.nodesReporters))
+	for name, reporter := range m.nodesReporters {
+		health, err := reporter.NodesHealth()
+		if err != nil {
+			m.logger.Error(err, "Failed to get the health of the nodes", "client", name)
+			continue
+		}
+		nodes[name] = health
+	}
+	return nodes
+}
+
+// nodesCollector exposes the health of the nodes as Prometheus metrics.
+type nodesCollector struct {
+	server *Server
+}
+
+var _ prometheus.Collector = &nodesCollector{}
+
+func (n *nodesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeHealthyDesc
+}
+
+func (n *nodesCollector) Collect(ch chan<- prometheus.Metric) {
+	n.server.lock.RLock()
+	defer n.server.lock.RUnlock()
+	for name, nodes := range n.server.nodesHealth() {
+		for _, node := range nodes {
+			healthy := 0.0
+			if node.Healthy {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(nodeHealthyDesc, prometheus.GaugeValue, healthy, name, node.URL)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package monitoring
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
+)
+
+// RoutingExplainer explains which metric servers are queried for a metric.
+type RoutingExplainer interface {
+	ExplainRouting(metric config.RoutedMetric) registry.RoutingExplanation
+}
+
+// WithRoutingExplainer sets the explainer used by the routing debug endpoint.
+func (m *Server) WithRoutingExplainer(explainer RoutingExplainer) *Server {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.routingExplainer = explainer
+	return m
+}
+
+// routingHandler explains which routing rule matches the metric set in the query parameters, and which metric servers
+// are queried for it. The type of the metric is custom if not set.
+func (m *Server) routingHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	metric := config.RoutedMetric{
+		Type:      config.MetricType(query.Get("type")),
+		Metric:    query.Get("metric"),
+		Resource:  query.Get("resource"),
+		Namespace: query.Get("namespace"),
+	}
+	if len(metric.Type) == 0 {
+		metric.Type = config.CustomMetricType
+	}
+
+	status, response := http.StatusOK, interface{}(nil)
+	m.lock.RLock()
+	explainer := m.routingExplainer
+	m.lock.RUnlock()
+	switch {
+	case explainer == nil:
+		status, response = http.StatusServiceUnavailable, errorResponse{Error: "metrics are not served yet"}
+	case len(metric.Metric) == 0:
+		status, response = http.StatusBadRequest, errorResponse{Error: "metric is not set"}
+	case metric.Type != config.CustomMetricType && metric.Type != config.ExternalMetricType:
+		status, response = http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unknown metric type: %s", metric.Type)}
+	default:
+		response = explainer.ExplainRouting(metric)
+	}
+	if err := writeJSONResponse(writer, status, response); err != nil {
+		m.logger.Error(err, "Failed to write routing explanation to client")
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -18,11 +18,13 @@
 package monitoring
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
@@ -58,6 +60,12 @@ type Counters struct {
 	ExternalMetrics map[string]int `json:"externalMetrics,omitempty"`
 }
 
+// Timestamps holds a time for each client, by metric type.
+type Timestamps struct {
+	CustomMetrics   map[string]time.Time `json:"customMetrics,omitempty"`
+	ExternalMetrics map[string]time.Time `json:"externalMetrics,omitempty"`
+}
+
 func NewCounters() *Counters {
 	return &Counters{
 		CustomMetrics:   make(map[string]int),
@@ -65,6 +73,22 @@ func NewCounters() *Counters {
 	}
 }
 
+// forType returns the counters of a metric type.
+func (c *Counters) forType(metricType config.MetricType) map[string]int {
+	if metricType == config.CustomMetricType {
+		return c.CustomMetrics
+	}
+	return c.ExternalMetrics
+}
+
+// forType returns the timestamps of a metric type.
+func (t *Timestamps) forType(metricType config.MetricType) map[string]time.Time {
+	if metricType == config.CustomMetricType {
+		return t.CustomMetrics
+	}
+	return t.ExternalMetrics
+}
+
 func NewServer(metricServers []config.MetricServer, port int, failureThreshold int) *Server {
 	if failureThreshold == 0 {
 		failureThreshold = defaultFailureThreshold
@@ -79,13 +103,20 @@ func NewServer(metricServers []config.MetricServer, port int, failureThreshold i
 		}
 	}
 	return &Server{
-		logger:           log.ForPackage("monitoring"),
-		lock:             sync.RWMutex{},
-		metricServers:    metricServers,
-		monitoringPort:   port,
-		clientFailures:   NewCounters(),
-		clientSuccesses:  clientSuccesses,
+		logger:          log.ForPackage("monitoring"),
+		lock:            sync.RWMutex{},
+		metricServers:   metricServers,
+		monitoringPort:  port,
+		clientFailures:  NewCounters(),
+		clientSuccesses: clientSuccesses,
+		lastRefresh: &Timestamps{
+			CustomMetrics:   make(map[string]time.Time),
+			ExternalMetrics: make(map[string]time.Time),
+		},
 		failureThreshold: failureThreshold,
+		nodesReporters:   make(map[string]client.NodesReporter),
+		circuitBreakers:  make(map[string]*client.CircuitBreaker),
+		httpServer:       &http.Server{Addr: fmt.Sprintf(":%d", port)},
 	}
 }
 
@@ -97,6 +128,12 @@ type Server struct {
 	failureThreshold int
 	clientFailures   *Counters
 	clientSuccesses  *Counters
+	// lastRefresh is the time of the last successful refresh of the metrics of each client.
+	lastRefresh      *Timestamps
+	nodesReporters   map[string]client.NodesReporter
+	circuitBreakers  map[string]*client.CircuitBreaker
+	routingExplainer RoutingExplainer
+	httpServer       *http.Server
 }
 
 func (m *Server) OnError(c client.Interface, metricType config.MetricType, err error) {
@@ -120,6 +157,7 @@ func (m *Server) UpdateExternalMetrics(c client.Interface, ems map[provider.Exte
 	m.clientFailures.ExternalMetrics[clientName] = 0
 	// increment success counters
 	m.clientSuccesses.ExternalMetrics[clientName]++
+	m.lastRefresh.ExternalMetrics[clientName] = time.Now()
 	clientSuccess.WithLabelValues(c.GetConfiguration().Name, string(config.ExternalMetricType)).Inc()
 	// update external metrics stats
 	metrics.WithLabelValues(c.GetConfiguration().Name, string(config.ExternalMetricType)).Set(float64(len(ems)))
@@ -133,15 +171,78 @@ func (m *Server) UpdateCustomMetrics(c client.Interface, cms map[provider.Custom
 	m.clientFailures.CustomMetrics[clientName] = 0
 	// increment success counters
 	m.clientSuccesses.CustomMetrics[clientName]++
+	m.lastRefresh.CustomMetrics[clientName] = time.Now()
 	clientSuccess.WithLabelValues(c.GetConfiguration().Name, string(config.CustomMetricType)).Inc()
 	// update custom metrics stats
 	metrics.WithLabelValues(c.GetConfiguration().Name, string(config.CustomMetricType)).Set(float64(len(cms)))
 }
 
+// UpdateMetricServers replaces the metric servers once the configuration has been reloaded. The counters of the servers
+// which are still configured are kept, the nodes and the circuit breaker of the given clients, which have been created
+// or rebuilt, replace the previous ones.
+func (m *Server) UpdateMetricServers(metricServers []config.MetricServer, clients ...client.Interface) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.metricServers = metricServers
+	names := make(map[string]struct{}, len(metricServers))
+	for _, metricType := range []config.MetricType{config.CustomMetricType, config.ExternalMetricType} {
+		configured := make(map[string]struct{})
+		for _, server := range metricServers {
+			names[server.Name] = struct{}{}
+			if !server.MetricTypes.HasType(metricType) {
+				continue
+			}
+			configured[server.Name] = struct{}{}
+			if _, exists := m.clientSuccesses.forType(metricType)[server.Name]; !exists {
+				m.clientSuccesses.forType(metricType)[server.Name] = 0
+			}
+		}
+		for name := range m.clientSuccesses.forType(metricType) {
+			if _, exists := configured[name]; exists {
+				continue
+			}
+			delete(m.clientSuccesses.forType(metricType), name)
+			delete(m.clientFailures.forType(metricType), name)
+			delete(m.lastRefresh.forType(metricType), name)
+			clientErrors.DeleteLabelValues(name, string(metricType))
+			clientSuccess.DeleteLabelValues(name, string(metricType))
+			metrics.DeleteLabelValues(name, string(metricType))
+		}
+	}
+	for name := range m.nodesReporters {
+		if _, exists := names[name]; !exists {
+			delete(m.nodesReporters, name)
+		}
+	}
+	for name := range m.circuitBreakers {
+		if _, exists := names[name]; !exists {
+			delete(m.circuitBreakers, name)
+		}
+	}
+	for _, c := range clients {
+		delete(m.nodesReporters, c.GetConfiguration().Name)
+		delete(m.circuitBreakers, c.GetConfiguration().Name)
+	}
+	m.addNodesReporters(clients...)
+	m.addCircuitBreakers(clients...)
+}
+
+// Start serves the readiness endpoint and the Prometheus metrics until Shutdown is called.
 func (m *Server) Start() {
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/readyz", m.readyHandler)
-	_ = http.ListenAndServe(fmt.Sprintf(":%d", m.monitoringPort), nil)
+	prometheus.MustRegister(&nodesCollector{server: m})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/readyz", m.readyHandler)
+	mux.HandleFunc("/debug/routing", m.routingHandler)
+	m.httpServer.Handler = mux
+	if err := m.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		m.logger.Error(err, "Monitoring server failed")
+	}
+}
+
+// Shutdown stops the monitoring server, once the in-flight requests are completed or the context is done.
+func (m *Server) Shutdown(ctx context.Context) error {
+	return m.httpServer.Shutdown(ctx)
 }
 
 func (m *Server) readyHandler(writer http.ResponseWriter, _ *http.Request) {
@@ -159,33 +260,69 @@ func (m *Server) isReadyAndHealthy() (ClientsHealthResponse, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	healthResponse := ClientsHealthResponse{ClientFailures: m.clientFailures, ClientOk: m.clientSuccesses}
+	healthResponse := ClientsHealthResponse{
+		ClientFailures:  m.clientFailures,
+		ClientOk:        m.clientSuccesses,
+		LastRefresh:     m.lastRefresh,
+		Nodes:           m.nodesHealth(),
+		CircuitBreakers: m.circuitBreakersState(),
+	}
 
 	for _, server := range m.metricServers {
-		if customMetricsSuccess, hasCustomMetrics := m.clientSuccesses.CustomMetrics[server.Name]; hasCustomMetrics && customMetricsSuccess == 0 {
-			return healthResponse, errors.New("client has not retrieved an initial set of custom metrics yet")
+		err := m.clientHealth(server)
+		if err == nil {
+			continue
 		}
-
-		if externalMetricsSuccess, hasExternalMetrics := m.clientSuccesses.ExternalMetrics[server.Name]; hasExternalMetrics && externalMetricsSuccess == 0 {
-			return healthResponse, errors.New("client has not retrieved an initial set of external metrics yet")
+		if server.IsRequired() {
+			return healthResponse, err
 		}
-
-		failures := m.clientFailures.CustomMetrics[server.Name]
-		if failures >= m.failureThreshold {
-			return healthResponse, fmt.Errorf("client got %d consecutive failures while retrieving custom metrics", failures)
-		}
-
-		failures = m.clientFailures.ExternalMetrics[server.Name]
-		if failures >= m.failureThreshold {
-			return healthResponse, fmt.Errorf("client got %d consecutive failures while retrieving external metrics", failures)
+		// A client which is not required does not make the adapter unhealthy.
+		if healthResponse.Degraded == nil {
+			healthResponse.Degraded = make(map[string]string)
 		}
+		healthResponse.Degraded[server.Name] = err.Error()
 	}
 	return healthResponse, nil
 }
 
+// clientHealth returns an error if a client has not retrieved an initial set of metrics yet, or if its last attempts to
+// retrieve them failed.
+func (m *Server) clientHealth(server config.MetricServer) error {
+	if customMetricsSuccess, hasCustomMetrics := m.clientSuccesses.CustomMetrics[server.Name]; hasCustomMetrics && customMetricsSuccess == 0 {
+		return errors.New("client has not retrieved an initial set of custom metrics yet")
+	}
+
+	if externalMetricsSuccess, hasExternalMetrics := m.clientSuccesses.ExternalMetrics[server.Name]; hasExternalMetrics && externalMetricsSuccess == 0 {
+		return errors.New("client has not retrieved an initial set of external metrics yet")
+	}
+
+	failures := m.clientFailures.CustomMetrics[server.Name]
+	if failures >= m.failureThreshold {
+		return fmt.Errorf("client got %d consecutive failures while retrieving custom metrics", failures)
+	}
+
+	failures = m.clientFailures.ExternalMetrics[server.Name]
+	if failures >= m.failureThreshold {
+		return fmt.Errorf("client got %d consecutive failures while retrieving external metrics", failures)
+	}
+	return nil
+}
+
 type ClientsHealthResponse struct {
 	ClientFailures *Counters `json:"consecutiveFailures,omitempty"`
 	ClientOk       *Counters `json:"successTotal,omitempty"`
+	// Degraded are the clients which are not required and cannot retrieve their metrics, with the reason. They do not
+	// make the adapter unhealthy.
+	Degraded map[string]string `json:"degraded,omitempty"`
+	// LastRefresh is the time of the last successful refresh of the custom and external metrics of each client, they
+	// are refreshed independently.
+	LastRefresh *Timestamps `json:"lastSuccessfulRefresh,omitempty"`
+	// Nodes is the health of the nodes of each client, a failing node does not make the adapter unhealthy as long as
+	// the client can use other nodes.
+	Nodes map[string][]client.NodeHealth `json:"nodes,omitempty"`
+	// CircuitBreakers is the state of the circuit breaker of each client. An open circuit does not make the adapter
+	// unhealthy, the client fails fast until the server recovers.
+	CircuitBreakers map[string]client.BreakerState `json:"circuitBreakers,omitempty"`
 }
 
 func writeJSONResponse(w http.ResponseWriter, code int, resp interface{}) error {
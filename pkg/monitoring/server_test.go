@@ -18,9 +18,14 @@
 package monitoring
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
@@ -30,6 +35,7 @@ import (
 
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
 )
 
 func TestServer_isReadyAndHealthy(t *testing.T) {
@@ -99,24 +105,233 @@ func (f fakeClient) GetConfiguration() config.MetricServer {
 	}
 }
 
-func (f fakeClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error) {
+func (f fakeClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
 	panic("implement me")
 }
 
-func (f fakeClient) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
+func (f fakeClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
 	panic("implement me")
 }
 
-func (f fakeClient) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+func (f fakeClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
 	panic("implement me")
 }
 
-func (f fakeClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error) {
+func (f fakeClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
 	panic("implement me")
 }
 
-func (f fakeClient) GetExternalMetric(name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+func (f fakeClient) GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
 	panic("implement me")
 }
 
 var _ client.Interface = &fakeClient{}
+
+func TestServer_isReadyAndHealthy_degraded(t *testing.T) {
+	required := false
+	server := NewServer([]config.MetricServer{
+		{
+			Name: "metric_server1",
+		},
+		{
+			Name:        "metric_server2",
+			MetricTypes: &config.MetricTypes{config.ExternalMetricType},
+			Required:    &required,
+		},
+	}, 1234, 0)
+	server.UpdateCustomMetrics(newFakeClient("metric_server1"), nil)
+	server.UpdateExternalMetrics(newFakeClient("metric_server1"), nil)
+
+	// server2 is not required, it does not make the adapter unhealthy
+	health, err := server.isReadyAndHealthy()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"metric_server2": "client has not retrieved an initial set of external metrics yet"}, health.Degraded)
+
+	server.UpdateExternalMetrics(newFakeClient("metric_server2"), nil)
+	health, err = server.isReadyAndHealthy()
+	assert.NoError(t, err)
+	assert.Empty(t, health.Degraded)
+
+	for i := 0; i < defaultFailureThreshold; i++ {
+		server.OnError(newFakeClient("metric_server2"), config.ExternalMetricType, errors.New("error"))
+	}
+	health, err = server.isReadyAndHealthy()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"metric_server2": "client got 3 consecutive failures while retrieving external metrics"}, health.Degraded)
+
+	// server1 is required
+	for i := 0; i < defaultFailureThreshold; i++ {
+		server.OnError(newFakeClient("metric_server1"), config.CustomMetricType, errors.New("error"))
+	}
+	_, err = server.isReadyAndHealthy()
+	assert.Error(t, err)
+}
+
+func TestServer_nodesHealth(t *testing.T) {
+	server := NewServer([]config.MetricServer{
+		{
+			Name:        "metric_server1",
+			MetricTypes: &config.MetricTypes{config.CustomMetricType},
+		},
+	}, 1234, 0)
+	server.WithNodesReporters(&fakeNodesClient{
+		fakeClient: fakeClient{name: "metric_server1"},
+		nodes: []client.NodeHealth{
+			{URL: "https://es-0:9200", Healthy: true},
+			{URL: "https://es-1:9200", Healthy: false, Failures: 3},
+		},
+	}, newFakeClient("metric_server2"))
+	server.UpdateCustomMetrics(newFakeClient("metric_server1"), nil)
+
+	// A failing node does not make the adapter unhealthy.
+	health, err := server.isReadyAndHealthy()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]client.NodeHealth{
+		"metric_server1": {
+			{URL: "https://es-0:9200", Healthy: true},
+			{URL: "https://es-1:9200", Healthy: false, Failures: 3},
+		},
+	}, health.Nodes)
+
+	assert.NoError(t, testutil.CollectAndCompare(&nodesCollector{server: server}, strings.NewReader(`
+# HELP node_healthy Whether the last request sent to a node of a metrics server succeeded
+# TYPE node_healthy gauge
+node_healthy{client="metric_server1",node="https://es-0:9200"} 1
+node_healthy{client="metric_server1",node="https://es-1:9200"} 0
+`)))
+}
+
+type fakeNodesClient struct {
+	fakeClient
+	nodes []client.NodeHealth
+}
+
+func (f *fakeNodesClient) NodesHealth() ([]client.NodeHealth, error) {
+	return f.nodes, nil
+}
+
+func TestServer_circuitBreakers(t *testing.T) {
+	metricServer := config.MetricServer{
+		Name:           "metric_server1",
+		MetricTypes:    &config.MetricTypes{config.CustomMetricType},
+		CircuitBreaker: &config.CircuitBreaker{FailureThreshold: 1},
+	}
+	server := NewServer([]config.MetricServer{metricServer}, 1234, 0)
+	breaker := client.NewCircuitBreaker(metricServer)
+	server.WithCircuitBreakers(&fakeBreakerClient{
+		fakeClient: fakeClient{name: "metric_server1"},
+		breaker:    breaker,
+	}, newFakeClient("metric_server2"))
+	server.UpdateCustomMetrics(newFakeClient("metric_server1"), nil)
+	breaker.Record(false)
+
+	// An open circuit does not make the adapter unhealthy.
+	health, err := server.isReadyAndHealthy()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]client.BreakerState{"metric_server1": client.BreakerOpen}, health.CircuitBreakers)
+}
+
+func TestServer_UpdateMetricServers(t *testing.T) {
+	server := NewServer([]config.MetricServer{
+		{
+			Name:        "metric_server1",
+			MetricTypes: &config.MetricTypes{config.CustomMetricType},
+		},
+		{
+			Name:        "metric_server2",
+			MetricTypes: &config.MetricTypes{config.CustomMetricType},
+		},
+	}, 1234, 0)
+	server.WithNodesReporters(&fakeNodesClient{fakeClient: fakeClient{name: "metric_server2"}})
+	server.UpdateCustomMetrics(newFakeClient("metric_server1"), nil)
+	server.UpdateCustomMetrics(newFakeClient("metric_server2"), nil)
+	_, err := server.isReadyAndHealthy()
+	assert.NoError(t, err)
+
+	// metric_server2 is removed, metric_server3 is added.
+	server.UpdateMetricServers([]config.MetricServer{
+		{
+			Name:        "metric_server1",
+			MetricTypes: &config.MetricTypes{config.CustomMetricType},
+		},
+		{
+			Name:        "metric_server3",
+			MetricTypes: &config.MetricTypes{config.ExternalMetricType},
+		},
+	}, &fakeNodesClient{fakeClient: fakeClient{name: "metric_server3"}})
+	health, err := server.isReadyAndHealthy()
+	assert.Error(t, err, "metric_server3 has not retrieved its external metrics yet")
+	assert.Equal(t, map[string]int{"metric_server1": 1}, health.ClientOk.CustomMetrics)
+	assert.Equal(t, map[string]int{"metric_server3": 0}, health.ClientOk.ExternalMetrics)
+	assert.Contains(t, health.Nodes, "metric_server3")
+	assert.NotContains(t, health.Nodes, "metric_server2")
+
+	server.UpdateExternalMetrics(newFakeClient("metric_server3"), nil)
+	_, err = server.isReadyAndHealthy()
+	assert.NoError(t, err)
+}
+
+type fakeBreakerClient struct {
+	fakeClient
+	breaker *client.CircuitBreaker
+}
+
+func (f *fakeBreakerClient) CircuitBreaker() *client.CircuitBreaker {
+	return f.breaker
+}
+
+type fakeRoutingExplainer struct{}
+
+func (f fakeRoutingExplainer) ExplainRouting(metric config.RoutedMetric) registry.RoutingExplanation {
+	return registry.RoutingExplanation{Metric: metric, Servers: []string{"metric_server1"}, Queried: []string{"metric_server1"}}
+}
+
+func TestServer_routingHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		explainer  RoutingExplainer
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "explain custom metric",
+			explainer:  fakeRoutingExplainer{},
+			query:      "metric=kibana.stats.load&resource=pods&namespace=default",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"metric":{"type":"custom","metric":"kibana.stats.load","resource":"pods","namespace":"default"},"servers":["metric_server1"],"queried":["metric_server1"],"reason":""}`,
+		},
+		{
+			name:       "metric not set",
+			explainer:  fakeRoutingExplainer{},
+			query:      "type=external",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"metric is not set"}`,
+		},
+		{
+			name:       "unknown metric type",
+			explainer:  fakeRoutingExplainer{},
+			query:      "type=resource&metric=cpu",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"unknown metric type: resource"}`,
+		},
+		{
+			name:       "metrics not served yet",
+			query:      "metric=kibana.stats.load",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   `{"error":"metrics are not served yet"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(nil, 1234, 0)
+			if tt.explainer != nil {
+				server.WithRoutingExplainer(tt.explainer)
+			}
+			recorder := httptest.NewRecorder()
+			server.routingHandler(recorder, httptest.NewRequest(http.MethodGet, "/debug/routing?"+tt.query, nil))
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+			assert.JSONEq(t, tt.wantBody, recorder.Body.String())
+		})
+	}
+}
@@ -18,12 +18,19 @@
 package profiling
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 )
 
-func StartProfiling(profilingPort int) {
-	// Server used for pprof
-	_ = http.ListenAndServe(fmt.Sprintf(":%d", profilingPort), nil)
+// StartProfiling serves pprof until the context is done.
+func StartProfiling(ctx context.Context, profilingPort int) {
+	// Server used for pprof, the handlers are registered in the default mux
+	server := &http.Server{Addr: fmt.Sprintf(":%d", profilingPort)}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	_ = server.ListenAndServe()
 }
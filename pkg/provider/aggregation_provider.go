@@ -30,8 +30,10 @@ import (
 
 	"go.elastic.co/apm/v2"
 
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/tracing"
 )
 
 // aggregationProvider is an implementation of provider.MetricsProvider which retrieve metrics from a set of metric clients.
@@ -53,31 +55,54 @@ func NewAggregationProvider(
 	}
 }
 
-func (p *aggregationProvider) GetMetricByName(context context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+func (p *aggregationProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	t, ctx := tracing.NewTransaction(ctx, p.tracer, "aggregation-provider", "GetMetricByName")
+	defer tracing.EndTransaction(t)
 	p.logger.V(1).Info("GetMetricByName", "name", name, "info", info, "metricSelector", metricSelector)
-	metricClient, err := p.registry.GetCustomMetricClient(info)
+	metricClients, err := p.registry.GetCustomMetricClients(info, name.Namespace)
 	if err != nil {
 		return nil, err
 	}
-	return metricClient.GetMetricByName(name, info, metricSelector)
+	return query(ctx, p, customMetricType, metricClients,
+		func(value *custom_metrics.MetricValue) bool { return value == nil },
+		func(ctx context.Context, metricClient client.Interface) (*custom_metrics.MetricValue, error) {
+			return metricClient.GetMetricByName(ctx, name, info, metricSelector)
+		},
+	)
 }
 
-func (p *aggregationProvider) GetMetricBySelector(context context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+func (p *aggregationProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	t, ctx := tracing.NewTransaction(ctx, p.tracer, "aggregation-provider", "GetMetricBySelector")
+	defer tracing.EndTransaction(t)
 	p.logger.V(1).Info("GetMetricBySelector", "namespace", namespace, "selector", selector, "info", info, "metricSelector", metricSelector)
-	metricClient, err := p.registry.GetCustomMetricClient(info)
+	metricClients, err := p.registry.GetCustomMetricClients(info, namespace)
 	if err != nil {
 		return nil, err
 	}
-	return metricClient.GetMetricBySelector(namespace, selector, info, metricSelector)
+	return query(ctx, p, customMetricType, metricClients,
+		func(values *custom_metrics.MetricValueList) bool { return values == nil || len(values.Items) == 0 },
+		func(ctx context.Context, metricClient client.Interface) (*custom_metrics.MetricValueList, error) {
+			return metricClient.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+		},
+	)
 }
 
-func (p *aggregationProvider) GetExternalMetric(context context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+func (p *aggregationProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	t, ctx := tracing.NewTransaction(ctx, p.tracer, "aggregation-provider", "GetExternalMetric")
+	defer tracing.EndTransaction(t)
 	p.logger.V(1).Info("GetExternalMetric", "namespace", namespace, "info", info, "metricSelector", metricSelector)
-	metricClient, err := p.registry.GetExternalMetricClient(info)
+	metricClients, err := p.registry.GetExternalMetricClients(info, namespace)
 	if err != nil {
 		return nil, err
 	}
-	return metricClient.GetExternalMetric(info.Metric, namespace, metricSelector)
+	return query(ctx, p, externalMetricType, metricClients,
+		func(values *external_metrics.ExternalMetricValueList) bool {
+			return values == nil || len(values.Items) == 0
+		},
+		func(ctx context.Context, metricClient client.Interface) (*external_metrics.ExternalMetricValueList, error) {
+			return metricClient.GetExternalMetric(ctx, info.Metric, namespace, metricSelector)
+		},
+	)
 }
 
 func (p *aggregationProvider) ListAllMetrics() []provider.CustomMetricInfo {
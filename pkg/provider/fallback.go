@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package provider
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.elastic.co/apm/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+)
+
+const (
+	customMetricType   = "custom"
+	externalMetricType = "external"
+
+	valueResult    = "value"
+	notFoundResult = "not_found"
+	errorResult    = "error"
+
+	// metricServerLabel is the label of the APM transaction set to the name of the metric server which answered.
+	metricServerLabel = "metric_server"
+)
+
+var responsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "provider_responses_total",
+	Help: "The number of responses returned by the provider, by metric server which answered",
+}, []string{"client", "type", "result", "fallback"})
+
+// response is the result of a query sent to a metric server.
+type response[T any] struct {
+	client   client.Interface
+	value    T
+	err      error
+	notFound bool
+}
+
+func (r *response[T]) result() string {
+	switch {
+	case r.notFound:
+		return notFoundResult
+	case r.err != nil:
+		return errorResult
+	default:
+		return valueResult
+	}
+}
+
+// query sends a query to the metric servers serving a metric, by decreasing priority, until one of them returns a
+// value or its fallback policy does not allow to query the next one. If no server returns a value, an empty result is
+// preferred over an error, else the response of the server with the highest priority is returned.
+func query[T any](
+	ctx context.Context,
+	p *aggregationProvider,
+	metricType string,
+	clients []client.Interface,
+	isEmpty func(T) bool,
+	get func(context.Context, client.Interface) (T, error),
+) (T, error) {
+	var responses []*response[T]
+	for i, metricClient := range clients {
+		queryCtx, cancel := client.WithQueryTimeout(ctx, metricClient)
+		value, err := get(queryCtx, metricClient)
+		cancel()
+		r := &response[T]{
+			client:   metricClient,
+			value:    value,
+			err:      err,
+			notFound: apierrors.IsNotFound(err) || (err == nil && isEmpty(value)),
+		}
+		responses = append(responses, r)
+		if r.err == nil && !r.notFound {
+			break
+		}
+		name := metricClient.GetConfiguration().Name
+		if i == len(clients)-1 || ctx.Err() != nil || !metricClient.GetConfiguration().Fallback.Allows(r.err, r.notFound) {
+			break
+		}
+		p.logger.Info(
+			"Metric server cannot answer, falling back to the next one",
+			"client", name,
+			"result", r.result(),
+			"error", r.err,
+			"next_client", clients[i+1].GetConfiguration().Name,
+		)
+	}
+
+	answer := responses[len(responses)-1]
+	if answer.err != nil || answer.notFound {
+		answer = responses[0]
+		for _, r := range responses {
+			if r.err == nil {
+				answer = r
+				break
+			}
+		}
+	}
+
+	name := answer.client.GetConfiguration().Name
+	p.logger.V(1).Info("Metric server answered", "client", name, "type", metricType, "result", answer.result(), "queried_clients", len(responses))
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		tx.Context.SetLabel(metricServerLabel, name)
+	}
+	responsesTotal.WithLabelValues(name, metricType, answer.result(), strconv.FormatBool(answer.client != clients[0])).Inc()
+	return answer.value, answer.err
+}
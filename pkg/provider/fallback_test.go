@@ -0,0 +1,189 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
+)
+
+var externalMetric = provider.ExternalMetricInfo{Metric: "metric"}
+
+// fakeClient serves a single external metric, it returns a value, no value or an error.
+type fakeClient struct {
+	config.MetricServer
+	value   *float64
+	err     error
+	queried int
+}
+
+var _ client.Interface = &fakeClient{}
+
+func (f *fakeClient) GetConfiguration() config.MetricServer {
+	return f.MetricServer
+}
+
+func (f *fakeClient) GetMetricByName(context.Context, types.NamespacedName, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValue, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) GetMetricBySelector(context.Context, string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) GetExternalMetric(_ context.Context, name, _ string, _ labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	f.queried++
+	if f.err != nil {
+		return nil, f.err
+	}
+	values := &external_metrics.ExternalMetricValueList{}
+	if f.value != nil {
+		values.Items = append(values.Items, external_metrics.ExternalMetricValue{
+			MetricName: name,
+			Value:      *resource.NewMilliQuantity(int64(*f.value*1000), resource.DecimalSI),
+		})
+	}
+	return values, nil
+}
+
+func (f *fakeClient) ListCustomMetricInfos(context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) ListExternalMetrics(context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	return map[provider.ExternalMetricInfo]struct{}{externalMetric: {}}, nil
+}
+
+func valueOf(v float64) *float64 {
+	return &v
+}
+
+func TestAggregationProvider_fallback(t *testing.T) {
+	backendErr := errors.New("backend error")
+	tests := []struct {
+		name string
+		// clients by decreasing priority
+		clients     []*fakeClient
+		wantValue   *float64
+		wantErr     error
+		wantQueried []int
+	}{
+		{
+			name: "preferred server answers",
+			clients: []*fakeClient{
+				{value: valueOf(1)},
+				{value: valueOf(2)},
+			},
+			wantValue:   valueOf(1),
+			wantQueried: []int{1, 0},
+		},
+		{
+			name: "fallback on error",
+			clients: []*fakeClient{
+				{err: backendErr},
+				{value: valueOf(2)},
+			},
+			wantValue:   valueOf(2),
+			wantQueried: []int{1, 1},
+		},
+		{
+			name: "fallback on no value",
+			clients: []*fakeClient{
+				{},
+				{err: backendErr},
+				{value: valueOf(3)},
+			},
+			wantValue:   valueOf(3),
+			wantQueried: []int{1, 1, 1},
+		},
+		{
+			name: "no fallback",
+			clients: []*fakeClient{
+				{MetricServer: config.MetricServer{Fallback: config.FallbackNever}, err: backendErr},
+				{value: valueOf(2)},
+			},
+			wantErr:     backendErr,
+			wantQueried: []int{1, 0},
+		},
+		{
+			name: "no fallback on no value",
+			clients: []*fakeClient{
+				{MetricServer: config.MetricServer{Fallback: config.FallbackOnError}},
+				{value: valueOf(2)},
+			},
+			wantQueried: []int{1, 0},
+		},
+		{
+			name: "no value is preferred over an error",
+			clients: []*fakeClient{
+				{err: backendErr},
+				{},
+			},
+			wantQueried: []int{1, 1},
+		},
+		{
+			name: "error of the preferred server",
+			clients: []*fakeClient{
+				{err: backendErr},
+				{err: errors.New("other error")},
+			},
+			wantErr:     backendErr,
+			wantQueried: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registry.NewRegistry()
+			for i, c := range tt.clients {
+				c.Name = string(rune('a' + i))
+				c.Priority = len(tt.clients) - i
+				r.UpdateExternalMetrics(c, map[provider.ExternalMetricInfo]struct{}{externalMetric: {}})
+			}
+			p := &aggregationProvider{logger: log.ForPackage("provider"), registry: r}
+			got, err := p.GetExternalMetric(context.Background(), "ns", labels.Everything(), externalMetric)
+			for i, c := range tt.clients {
+				assert.Equal(t, tt.wantQueried[i], c.queried, "client %s", c.Name)
+			}
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.wantValue == nil {
+				assert.Empty(t, got.Items)
+				return
+			}
+			assert.Equal(t, 1, len(got.Items))
+			assert.Equal(t, *tt.wantValue, got.Items[0].Value.AsApproximateFloat64())
+		})
+	}
+}
@@ -31,20 +31,31 @@ func newMetricClients() *metricClients {
 	return &clients
 }
 
+// priorities holds the priority of each server by name. It overrides the priority in the configuration of the clients,
+// which are not created again when only their priority is changed.
+type priorities map[string]int
+
+func (p priorities) of(metricClient client.Interface) int {
+	metricServer := metricClient.GetConfiguration()
+	if priority, ok := p[metricServer.Name]; ok {
+		return priority
+	}
+	return metricServer.Priority
+}
+
 func (c metricClients) Len() int {
 	return len(c)
 }
 
-func (c metricClients) Less(i, j int) bool {
+// sort sorts the clients by decreasing priority.
+func (c metricClients) sort(p priorities) {
 	// We want client with higher priority to be at the beginning of the array
-	return c[i].GetConfiguration().Priority > c[j].GetConfiguration().Priority
-}
-
-func (c metricClients) Swap(i, j int) {
-	c[i], c[j] = c[j], c[i]
+	sort.SliceStable(c, func(i, j int) bool {
+		return p.of(c[i]) > p.of(c[j])
+	})
 }
 
-func (c *metricClients) addOrUpdateClient(metricClient client.Interface) {
+func (c *metricClients) addOrUpdateClient(metricClient client.Interface, p priorities) {
 	found := -1
 	for i, s := range *c {
 		if s.GetConfiguration().Name == metricClient.GetConfiguration().Name {
@@ -57,7 +68,7 @@ func (c *metricClients) addOrUpdateClient(metricClient client.Interface) {
 	} else {
 		*c = append(*c, metricClient)
 	}
-	sort.Sort(c)
+	c.sort(p)
 }
 
 func (c *metricClients) removeClient(sourceName string) (empty bool) {
@@ -69,16 +80,18 @@ func (c *metricClients) removeClient(sourceName string) (empty bool) {
 		}
 	}
 	if found != -1 {
+		// Removing a client does not change the order of the other ones.
 		*c = append((*c)[:found], (*c)[found+1:]...)
-		sort.Sort(c)
 	}
 	return c.Len() == 0
 }
 
-func (c *metricClients) getBestMetricClient() (client.Interface, error) {
+// getMetricClients returns a copy of the clients, by decreasing priority.
+func (c *metricClients) getMetricClients() ([]client.Interface, error) {
 	if c.Len() == 0 {
 		return nil, fmt.Errorf("no metric backend for metric")
 	}
-	service := (*c)[0]
-	return service, nil
+	clients := make([]client.Interface, c.Len())
+	copy(clients, *c)
+	return clients, nil
 }
@@ -18,6 +18,7 @@
 package registry
 
 import (
+	"context"
 	"sync"
 
 	"k8s.io/apimachinery/pkg/labels"
@@ -54,23 +55,23 @@ func (fmc *fakeMetricsClient) GetConfiguration() config.MetricServer {
 	return fmc.MetricServer
 }
 
-func (fmc *fakeMetricsClient) GetMetricByName(types.NamespacedName, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValue, error) {
+func (fmc *fakeMetricsClient) GetMetricByName(context.Context, types.NamespacedName, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValue, error) {
 	panic("not implemented")
 }
 
-func (fmc *fakeMetricsClient) GetMetricBySelector(string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
+func (fmc *fakeMetricsClient) GetMetricBySelector(context.Context, string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
 	panic("not implemented")
 }
 
-func (fmc *fakeMetricsClient) GetExternalMetric(string, string, labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+func (fmc *fakeMetricsClient) GetExternalMetric(context.Context, string, string, labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
 	panic("not implemented")
 }
 
-func (fmc *fakeMetricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error) {
+func (fmc *fakeMetricsClient) ListCustomMetricInfos(context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
 	return fmc.customMetrics, nil
 }
 
-func (fmc *fakeMetricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error) {
+func (fmc *fakeMetricsClient) ListExternalMetrics(context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
 	return fmc.externalMetrics, nil
 }
 
@@ -29,6 +29,7 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/scheduler"
 )
@@ -42,6 +43,9 @@ type Registry struct {
 
 	customMetrics   map[provider.CustomMetricInfo]*metricClients
 	externalMetrics map[provider.ExternalMetricInfo]*metricClients
+
+	routing    config.Routing
+	priorities priorities
 }
 
 func NewRegistry() *Registry {
@@ -118,7 +122,7 @@ func (r *Registry) UpdateCustomMetrics(
 			r.customMetrics[mInfo] = newMetricClients()
 		}
 		serviceList := r.customMetrics[mInfo]
-		serviceList.addOrUpdateClient(metricClient)
+		serviceList.addOrUpdateClient(metricClient, r.priorities)
 	}
 }
 
@@ -147,7 +151,39 @@ func (r *Registry) UpdateExternalMetrics(
 			r.externalMetrics[eInfo] = newMetricClients()
 		}
 		serviceList := r.externalMetrics[eInfo]
-		serviceList.addOrUpdateClient(metricClient)
+		serviceList.addOrUpdateClient(metricClient, r.priorities)
+	}
+}
+
+// SetPriorities updates the priority of the clients of the metric servers, the clients of each metric are sorted again.
+func (r *Registry) SetPriorities(metricServers []config.MetricServer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.priorities = make(priorities, len(metricServers))
+	for _, metricServer := range metricServers {
+		r.priorities[metricServer.Name] = metricServer.Priority
+	}
+	for _, clients := range r.customMetrics {
+		clients.sort(r.priorities)
+	}
+	for _, clients := range r.externalMetrics {
+		clients.sort(r.priorities)
+	}
+}
+
+// RemoveClient removes a client from the registry, the metrics it was the only one to serve are not served anymore.
+func (r *Registry) RemoveClient(clientName string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for cm := range r.getCustomMetricsFrom(clientName) {
+		if empty := r.customMetrics[cm].removeClient(clientName); empty {
+			delete(r.customMetrics, cm)
+		}
+	}
+	for em := range r.getExternalMetricsFrom(clientName) {
+		if empty := r.externalMetrics[em].removeClient(clientName); empty {
+			delete(r.externalMetrics, em)
+		}
 	}
 }
 
@@ -171,7 +207,17 @@ func getRemovedExternalMetrics(old map[provider.ExternalMetricInfo]struct{}, new
 	return outdated
 }
 
-func (r *Registry) GetCustomMetricClient(info provider.CustomMetricInfo) (client.Interface, error) {
+func (r *Registry) GetCustomMetricClient(info provider.CustomMetricInfo, namespace string) (client.Interface, error) {
+	metricClients, err := r.GetCustomMetricClients(info, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return metricClients[0], nil
+}
+
+// GetCustomMetricClients returns the clients to query for a custom metric requested in a namespace: the server of the
+// routing rule matching the metric first, if any, then the other clients serving the metric by decreasing priority.
+func (r *Registry) GetCustomMetricClients(info provider.CustomMetricInfo, namespace string) ([]client.Interface, error) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 	var metricClients *metricClients
@@ -186,19 +232,34 @@ func (r *Registry) GetCustomMetricClient(info provider.CustomMetricInfo) (client
 				Message: fmt.Sprintf("custom metric %s is not served by any metric client", info.Metric),
 			}}
 	}
-	metricClient, err := metricClients.getBestMetricClient()
+	clients, err := metricClients.getMetricClients()
 	if err != nil {
 		return nil, fmt.Errorf("no backend for custom metric: %v", info.Metric)
 	}
+	clients, err = r.route(customRoutedMetric(info, namespace), clients)
+	if err != nil {
+		return nil, err
+	}
 	r.logger.V(1).Info(
 		"Custom metric found", "metric", info.String(),
-		"client_name", metricClient.GetConfiguration().Name,
-		"client_host", metricClient.GetConfiguration().ClientConfig.Host,
+		"client_name", clients[0].GetConfiguration().Name,
+		"client_host", clients[0].GetConfiguration().ClientConfig.Host,
+		"clients_count", len(clients),
 	)
-	return metricClient, nil
+	return clients, nil
 }
 
-func (r *Registry) GetExternalMetricClient(info provider.ExternalMetricInfo) (client.Interface, error) {
+func (r *Registry) GetExternalMetricClient(info provider.ExternalMetricInfo, namespace string) (client.Interface, error) {
+	metricClients, err := r.GetExternalMetricClients(info, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return metricClients[0], nil
+}
+
+// GetExternalMetricClients returns the clients to query for an external metric requested in a namespace: the server of
+// the routing rule matching the metric first, if any, then the other clients serving the metric by decreasing priority.
+func (r *Registry) GetExternalMetricClients(info provider.ExternalMetricInfo, namespace string) ([]client.Interface, error) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 	var metricClients *metricClients
@@ -212,16 +273,21 @@ func (r *Registry) GetExternalMetricClient(info provider.ExternalMetricInfo) (cl
 				Message: fmt.Sprintf("external metric %s is not served by any metric client", info.Metric),
 			}}
 	}
-	metricClient, err := metricClients.getBestMetricClient()
+	clients, err := metricClients.getMetricClients()
 	if err != nil {
 		return nil, fmt.Errorf("not backend for metric: %v", info.Metric)
 	}
+	clients, err = r.route(externalRoutedMetric(info, namespace), clients)
+	if err != nil {
+		return nil, err
+	}
 	r.logger.V(1).Info(
 		"External metric found", "metric", info.Metric,
-		"client_name", metricClient.GetConfiguration().Name,
-		"client_host", metricClient.GetConfiguration().ClientConfig.Host,
+		"client_name", clients[0].GetConfiguration().Name,
+		"client_host", clients[0].GetConfiguration().ClientConfig.Host,
+		"clients_count", len(clients),
 	)
-	return metricClient, nil
+	return clients, nil
 }
 
 func (r *Registry) ListAllCustomMetrics() []provider.CustomMetricInfo {
@@ -27,6 +27,7 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
 )
 
 func TestRegistry_UpdateMetrics(t *testing.T) {
@@ -80,12 +81,18 @@ func TestRegistry_UpdateMetrics(t *testing.T) {
 				)
 
 				// custom metric2 is served by client2
-				c1, err := r.GetCustomMetricClient(provider.CustomMetricInfo{Metric: "c_metric2"})
+				c1, err := r.GetCustomMetricClient(provider.CustomMetricInfo{Metric: "c_metric2"}, "")
 				assert.NoError(t, err)
 				assert.Equal(t, "client2", c1.GetConfiguration().Name, "c_metric2 should be served by client2")
+				// client1 also serves c_metric2, with a lower priority
+				cs, err := r.GetCustomMetricClients(provider.CustomMetricInfo{Metric: "c_metric2"}, "")
+				assert.NoError(t, err)
+				assert.Equal(t, 2, len(cs))
+				assert.Equal(t, "client2", cs[0].GetConfiguration().Name)
+				assert.Equal(t, "client1", cs[1].GetConfiguration().Name)
 
 				// custom metricX is served by no metric client.
-				c2, err := r.GetCustomMetricClient(provider.CustomMetricInfo{Metric: "metricX"})
+				c2, err := r.GetCustomMetricClient(provider.CustomMetricInfo{Metric: "metricX"}, "")
 				assert.Equal(t, &errors.StatusError{
 					ErrStatus: metav1.Status{
 						Status:  metav1.StatusFailure,
@@ -96,20 +103,20 @@ func TestRegistry_UpdateMetrics(t *testing.T) {
 				assert.Nil(t, c2)
 
 				// custom metric6 is served by client1
-				c6, err := r.GetCustomMetricClient(provider.CustomMetricInfo{Metric: "c_metric6"})
+				c6, err := r.GetCustomMetricClient(provider.CustomMetricInfo{Metric: "c_metric6"}, "")
 				assert.NoError(t, err)
 				assert.Equal(t, "client1", c6.GetConfiguration().Name, "c_metric6 should be served by client1")
 
 				// external metric e_metric1 and e_metric2 are served by client1
-				e1, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: "e_metric1"})
+				e1, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: "e_metric1"}, "")
 				assert.NoError(t, err)
 				assert.Equal(t, "client1", e1.GetConfiguration().Name, "e_metric1 should be  served by client1")
-				e2, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: "e_metric2"})
+				e2, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: "e_metric2"}, "")
 				assert.NoError(t, err)
 				assert.Equal(t, "client1", e2.GetConfiguration().Name, "e_metric2 should be  served by client1")
 
 				// custom metricX is served by no metric client.
-				e3, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: "e_metric3"})
+				e3, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: "e_metric3"}, "")
 				assert.Equal(t, &errors.StatusError{
 					ErrStatus: metav1.Status{
 						Status:  metav1.StatusFailure,
@@ -129,3 +136,85 @@ func TestRegistry_UpdateMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestRegistry_RemoveClient(t *testing.T) {
+	r := newFakeRegistry().
+		addExistingCustomMetrics(newFakeMetricsClient("client1", 0), "c_metric1", "c_metric2").
+		addExistingCustomMetrics(newFakeMetricsClient("client2", 1), "c_metric2").
+		addExternalCustomMetrics(newFakeMetricsClient("client1", 0), "e_metric1").
+		registry
+	r.RemoveClient("client1")
+
+	// c_metric2 is still served by client2, the other metrics are not served anymore.
+	assert.ElementsMatch(t, []provider.CustomMetricInfo{{Metric: "c_metric2"}}, r.ListAllCustomMetrics())
+	assert.Empty(t, r.ListAllExternalMetrics())
+	cs, err := r.GetCustomMetricClients(provider.CustomMetricInfo{Metric: "c_metric2"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cs))
+	assert.Equal(t, "client2", cs[0].GetConfiguration().Name)
+}
+
+func TestRegistry_SetPriorities(t *testing.T) {
+	client1, client2 := newFakeMetricsClient("client1", 0), newFakeMetricsClient("client2", 1)
+	r := newFakeRegistry().registry
+	r.UpdateCustomMetrics(client1, map[provider.CustomMetricInfo]struct{}{{Metric: "c_metric"}: {}})
+	r.UpdateCustomMetrics(client2, map[provider.CustomMetricInfo]struct{}{{Metric: "c_metric"}: {}})
+	r.UpdateExternalMetrics(client1, map[provider.ExternalMetricInfo]struct{}{{Metric: "e_metric"}: {}})
+	r.UpdateExternalMetrics(client2, map[provider.ExternalMetricInfo]struct{}{{Metric: "e_metric"}: {}})
+	names := func() []string {
+		cs, err := r.GetCustomMetricClients(provider.CustomMetricInfo{Metric: "c_metric"}, "")
+		assert.NoError(t, err)
+		es, err := r.GetExternalMetricClients(provider.ExternalMetricInfo{Metric: "e_metric"}, "")
+		assert.NoError(t, err)
+		var names []string
+		for _, c := range append(cs, es...) {
+			names = append(names, c.GetConfiguration().Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"client2", "client1", "client2", "client1"}, names())
+
+	// The clients are sorted again, the priority in their configuration is not used anymore.
+	r.SetPriorities([]config.MetricServer{{Name: "client1", Priority: 1}, {Name: "client2", Priority: 0}})
+	assert.Equal(t, []string{"client1", "client2", "client1", "client2"}, names())
+	r.UpdateCustomMetrics(client2, map[provider.CustomMetricInfo]struct{}{{Metric: "c_metric"}: {}})
+	assert.Equal(t, []string{"client1", "client2", "client1", "client2"}, names())
+}
+
+func TestRegistry_routing(t *testing.T) {
+	r := newFakeRegistry().
+		addExistingCustomMetrics(newFakeMetricsClient("client2", 1), "c_metric").
+		addExistingCustomMetrics(newFakeMetricsClient("client1", 0), "c_metric").
+		addExternalCustomMetrics(newFakeMetricsClient("client1", 0), "e_metric").
+		registry.
+		WithRouting(config.Routing{
+			{Namespace: "team-a", Server: "client1"},
+			{MetricType: config.ExternalMetricType, Server: "client2"},
+		})
+
+	// c_metric is routed to client1 in team-a, client2 is queried if client1 cannot answer
+	cs, err := r.GetCustomMetricClients(provider.CustomMetricInfo{Metric: "c_metric"}, "team-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"client1", "client2"}, clientNames(cs))
+
+	// no rule matches c_metric in other namespaces
+	cs, err = r.GetCustomMetricClients(provider.CustomMetricInfo{Metric: "c_metric"}, "team-b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"client2", "client1"}, clientNames(cs))
+
+	// e_metric is routed to client2, which does not serve it
+	_, err = r.GetExternalMetricClients(provider.ExternalMetricInfo{Metric: "e_metric"}, "team-b")
+	assert.True(t, errors.IsNotFound(err))
+	assert.EqualError(t, err, "external metric e_metric: routed to server client2 by routing rule 1, which does not serve the metric")
+
+	explanation := r.ExplainRouting(config.RoutedMetric{Type: config.CustomMetricType, Metric: "c_metric", Namespace: "team-a"})
+	assert.Equal(t, 0, *explanation.RuleIndex)
+	assert.Equal(t, "client1", explanation.Rule.Server)
+	assert.Equal(t, []string{"client2", "client1"}, explanation.Servers)
+	assert.Equal(t, []string{"client1", "client2"}, explanation.Queried)
+
+	explanation = r.ExplainRouting(config.RoutedMetric{Type: config.ExternalMetricType, Metric: "unknown"})
+	assert.Equal(t, 1, *explanation.RuleIndex)
+	assert.Empty(t, explanation.Queried)
+	assert.Equal(t, "the metric is not served by any metric server", explanation.Reason)
+}
@@ -0,0 +1,170 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+// RoutingExplanation explains which metric servers are queried for a metric.
+type RoutingExplanation struct {
+	Metric config.RoutedMetric `json:"metric"`
+	// RuleIndex is the index of the routing rule which matched the metric, nil if no rule matched.
+	RuleIndex *int                `json:"ruleIndex,omitempty"`
+	Rule      *config.RoutingRule `json:"rule,omitempty"`
+	// Servers are the metric servers serving the metric, by decreasing priority.
+	Servers []string `json:"servers"`
+	// Queried are the metric servers queried for the metric, in order.
+	Queried []string `json:"queried"`
+	Reason  string   `json:"reason"`
+}
+
+// WithRouting sets the routing rules used to select the metric servers queried for a metric.
+func (r *Registry) WithRouting(routing config.Routing) *Registry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routing = routing
+	return r
+}
+
+func customRoutedMetric(info provider.CustomMetricInfo, namespace string) config.RoutedMetric {
+	return config.RoutedMetric{
+		Type:      config.CustomMetricType,
+		Metric:    info.Metric,
+		Resource:  info.GroupResource.String(),
+		Namespace: namespace,
+	}
+}
+
+func externalRoutedMetric(info provider.ExternalMetricInfo, namespace string) config.RoutedMetric {
+	return config.RoutedMetric{
+		Type:      config.ExternalMetricType,
+		Metric:    info.Metric,
+		Namespace: namespace,
+	}
+}
+
+// route returns the clients to query for a metric, given the clients serving it by decreasing priority. A NotFound
+// error is returned if the metric is routed to a server which does not serve it.
+func (r *Registry) route(metric config.RoutedMetric, clients []client.Interface) ([]client.Interface, error) {
+	queried, explanation := r.explain(metric, clients)
+	if len(queried) == 0 {
+		return nil, &errors.StatusError{
+			ErrStatus: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusNotFound,
+				Reason:  metav1.StatusReasonNotFound,
+				Message: fmt.Sprintf("%s metric %s: %s", metric.Type, metric.Metric, explanation.Reason),
+			}}
+	}
+	if explanation.Rule != nil {
+		r.logger.V(1).Info("Metric routed", "metric", metric.Metric, "type", metric.Type, "rule", *explanation.RuleIndex, "client_name", explanation.Rule.Server)
+	}
+	return queried, nil
+}
+
+// explain returns the clients to query for a metric, the server of the first matching routing rule first, and explains
+// why. The server of the rule must serve the metric, no other server is queried otherwise.
+func (r *Registry) explain(metric config.RoutedMetric, clients []client.Interface) ([]client.Interface, RoutingExplanation) {
+	explanation := RoutingExplanation{
+		Metric:  metric,
+		Servers: clientNames(clients),
+	}
+	index, rule := r.routing.Route(metric)
+	if rule == nil {
+		explanation.Queried = explanation.Servers
+		explanation.Reason = "no routing rule matches the metric, servers are queried by decreasing priority"
+		return clients, explanation
+	}
+	explanation.RuleIndex = &index
+	explanation.Rule = rule
+	queried := make([]client.Interface, 0, len(clients))
+	for _, c := range clients {
+		if c.GetConfiguration().Name == rule.Server {
+			queried = append(queried, c)
+		}
+	}
+	if len(queried) == 0 {
+		explanation.Queried = []string{}
+		explanation.Reason = fmt.Sprintf("routed to server %s by routing rule %d, which does not serve the metric", rule.Server, index)
+		return nil, explanation
+	}
+	for _, c := range clients {
+		if c.GetConfiguration().Name != rule.Server {
+			queried = append(queried, c)
+		}
+	}
+	explanation.Queried = clientNames(queried)
+	explanation.Reason = fmt.Sprintf("routed to server %s by routing rule %d, other servers are queried by decreasing priority if it cannot answer", rule.Server, index)
+	return queried, explanation
+}
+
+// ExplainRouting explains which metric servers are queried for a metric. The metric is looked up by name, and by
+// resource for a custom metric, regardless of whether it is namespaced.
+func (r *Registry) ExplainRouting(metric config.RoutedMetric) RoutingExplanation {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var clients []client.Interface
+	switch metric.Type {
+	case config.CustomMetricType:
+		groupResource := schema.ParseGroupResource(metric.Resource)
+		for _, namespaced := range []bool{true, false} {
+			info := provider.CustomMetricInfo{GroupResource: groupResource, Namespaced: namespaced, Metric: metric.Metric}
+			if metricClients, ok := r.customMetrics[info]; ok {
+				clients, _ = metricClients.getMetricClients()
+				break
+			}
+		}
+	case config.ExternalMetricType:
+		if metricClients, ok := r.externalMetrics[provider.ExternalMetricInfo{Metric: metric.Metric}]; ok {
+			clients, _ = metricClients.getMetricClients()
+		}
+	}
+	if len(clients) == 0 {
+		explanation := RoutingExplanation{
+			Metric:  metric,
+			Servers: []string{},
+			Queried: []string{},
+			Reason:  "the metric is not served by any metric server",
+		}
+		if index, rule := r.routing.Route(metric); rule != nil {
+			explanation.RuleIndex = &index
+			explanation.Rule = rule
+		}
+		return explanation
+	}
+	_, explanation := r.explain(metric, clients)
+	return explanation
+}
+
+func clientNames(clients []client.Interface) []string {
+	names := make([]string, len(clients))
+	for i, c := range clients {
+		names[i] = c.GetConfiguration().Name
+	}
+	return names
+}
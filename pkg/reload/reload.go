@@ -0,0 +1,367 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package reload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/log"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/monitoring"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/scheduler"
+)
+
+// closeTimeout is how long the in-flight requests of the clients of the removed or changed metric servers are awaited.
+const closeTimeout = 10 * time.Second
+
+var (
+	reloadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_timestamp_seconds",
+		Help: "The time of the last reload of the configuration",
+	})
+	reloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_success",
+		Help: "Whether the last reload of the configuration succeeded",
+	})
+)
+
+// NewClientFunc creates the client of a metric server.
+type NewClientFunc func(metricServer config.MetricServer) (client.Interface, error)
+
+// Reloader applies a new configuration to the running adapter. Only the metric servers which have been added, removed
+// or changed are started, stopped or rebuilt, the other ones keep on serving their metrics.
+type Reloader struct {
+	logger    logr.Logger
+	newClient NewClientFunc
+
+	scheduler  *scheduler.Scheduler
+	registry   *registry.Registry
+	monitoring *monitoring.Server
+
+	lock sync.Mutex
+	// file is the latest valid configuration read from the configuration file.
+	file *config.Config
+	// resources are the metric servers read from MetricServer resources, they have a higher priority than the servers of
+	// the configuration file.
+	resources []config.MetricServer
+	// config is the configuration applied, the configuration file with the metric servers of the resources.
+	config *config.Config
+	// clients are the clients of the metric servers, by name, before they are wrapped in a cache.
+	clients map[string]client.Interface
+}
+
+// NewReloader creates a reloader for the current configuration, and the clients created from it.
+func NewReloader(
+	current *config.Config,
+	clients []client.Interface,
+	newClient NewClientFunc,
+	metricsScheduler *scheduler.Scheduler,
+	metricsRegistry *registry.Registry,
+	monitoringServer *monitoring.Server,
+) *Reloader {
+	r := &Reloader{
+		logger:     log.ForPackage("reload"),
+		newClient:  newClient,
+		scheduler:  metricsScheduler,
+		registry:   metricsRegistry,
+		monitoring: monitoringServer,
+		file:       current,
+		config:     current,
+		clients:    make(map[string]client.Interface, len(clients)),
+	}
+	for _, c := range clients {
+		r.clients[c.GetConfiguration().Name] = c
+	}
+	return r
+}
+
+// Clients returns the clients of the metric servers currently configured, before they are wrapped in a cache.
+func (r *Reloader) Clients() []client.Interface {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	clients := make([]client.Interface, 0, len(r.clients))
+	for _, metricServer := range r.config.MetricServers {
+		if c, exists := r.clients[metricServer.Name]; exists {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// Watch reloads the configuration, a file or a directory, each time it is updated, until the context is done. The
+// directory of a file is watched, since a file mounted from a ConfigMap is updated by replacing a symbolic link.
+func (r *Reloader) Watch(ctx context.Context, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	directory := path
+	if !info.IsDir() {
+		directory = filepath.Dir(path)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(directory); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) {
+					continue
+				}
+				r.logger.V(1).Info("Reloading configuration", "event", event.String())
+				if err := r.reloadFile(ctx, path); err != nil {
+					r.logger.Error(err, "Failed to reload configuration, the previous one is kept", "path", path)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.logger.Error(err, "Error while watching configuration", "path", path)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadFile reads the configuration files and reloads them.
+func (r *Reloader) reloadFile(ctx context.Context, path string) error {
+	file, err := load(path)
+	if err != nil {
+		err = fmt.Errorf("invalid configuration: %w", err)
+		recordReload(err)
+		return err
+	}
+	return r.reloadConfig(ctx, file)
+}
+
+// load reads the configuration files, an empty file is likely being written and is rejected.
+func load(path string) (*config.Config, error) {
+	files, err := config.Files(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() == 0 {
+			return nil, fmt.Errorf("%s: configuration file is empty", file)
+		}
+	}
+	return config.Load(path)
+}
+
+// Reload validates a new configuration and applies it. An invalid configuration, or a configuration for which a client
+// cannot be created, is rejected and the current one is kept.
+func (r *Reloader) Reload(ctx context.Context, source []byte) error {
+	if len(bytes.TrimSpace(source)) == 0 {
+		// The file is likely being written.
+		err := errors.New("configuration file is empty")
+		recordReload(err)
+		return err
+	}
+	file, err := config.From(source)
+	if err != nil {
+		err = fmt.Errorf("invalid configuration: %w", err)
+		recordReload(err)
+		return err
+	}
+	return r.reloadConfig(ctx, file)
+}
+
+// reloadConfig applies a new configuration read from the configuration files.
+func (r *Reloader) reloadConfig(ctx context.Context, file *config.Config) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.reload(ctx, file)
+	recordReload(err)
+	return err
+}
+
+// recordReload records the result of a reload.
+func recordReload(err error) {
+	reloadTimestamp.SetToCurrentTime()
+	if err != nil {
+		reloadSuccess.Set(0)
+		return
+	}
+	reloadSuccess.Set(1)
+}
+
+func (r *Reloader) reload(ctx context.Context, file *config.Config) error {
+	next, err := file.WithMetricServers(r.resources...)
+	if err != nil {
+		return fmt.Errorf("configuration conflicts with the metric server resources: %w", err)
+	}
+	if err := r.apply(ctx, next); err != nil {
+		return err
+	}
+	r.file = file
+	return nil
+}
+
+// ValidateResource validates a metric server read from a resource, with the servers of the configuration file.
+func (r *Reloader) ValidateResource(metricServer config.MetricServer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, err := r.file.WithMetricServers(metricServer)
+	return err
+}
+
+// ReloadResources applies the metric servers read from the resources, in increasing priority, with the servers of the
+// configuration file.
+func (r *Reloader) ReloadResources(ctx context.Context, metricServers []config.MetricServer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.reloadResources(ctx, metricServers)
+	recordReload(err)
+	return err
+}
+
+func (r *Reloader) reloadResources(ctx context.Context, metricServers []config.MetricServer) error {
+	next, err := r.file.WithMetricServers(metricServers...)
+	if err != nil {
+		return fmt.Errorf("invalid metric server resources: %w", err)
+	}
+	if err := r.apply(ctx, next); err != nil {
+		return err
+	}
+	r.resources = metricServers
+	return nil
+}
+
+// apply starts, stops or rebuilds the metric servers which have been added, removed or changed in the next
+// configuration.
+func (r *Reloader) apply(ctx context.Context, next *config.Config) error {
+	diff, err := config.DiffMetricServers(r.config.MetricServers, next.MetricServers)
+	if err != nil {
+		return err
+	}
+
+	// The clients are created first, nothing is changed if one of them cannot be created.
+	created := make(map[string]client.Interface, len(diff.Added)+len(diff.Changed))
+	for _, metricServers := range [][]config.MetricServer{diff.Added, diff.Changed} {
+		for _, metricServer := range metricServers {
+			c, err := r.newClient(metricServer)
+			if err != nil {
+				return errors.Join(fmt.Errorf("%s: %w", metricServer.Name, err), closeClients(ctx, values(created)))
+			}
+			created[metricServer.Name] = c
+		}
+	}
+
+	// The metrics of the removed and changed servers are not served until the new clients have listed them.
+	var previous []client.Interface
+	for _, metricServers := range [][]config.MetricServer{diff.Removed, diff.Changed} {
+		for _, metricServer := range metricServers {
+			r.scheduler.RemoveClient(metricServer.Name)
+			r.registry.RemoveClient(metricServer.Name)
+			if c, exists := r.clients[metricServer.Name]; exists {
+				previous = append(previous, c)
+				delete(r.clients, metricServer.Name)
+			}
+		}
+	}
+	r.registry.WithRouting(next.Routing)
+	r.registry.SetPriorities(next.MetricServers)
+	clients := values(created)
+	r.monitoring.UpdateMetricServers(next.MetricServers, clients...)
+	for _, c := range clients {
+		r.clients[c.GetConfiguration().Name] = c
+		r.scheduler.AddClient(client.NewCachedClient(c))
+	}
+
+	if err := closeClients(ctx, previous); err != nil {
+		r.logger.Error(err, "Failed to close the clients of the previous configuration")
+	}
+
+	// Settings which are only read at startup are not reloaded.
+	if next.ReadinessProbe != r.config.ReadinessProbe || next.GetInitialSyncTimeout() != r.config.GetInitialSyncTimeout() {
+		r.logger.Info("Readiness probe and initial sync timeout cannot be reloaded, the adapter must be restarted to apply them")
+		next.ReadinessProbe = r.config.ReadinessProbe
+		next.InitialSyncTimeout = r.config.InitialSyncTimeout
+	}
+	r.config = next
+
+	if diff.IsEmpty() {
+		r.logger.V(1).Info("Configuration reloaded, no metric server has been changed")
+		return nil
+	}
+	r.logger.Info("Configuration reloaded",
+		"added", names(diff.Added),
+		"removed", names(diff.Removed),
+		"changed", names(diff.Changed),
+		"reprioritized", names(diff.Reprioritized),
+	)
+	return nil
+}
+
+// closeClients releases the resources held by clients which are not used anymore, within closeTimeout.
+func closeClients(ctx context.Context, clients []client.Interface) error {
+	ctx, cancel := context.WithTimeout(ctx, closeTimeout)
+	defer cancel()
+	return client.Close(ctx, clients...)
+}
+
+// values returns the clients sorted by name.
+func values(clients map[string]client.Interface) []client.Interface {
+	result := make([]client.Interface, 0, len(clients))
+	for _, c := range clients {
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetConfiguration().Name < result[j].GetConfiguration().Name
+	})
+	return result
+}
+
+func names(metricServers []config.MetricServer) []string {
+	result := make([]string, len(metricServers))
+	for i := range metricServers {
+		result[i] = metricServers[i].Name
+	}
+	return result
+}
@@ -0,0 +1,317 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/monitoring"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/registry"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/scheduler"
+)
+
+const initialConfig = `
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+  - name: b
+    serverType: custom
+    clientConfig:
+      host: https://b
+`
+
+// fakeClient serves a single external metric named after the client.
+type fakeClient struct {
+	config.MetricServer
+	closed bool
+}
+
+var _ client.Interface = &fakeClient{}
+
+func (f *fakeClient) GetConfiguration() config.MetricServer {
+	return f.MetricServer
+}
+
+func (f *fakeClient) GetMetricByName(context.Context, types.NamespacedName, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValue, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) GetMetricBySelector(context.Context, string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) GetExternalMetric(context.Context, string, string, labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) ListCustomMetricInfos(context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) ListExternalMetrics(context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	return map[provider.ExternalMetricInfo]struct{}{{Metric: f.Name}: {}}, nil
+}
+
+func (f *fakeClient) Close(context.Context) error {
+	f.closed = true
+	return nil
+}
+
+// fakeFactory creates fake clients and records them, it fails for the servers with the host https://invalid.
+type fakeFactory struct {
+	lock    sync.Mutex
+	clients []*fakeClient
+}
+
+func (f *fakeFactory) newClient(metricServer config.MetricServer) (client.Interface, error) {
+	if metricServer.ClientConfig.Host == "https://invalid" {
+		return nil, errors.New("cannot create client")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := &fakeClient{MetricServer: metricServer}
+	f.clients = append(f.clients, c)
+	return c, nil
+}
+
+func (f *fakeFactory) created() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var created []string
+	for _, c := range f.clients {
+		created = append(created, c.Name)
+	}
+	return created
+}
+
+func newReloader(t *testing.T, ctx context.Context) (*Reloader, *fakeFactory, *registry.Registry) {
+	t.Helper()
+	cfg, err := config.From([]byte(initialConfig))
+	assert.NoError(t, err)
+	factory := &fakeFactory{}
+	var clients []client.Interface
+	for _, metricServer := range cfg.MetricServers {
+		c, err := factory.newClient(metricServer)
+		assert.NoError(t, err)
+		clients = append(clients, c)
+	}
+	metricsRegistry := registry.NewRegistry()
+	monitoringServer := monitoring.NewServer(cfg.MetricServers, 0, 0)
+	metricsScheduler := scheduler.NewScheduler(clients...).
+		WithMetricListeners(monitoringServer, metricsRegistry).
+		WithErrorListeners(monitoringServer).
+		Start(ctx)
+	return NewReloader(cfg, clients, factory.newClient, metricsScheduler, metricsRegistry, monitoringServer), factory, metricsRegistry
+}
+
+// servedBy returns the name of the client serving an external metric, or an empty string if the metric is not served.
+func servedBy(r *registry.Registry, metric string) string {
+	c, err := r.GetExternalMetricClient(provider.ExternalMetricInfo{Metric: metric}, "")
+	if err != nil {
+		return ""
+	}
+	return c.GetConfiguration().Name
+}
+
+func TestReloader_Reload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader, factory, metricsRegistry := newReloader(t, ctx)
+	assert.Eventually(t, func() bool {
+		return servedBy(metricsRegistry, "a") == "a" && servedBy(metricsRegistry, "b") == "b"
+	}, 5*time.Second, 10*time.Millisecond)
+	initialClients := factory.clients
+
+	// a is unchanged, b is removed and c is added.
+	err := reloader.Reload(ctx, []byte(`
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+  - name: c
+    serverType: custom
+    clientConfig:
+      host: https://c
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(reloadSuccess))
+	assert.Equal(t, []string{"a", "b", "c"}, factory.created())
+	assert.False(t, initialClients[0].closed, "unchanged client should not be closed")
+	assert.True(t, initialClients[1].closed, "removed client should be closed")
+	assert.Eventually(t, func() bool {
+		return servedBy(metricsRegistry, "c") == "c"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "", servedBy(metricsRegistry, "b"))
+	assert.Equal(t, "a", servedBy(metricsRegistry, "a"))
+
+	// c is changed and rebuilt.
+	err = reloader.Reload(ctx, []byte(`
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+  - name: c
+    serverType: custom
+    queryTimeout: 5s
+    clientConfig:
+      host: https://c
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "c"}, factory.created())
+	assert.True(t, factory.clients[2].closed, "changed client should be closed")
+	assert.Eventually(t, func() bool {
+		return servedBy(metricsRegistry, "c") == "c"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []client.Interface{factory.clients[0], factory.clients[3]}, reloader.Clients())
+
+	// Invalid configurations are rejected, the current one is kept.
+	for _, source := range []string{
+		"",
+		"metricServers: [",
+		`
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://invalid
+`,
+		`
+metricServers:
+  - name: a
+    serverType: elasticsearch
+    clientConfig:
+      host: https://a
+    metricSets:
+      - indices: [ 'metrics-*' ]
+        fields:
+          - name: broken
+            search:
+              body: '{ "query": {{ .Unclosed '
+              metricPath: ".value"
+              timestampPath: ".timestamp"
+`,
+	} {
+		assert.Error(t, reloader.Reload(ctx, []byte(source)))
+		assert.Equal(t, 0.0, testutil.ToFloat64(reloadSuccess))
+	}
+	assert.Equal(t, []client.Interface{factory.clients[0], factory.clients[3]}, reloader.Clients())
+	assert.False(t, factory.clients[0].closed)
+	assert.Equal(t, "a", servedBy(metricsRegistry, "a"))
+}
+
+func TestReloader_ReloadResources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader, factory, metricsRegistry := newReloader(t, ctx)
+	resource := config.MetricServer{
+		Name:         "r",
+		ServerType:   "custom",
+		ClientConfig: config.HTTPClientConfig{Host: "https://r"},
+	}
+	assert.NoError(t, reloader.ValidateResource(resource))
+	assert.EqualError(t, reloader.ValidateResource(config.MetricServer{Name: "a", ServerType: "custom", ClientConfig: resource.ClientConfig}), "a: duplicate metric server name")
+
+	assert.NoError(t, reloader.ReloadResources(ctx, []config.MetricServer{resource}))
+	assert.Equal(t, []string{"a", "b", "r"}, factory.created())
+	assert.Eventually(t, func() bool {
+		return servedBy(metricsRegistry, "r") == "r"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The servers of the resources are kept when the configuration file is reloaded.
+	assert.NoError(t, reloader.Reload(ctx, []byte(`
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+`)))
+	// r is not rebuilt since only its priority has changed.
+	assert.Equal(t, []string{"a", "b", "r"}, factory.created())
+	assert.Equal(t, []client.Interface{factory.clients[0], factory.clients[2]}, reloader.Clients())
+	// A configuration file which conflicts with the resources is rejected.
+	assert.Error(t, reloader.Reload(ctx, []byte(`
+metricServers:
+  - name: r
+    serverType: custom
+    clientConfig:
+      host: https://a
+`)))
+
+	assert.NoError(t, reloader.ReloadResources(ctx, nil))
+	assert.True(t, factory.clients[2].closed, "server of the deleted resource should be closed")
+	assert.Equal(t, []client.Interface{factory.clients[0]}, reloader.Clients())
+}
+
+// TestReloader_Watch updates the configuration file as a ConfigMap volume does: the files are written in a new
+// directory, and a symbolic link to the directory is replaced. Either the file or the directory is watched.
+func TestReloader_Watch(t *testing.T) {
+	for _, watchDirectory := range []bool{false, true} {
+		t.Run(fmt.Sprintf("directory=%t", watchDirectory), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dir := t.TempDir()
+			writeVersion := func(version, source string) {
+				assert.NoError(t, os.Mkdir(filepath.Join(dir, version), 0o755))
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, version, "config.yml"), []byte(source), 0o644))
+				assert.NoError(t, os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+				assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+			}
+			writeVersion("..v1", initialConfig)
+			path := filepath.Join(dir, "config.yml")
+			assert.NoError(t, os.Symlink(filepath.Join("..data", "config.yml"), path))
+			if watchDirectory {
+				path = dir
+			}
+
+			reloader, factory, _ := newReloader(t, ctx)
+			assert.NoError(t, reloader.Watch(ctx, path))
+			writeVersion("..v2", `
+metricServers:
+  - name: a
+    serverType: custom
+    clientConfig:
+      host: https://a
+`)
+			assert.Eventually(t, func() bool {
+				return len(reloader.Clients()) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, []string{"a", "b"}, factory.created(), "unchanged client should not be rebuilt")
+		})
+	}
+}
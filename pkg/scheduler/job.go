@@ -18,10 +18,15 @@
 package scheduler
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
 	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
@@ -29,7 +34,14 @@ import (
 )
 
 type Job interface {
-	start()
+	// start refreshes the metrics until the context is done.
+	start(ctx context.Context)
+	// stop stops refreshing the metrics, wait blocks until the job is stopped.
+	stop()
+	// synced is closed once the client has listed each type of metrics it serves.
+	synced() <-chan struct{}
+	// wait blocks until the job is stopped.
+	wait()
 	GetClient() client.Interface
 	WithMetricListeners(listeners ...MetricListener) Job
 	WithErrorListeners(listeners ...ErrorListener) Job
@@ -37,91 +49,196 @@ type Job interface {
 
 var _ Job = &metricJob{}
 
-func newMetricJob(c client.Interface, wg *sync.WaitGroup) Job {
-	return &metricJob{
+var (
+	refreshTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metrics_last_refresh_timestamp_seconds",
+		Help: "The time of the last refresh of the list of the metrics served by a metrics server",
+	}, []string{"client", "type"})
+	refreshSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metrics_last_refresh_success",
+		Help: "Whether the last refresh of the list of the metrics served by a metrics server succeeded",
+	}, []string{"client", "type"})
+)
+
+func newMetricJob(c client.Interface) Job {
+	job := &metricJob{
 		logger: log.ForPackage("job"),
 		c:      c,
-		wg:     wg,
+		wg:     &sync.WaitGroup{},
+		done:   make(chan struct{}),
+	}
+	for _, metricType := range []config.MetricType{config.CustomMetricType, config.ExternalMetricType} {
+		if c.GetConfiguration().MetricTypes.HasType(metricType) {
+			job.discoveries = append(job.discoveries, &discovery{metricType: metricType})
+		}
 	}
+	// The initial sync of each metric type is awaited.
+	job.wg.Add(len(job.discoveries))
+	return job
 }
 
 type metricJob struct {
 	logger         logr.Logger
 	c              client.Interface
 	wg             *sync.WaitGroup
-	syncDone       sync.Once
+	done           chan struct{}
+	cancel         context.CancelFunc
+	running        sync.WaitGroup
+	discoveries    []*discovery
 	listeners      []MetricListener
 	errorListeners []ErrorListener
 }
 
-func (m *metricJob) start() {
+// discovery is the state of the refresh of the metrics of a given type, custom and external metrics are refreshed
+// independently.
+type discovery struct {
+	metricType config.MetricType
+	syncDone   sync.Once
+	// failures is the number of consecutive failed refreshes.
+	failures int
+}
+
+func (m *metricJob) start(ctx context.Context) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	for _, d := range m.discoveries {
+		m.running.Add(1)
+		go func(d *discovery) {
+			defer m.running.Done()
+			m.run(ctx, d)
+		}(d)
+	}
 	go func() {
-		// Attempt to get a first set of metrics
-		m.refreshMetrics()
-		dateTicker := time.NewTicker(1 * time.Minute)
-		for range dateTicker.C {
-			m.refreshMetrics()
-		}
+		m.wg.Wait()
+		close(m.done)
 	}()
 }
 
-func (m *metricJob) refreshMetrics() {
-	if m.GetClient().GetConfiguration().MetricTypes.HasType(config.CustomMetricType) {
-		customMetrics, err := m.c.ListCustomMetricInfos()
-		if err != nil {
-			m.logger.Error(err,
-				"Failed to update custom metric list",
-				"client_name", m.GetClient().GetConfiguration().Name,
-				"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
-			)
-			m.publishError(config.CustomMetricType, err)
+func (m *metricJob) stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+func (m *metricJob) wait() {
+	m.running.Wait()
+}
+
+func (m *metricJob) synced() <-chan struct{} {
+	return m.done
+}
+
+// run refreshes the metrics of a given type until the context is done.
+func (m *metricJob) run(ctx context.Context, d *discovery) {
+	for {
+		err := m.refreshMetrics(ctx, d.metricType)
+		if ctx.Err() != nil {
 			return
 		}
-
+		if err != nil {
+			d.failures++
+		} else {
+			d.failures = 0
+			d.syncDone.Do(func() {
+				m.logger.V(1).Info(
+					"First sync successful",
+					"type", d.metricType,
+					"client_name", m.GetClient().GetConfiguration().Name,
+					"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
+				)
+				m.wg.Done()
+			})
+		}
+		delay := nextRefresh(m.GetClient().GetConfiguration().Refresh, d.failures, rand.Float64)
 		m.logger.V(1).Info(
-			"Refreshed custom metrics",
-			"count", len(customMetrics),
+			"Scheduled next metrics refresh",
+			"type", d.metricType,
+			"delay", delay,
+			"consecutive_failures", d.failures,
 			"client_name", m.GetClient().GetConfiguration().Name,
-			"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
 		)
-
-		for _, listener := range m.listeners {
-			listener.UpdateCustomMetrics(m.c, customMetrics)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
 		}
 	}
+}
 
-	if m.GetClient().GetConfiguration().MetricTypes.HasType(config.ExternalMetricType) {
-		externalMetrics, err := m.c.ListExternalMetrics()
-		if err != nil {
-			m.logger.Error(err,
-				"Failed to update external metric list",
-				"client_name", m.GetClient().GetConfiguration().Name,
-				"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
-			)
-			m.publishError(config.ExternalMetricType, err)
-			return
+// nextRefresh returns the delay before the next refresh: the refresh interval, or an exponential backoff after
+// consecutive failures. The backoff is reset as soon as a refresh succeeds. random returns a number in [0, 1) used to
+// apply the jitter.
+func nextRefresh(refresh *config.Refresh, failures int, random func() float64) time.Duration {
+	delay := refresh.GetInterval()
+	if failures > 0 {
+		delay = refresh.GetInitialBackoff()
+		for i := 1; i < failures && delay < refresh.GetMaxBackoff(); i++ {
+			delay *= 2
 		}
+		if delay > refresh.GetMaxBackoff() {
+			delay = refresh.GetMaxBackoff()
+		}
+	}
+	if jitter := refresh.GetJitter(); jitter > 0 {
+		delay += time.Duration((2*random() - 1) * jitter * float64(delay))
+	}
+	return delay
+}
 
-		m.logger.V(1).Info(
-			"Refreshed external metrics",
-			"metrics_count", len(externalMetrics),
-			"client_name", m.GetClient().GetConfiguration().Name,
+// refreshMetrics refreshes the list of the metrics of a given type served by the client.
+func (m *metricJob) refreshMetrics(ctx context.Context, metricType config.MetricType) error {
+	clientName := m.GetClient().GetConfiguration().Name
+	count, err := m.listMetrics(ctx, metricType)
+	if ctx.Err() != nil {
+		// The job has been stopped.
+		return ctx.Err()
+	}
+	refreshTimestamp.WithLabelValues(clientName, string(metricType)).SetToCurrentTime()
+	if err != nil {
+		m.logger.Error(err,
+			fmt.Sprintf("Failed to update %s metric list", metricType),
+			"client_name", clientName,
 			"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
 		)
+		refreshSuccess.WithLabelValues(clientName, string(metricType)).Set(0)
+		m.publishError(metricType, err)
+		return err
+	}
+	refreshSuccess.WithLabelValues(clientName, string(metricType)).Set(1)
+	m.logger.V(1).Info(
+		fmt.Sprintf("Refreshed %s metrics", metricType),
+		"metrics_count", count,
+		"client_name", clientName,
+		"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
+	)
+	return nil
+}
 
+// listMetrics lists the metrics of a given type served by the client and notifies the listeners, it returns the number
+// of metrics.
+func (m *metricJob) listMetrics(ctx context.Context, metricType config.MetricType) (int, error) {
+	switch metricType {
+	case config.CustomMetricType:
+		customMetrics, err := m.c.ListCustomMetricInfos(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, listener := range m.listeners {
+			listener.UpdateCustomMetrics(m.c, customMetrics)
+		}
+		return len(customMetrics), nil
+	case config.ExternalMetricType:
+		externalMetrics, err := m.c.ListExternalMetrics(ctx)
+		if err != nil {
+			return 0, err
+		}
 		for _, listener := range m.listeners {
 			listener.UpdateExternalMetrics(m.c, externalMetrics)
 		}
+		return len(externalMetrics), nil
 	}
-
-	m.syncDone.Do(func() {
-		m.logger.V(1).Info(
-			"First sync successful",
-			"client_name", m.GetClient().GetConfiguration().Name,
-			"client_host", m.GetClient().GetConfiguration().ClientConfig.Host,
-		)
-		m.wg.Done()
-	})
+	return 0, fmt.Errorf("unknown metric type: %s", metricType)
 }
 
 func (m *metricJob) publishError(metricType config.MetricType, err error) {
@@ -0,0 +1,188 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/client"
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+func Test_nextRefresh(t *testing.T) {
+	refresh := &config.Refresh{
+		Interval:       time.Hour,
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+	}
+	tests := []struct {
+		name     string
+		refresh  *config.Refresh
+		failures int
+		random   float64
+		want     time.Duration
+	}{
+		{
+			name: "default interval",
+			want: time.Minute,
+		},
+		{
+			name:     "default backoff",
+			failures: 1,
+			want:     5 * time.Second,
+		},
+		{
+			name:    "interval",
+			refresh: refresh,
+			want:    time.Hour,
+		},
+		{
+			name:     "first failure",
+			refresh:  refresh,
+			failures: 1,
+			want:     time.Second,
+		},
+		{
+			name:     "consecutive failures",
+			refresh:  refresh,
+			failures: 3,
+			want:     4 * time.Second,
+		},
+		{
+			name:     "backoff is capped",
+			refresh:  refresh,
+			failures: 100,
+			want:     10 * time.Second,
+		},
+		{
+			name:    "jitter removed",
+			refresh: &config.Refresh{Interval: 10 * time.Second, Jitter: 0.2},
+			random:  0,
+			want:    8 * time.Second,
+		},
+		{
+			name:    "jitter added",
+			refresh: &config.Refresh{Interval: 10 * time.Second, Jitter: 0.2},
+			random:  0.75,
+			want:    11 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextRefresh(tt.refresh, tt.failures, func() float64 { return tt.random })
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// fakeClient fails to list its custom metrics, or blocks until the context is done, and serves a single external
+// metric.
+type fakeClient struct {
+	config.MetricServer
+	block bool
+}
+
+var _ client.Interface = &fakeClient{}
+
+func newFakeClient(required bool) *fakeClient {
+	return &fakeClient{MetricServer: config.MetricServer{
+		Name:     "client",
+		Required: &required,
+		Refresh:  &config.Refresh{Interval: time.Hour, InitialBackoff: time.Hour, MaxBackoff: time.Hour},
+	}}
+}
+
+func (f *fakeClient) GetConfiguration() config.MetricServer {
+	return f.MetricServer
+}
+
+func (f *fakeClient) GetMetricByName(context.Context, types.NamespacedName, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValue, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) GetMetricBySelector(context.Context, string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) GetExternalMetric(context.Context, string, string, labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	panic("not implemented")
+}
+
+func (f *fakeClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	if f.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("discovery error")
+}
+
+func (f *fakeClient) ListExternalMetrics(context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	return map[provider.ExternalMetricInfo]struct{}{{Metric: "metric"}: {}}, nil
+}
+
+// fakeListener records the external metrics and the errors.
+type fakeListener struct {
+	externalMetrics chan map[provider.ExternalMetricInfo]struct{}
+	errors          chan config.MetricType
+}
+
+func (f *fakeListener) UpdateCustomMetrics(client.Interface, map[provider.CustomMetricInfo]struct{}) {
+}
+
+func (f *fakeListener) UpdateExternalMetrics(_ client.Interface, ems map[provider.ExternalMetricInfo]struct{}) {
+	f.externalMetrics <- ems
+}
+
+func (f *fakeListener) OnError(_ client.Interface, metricType config.MetricType, _ error) {
+	f.errors <- metricType
+}
+
+func Test_metricJob_independentDiscoveries(t *testing.T) {
+	listener := &fakeListener{
+		externalMetrics: make(chan map[provider.ExternalMetricInfo]struct{}, 1),
+		errors:          make(chan config.MetricType, 1),
+	}
+	job := newMetricJob(newFakeClient(true)).
+		WithMetricListeners(listener).
+		WithErrorListeners(listener).(*metricJob)
+	assert.Equal(t, 2, len(job.discoveries))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	job.start(ctx)
+
+	// External metrics are refreshed even if custom metrics cannot be listed.
+	assert.Equal(t, config.CustomMetricType, <-listener.errors)
+	assert.Equal(t, map[provider.ExternalMetricInfo]struct{}{{Metric: "metric"}: {}}, <-listener.externalMetrics)
+
+	// The initial sync of custom metrics is not done.
+	select {
+	case <-job.synced():
+		t.Fatal("initial sync should not be done")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -18,7 +18,9 @@
 package scheduler
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 
@@ -27,20 +29,58 @@ import (
 )
 
 type Scheduler struct {
-	logger  logr.Logger
-	wg      *sync.WaitGroup
+	logger logr.Logger
+
+	lock    sync.Mutex
 	sources []Job
+	// listeners and errorListeners are also registered in the jobs of the clients added later.
+	listeners      []MetricListener
+	errorListeners []ErrorListener
+
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
-// Start starts all the metric sources.
-func (s *Scheduler) Start() *Scheduler {
+// Start starts all the metric sources, they are stopped when the context is done or when Stop is called.
+func (s *Scheduler) Start(ctx context.Context) *Scheduler {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ctx, s.stop = context.WithCancel(ctx)
 	for _, source := range s.sources {
-		source.start()
+		source.start(s.ctx)
 	}
 	return s
 }
 
+// Stop stops all the metric sources, in-flight refreshes are cancelled. Wait blocks until they are stopped.
+func (s *Scheduler) Stop() {
+	if s.stop != nil {
+		s.stop()
+	}
+}
+
+// Wait blocks until all the metric sources are stopped.
+func (s *Scheduler) Wait() {
+	sources := s.getSources()
+	for _, source := range sources {
+		source.wait()
+	}
+	s.logger.Info("Metric sources stopped", "sources_count", len(sources))
+}
+
+// getSources returns a copy of the metric sources.
+func (s *Scheduler) getSources() []Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sources := make([]Job, len(s.sources))
+	copy(sources, s.sources)
+	return sources
+}
+
 func (s *Scheduler) WithMetricListeners(listeners ...MetricListener) *Scheduler {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listeners = append(s.listeners, listeners...)
 	for i := range s.sources {
 		for j := range listeners {
 			s.sources[i].WithMetricListeners(listeners[j])
@@ -50,6 +90,9 @@ func (s *Scheduler) WithMetricListeners(listeners ...MetricListener) *Scheduler
 }
 
 func (s *Scheduler) WithErrorListeners(listeners ...ErrorListener) *Scheduler {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errorListeners = append(s.errorListeners, listeners...)
 	for i := range s.sources {
 		for j := range listeners {
 			s.sources[i].WithErrorListeners(listeners[j])
@@ -62,31 +105,84 @@ func (s *Scheduler) WithErrorListeners(listeners ...ErrorListener) *Scheduler {
 func NewScheduler(clients ...client.Interface) *Scheduler {
 	scheduler := &Scheduler{
 		logger:  log.ForPackage("scheduler"),
-		wg:      &sync.WaitGroup{},
 		sources: make([]Job, len(clients)),
 	}
 	for i := range clients {
-		scheduler.sources[i] = newMetricJob(clients[i], scheduler.wg)
+		scheduler.sources[i] = newMetricJob(clients[i])
 	}
-	scheduler.wg.Add(len(clients))
 	return scheduler
 }
 
 // WithClients adds more metrics clients to the scheduler.
 func (s *Scheduler) WithClients(clients ...client.Interface) *Scheduler {
 	for i := range clients {
-		source := newMetricJob(clients[i], s.wg)
-		s.sources = append(s.sources, source)
-
+		s.AddClient(clients[i])
 	}
-	s.wg.Add(len(clients))
 	return s
 }
 
-// WaitInitialSync blocks until all the
-func (s *Scheduler) WaitInitialSync() *Scheduler {
-	s.logger.Info("Wait until an initial metric list is grabbed from metric clients", "sources_count", len(s.sources))
-	s.wg.Wait()
-	s.logger.Info("Initial metric list is grabbed from metric clients", "sources_count", len(s.sources))
+// AddClient adds a metrics client to the scheduler, its metrics are refreshed right away if the scheduler is started.
+func (s *Scheduler) AddClient(c client.Interface) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	source := newMetricJob(c).WithMetricListeners(s.listeners...).WithErrorListeners(s.errorListeners...)
+	s.sources = append(s.sources, source)
+	if s.ctx != nil {
+		source.start(s.ctx)
+	}
+}
+
+// RemoveClient stops refreshing the metrics of a client and blocks until its in-flight refreshes are cancelled. It
+// returns false if there is no client with this name.
+func (s *Scheduler) RemoveClient(name string) bool {
+	s.lock.Lock()
+	var removed Job
+	for i, source := range s.sources {
+		if source.GetClient().GetConfiguration().Name == name {
+			removed = source
+			s.sources = append(s.sources[:i:i], s.sources[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+	if removed == nil {
+		return false
+	}
+	removed.stop()
+	removed.wait()
+	return true
+}
+
+// WaitInitialSync blocks until all the required metric clients have retrieved an initial list of each type of metrics
+// they serve. The other clients are awaited at most timeout, the clients which have not retrieved their metrics yet keep
+// on trying in the background.
+func (s *Scheduler) WaitInitialSync(timeout time.Duration) *Scheduler {
+	sources := s.getSources()
+	s.logger.Info("Wait until an initial metric list is grabbed from metric clients", "sources_count", len(sources), "timeout", timeout)
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	var degraded []string
+	for _, source := range sources {
+		metricServer := source.GetClient().GetConfiguration()
+		if metricServer.IsRequired() {
+			select {
+			case <-source.synced():
+			case <-s.ctx.Done():
+				// The scheduler has been stopped.
+				return s
+			}
+			continue
+		}
+		select {
+		case <-source.synced():
+		case <-ctx.Done():
+			degraded = append(degraded, metricServer.Name)
+		}
+	}
+	if len(degraded) > 0 {
+		s.logger.Info("Initial metric list is not grabbed from some optional metric clients, starting in degraded mode", "sources_count", len(sources), "degraded", degraded)
+		return s
+	}
+	s.logger.Info("Initial metric list is grabbed from metric clients", "sources_count", len(sources))
 	return s
 }
@@ -0,0 +1,118 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE.txt file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/elastic/elasticsearch-k8s-metrics-adapter/pkg/config"
+)
+
+func TestScheduler_WaitInitialSync(t *testing.T) {
+	// The custom metrics of the client cannot be listed, the client never completes its initial sync.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler := NewScheduler(newFakeClient(false)).Start(ctx)
+	done := make(chan struct{})
+	go func() {
+		scheduler.WaitInitialSync(50 * time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("optional client should not block the initial sync")
+	}
+
+	scheduler = NewScheduler(newFakeClient(true)).Start(ctx)
+	done = make(chan struct{})
+	go func() {
+		scheduler.WaitInitialSync(50 * time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+		assert.Fail(t, "required client should block the initial sync")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestScheduler_Stop(t *testing.T) {
+	blocked := newFakeClient(true)
+	blocked.block = true
+	// The first client waits for its next refresh, the second one is refreshing its custom metrics.
+	scheduler := NewScheduler(newFakeClient(true), blocked).Start(context.Background())
+	initialSync := make(chan struct{})
+	go func() {
+		scheduler.WaitInitialSync(time.Hour)
+		close(initialSync)
+	}()
+
+	scheduler.Stop()
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Wait()
+		close(stopped)
+	}()
+	for _, done := range []chan struct{}{stopped, initialSync} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("scheduler should be stopped")
+		}
+	}
+}
+
+func TestScheduler_AddRemoveClient(t *testing.T) {
+	listener := &fakeListener{
+		externalMetrics: make(chan map[provider.ExternalMetricInfo]struct{}, 1),
+		errors:          make(chan config.MetricType, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler := NewScheduler().WithMetricListeners(listener).WithErrorListeners(listener).Start(ctx)
+
+	// The client added once the scheduler is started is refreshed right away, and notifies the listeners.
+	added := newFakeClient(true)
+	added.block = true
+	scheduler.AddClient(added)
+	select {
+	case <-listener.externalMetrics:
+	case <-time.After(5 * time.Second):
+		t.Fatal("external metrics of the added client should be refreshed")
+	}
+
+	// The custom metrics refresh in progress is cancelled.
+	removed := make(chan bool)
+	go func() {
+		removed <- scheduler.RemoveClient("client")
+	}()
+	select {
+	case ok := <-removed:
+		assert.True(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("client should be removed")
+	}
+	assert.Empty(t, scheduler.getSources())
+	assert.False(t, scheduler.RemoveClient("client"))
+}
@@ -32,11 +32,14 @@ func IsEnabled() bool {
 }
 
 // NewTransaction starts a new transaction and sets up a new context with that transaction that also contains the related
-// APM agent's tracer.
+// APM agent's tracer. If the context already holds a transaction it is reused, and nil is returned.
 func NewTransaction(ctx context.Context, t *apm.Tracer, txName, txType string) (*apm.Transaction, context.Context) {
 	if t == nil {
 		return nil, ctx // apm turned off
 	}
+	if apm.TransactionFromContext(ctx) != nil {
+		return nil, ctx
+	}
 	tx := t.StartTransaction(txName, txType)
 	return tx, apm.ContextWithTransaction(ctx, tx)
 }